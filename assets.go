@@ -0,0 +1,105 @@
+package traefik_plugin_state_geo
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	defaultAssetsPrefix = "/__geoblock/assets/"
+	defaultAssetsMaxAge = time.Hour
+)
+
+// assetTypes are the content types of asset extensions missing from the
+// mime package's built-in table, which the system table may not fill in.
+var assetTypes = map[string]string{
+	".ico":   "image/x-icon",
+	".otf":   "font/otf",
+	".ttf":   "font/ttf",
+	".woff":  "font/woff",
+	".woff2": "font/woff2",
+}
+
+// assetServer serves the files block pages link to, such as logos, styles
+// and fonts, under a reserved path prefix. Requests for the prefix are
+// answered by the middleware, so they are neither geo-blocked nor passed to
+// the backend.
+type assetServer struct {
+	prefix       string
+	dir          http.Dir
+	cacheControl string
+}
+
+func newAssetServer(config *Config) (*assetServer, error) {
+	if config.AssetsDir == "" {
+		if config.AssetsPrefix != "" {
+			return nil, fmt.Errorf("assetsPrefix needs assetsDir")
+		}
+		return nil, nil
+	}
+
+	prefix := config.AssetsPrefix
+	if prefix == "" {
+		prefix = defaultAssetsPrefix
+	}
+	if !strings.HasPrefix(prefix, "/") || path.Clean(prefix) == "/" {
+		return nil, fmt.Errorf("invalid assetsPrefix %q", config.AssetsPrefix)
+	}
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	maxAge, err := parseTTL("assetsMaxAge", config.AssetsMaxAge, defaultAssetsMaxAge)
+	if err != nil {
+		return nil, err
+	}
+	return &assetServer{
+		prefix:       prefix,
+		dir:          http.Dir(config.AssetsDir),
+		cacheControl: fmt.Sprintf("public, max-age=%d", int64(maxAge/time.Second)),
+	}, nil
+}
+
+// match reports whether reqPath is under the asset prefix.
+func (s *assetServer) match(reqPath string) bool {
+	return strings.HasPrefix(reqPath, s.prefix)
+}
+
+// ServeHTTP serves the file reqPath names below the prefix. Directories and
+// dot files are not served, and http.Dir keeps paths inside the directory.
+func (s *assetServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		rw.Header().Set("Allow", "GET, HEAD")
+		http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := path.Clean("/" + strings.TrimPrefix(req.URL.Path, s.prefix))
+	if strings.Contains(name, "/.") {
+		http.NotFound(rw, req)
+		return
+	}
+	f, err := s.dir.Open(name)
+	if err != nil {
+		http.NotFound(rw, req)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		http.NotFound(rw, req)
+		return
+	}
+
+	// ServeContent picks the type from the extension or the content
+	// otherwise.
+	if contentType, ok := assetTypes[strings.ToLower(path.Ext(name))]; ok {
+		rw.Header().Set("Content-Type", contentType)
+	}
+	rw.Header().Set("Cache-Control", s.cacheControl)
+	rw.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(rw, req, info.Name(), info.ModTime(), f)
+}
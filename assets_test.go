@@ -0,0 +1,103 @@
+package traefik_plugin_state_geo
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vikewoods/traefik-plugin-state-geo/internal/geoiptest"
+)
+
+func TestBlockPageAssets(t *testing.T) {
+	dir := t.TempDir()
+	writeTemplateFiles(t, dir, map[string]string{
+		"logo.svg":   `<svg xmlns="http://www.w3.org/2000/svg"></svg>`,
+		"style.css":  "body { color: red; }",
+		"font.woff2": "wOF2",
+		".htpasswd":  "admin:secret",
+	})
+	if err := os.Mkdir(filepath.Join(dir, "img"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := CreateConfig()
+	cfg.AssetsDir = dir
+	cfg.AssetsMaxAge = "24h"
+	cfg.DeniedIPs = []string{geoiptest.IPNewYork}
+	cfg.TemplatePath = writeTemplate(t, "blocked.html", `<link rel="stylesheet" href="{{.AssetsPrefix}}style.css">`)
+	cfg.BlockedStates = []string{"CA"}
+	cfg.DBPath = geoiptest.WriteCityDB(t)
+	handler := newTestHandler(t, cfg, nil)
+
+	tests := []struct {
+		ip           string
+		method       string
+		path         string
+		expectedCode int
+		contentType  string
+	}{
+		// Assets are served to blocked and denied visitors alike.
+		{geoiptest.IPCalifornia, http.MethodGet, "/__geoblock/assets/style.css", http.StatusOK, "text/css; charset=utf-8"},
+		{geoiptest.IPNewYork, http.MethodGet, "/__geoblock/assets/logo.svg", http.StatusOK, "image/svg+xml"},
+		{geoiptest.IPCalifornia, http.MethodHead, "/__geoblock/assets/font.woff2", http.StatusOK, "font/woff2"},
+		{geoiptest.IPCalifornia, http.MethodGet, "/__geoblock/assets/missing.png", http.StatusNotFound, ""},
+		{geoiptest.IPCalifornia, http.MethodGet, "/__geoblock/assets/../stateblock.go", http.StatusNotFound, ""},
+		{geoiptest.IPCalifornia, http.MethodGet, "/__geoblock/assets/.htpasswd", http.StatusNotFound, ""},
+		{geoiptest.IPCalifornia, http.MethodGet, "/__geoblock/assets/img", http.StatusNotFound, ""},
+		{geoiptest.IPCalifornia, http.MethodPost, "/__geoblock/assets/style.css", http.StatusMethodNotAllowed, ""},
+		// Other paths still get the geo decision.
+		{geoiptest.IPCalifornia, http.MethodGet, "/__geoblock/style.css", http.StatusForbidden, ""},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "http://localhost"+tt.path, nil)
+		req.RemoteAddr = net.JoinHostPort(tt.ip, "1234")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+
+		if recorder.Code != tt.expectedCode {
+			t.Errorf("%s %s: expected status %d, got %d", tt.method, tt.path, tt.expectedCode, recorder.Code)
+		}
+		if tt.expectedCode != http.StatusOK {
+			continue
+		}
+		if got := recorder.Header().Get("Content-Type"); got != tt.contentType {
+			t.Errorf("%s: expected Content-Type %s, got %s", tt.path, tt.contentType, got)
+		}
+		if got := recorder.Header().Get("Cache-Control"); got != "public, max-age=86400" {
+			t.Errorf("%s: unexpected Cache-Control %q", tt.path, got)
+		}
+		if recorder.Header().Get("Last-Modified") == "" {
+			t.Errorf("%s: expected Last-Modified", tt.path)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+	req.RemoteAddr = net.JoinHostPort(geoiptest.IPCalifornia, "1234")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	if got := recorder.Body.String(); got != `<link rel="stylesheet" href="/__geoblock/assets/style.css">` {
+		t.Errorf("unexpected block page %s", got)
+	}
+}
+
+func TestAssetsConfig(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	invalid := []*Config{
+		{AssetsPrefix: "/assets/"},
+		{AssetsDir: t.TempDir(), AssetsPrefix: "assets/"},
+		{AssetsDir: t.TempDir(), AssetsPrefix: "/"},
+		{AssetsDir: t.TempDir(), AssetsMaxAge: "forever"},
+	}
+	for _, cfg := range invalid {
+		cfg.DBPath = geoiptest.WriteCityDB(t)
+		if _, err := New(context.Background(), next, cfg, "assets-config-test"); err == nil {
+			t.Errorf("expected %+v to be rejected", cfg)
+		}
+	}
+}
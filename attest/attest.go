@@ -0,0 +1,259 @@
+// Package attest signs and verifies the geo attestation the middleware adds
+// to requests it passes to backends. An attestation states which client
+// address the middleware decided on, the jurisdiction it was located in, the
+// decision, the database it was made with and until when the statement
+// holds, so a backend can tell geo headers set by the middleware from ones a
+// misrouted request carried in.
+//
+// Tokens are compact: the base64url encoded JSON claims and the base64url
+// encoded signature over them, joined by a dot. They are signed with
+// HMAC-SHA256 (shared secret) or Ed25519 (the backend only needs the public
+// key). A backend verifies them with
+//
+//	v := attest.NewVerifier()
+//	v.AddEd25519Key("2024-06", publicKey)
+//	claims, err := v.Verify(req.Header.Get("X-Geo-Attestation"), time.Now())
+//
+// and should compare claims.IP with the client address it sees.
+//
+// The package has no dependencies outside the standard library and uses no
+// generics, so the middleware can use it under Traefik's interpreter.
+package attest
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Version is the claims format version this package writes and accepts.
+const Version = 1
+
+// Signature algorithms.
+const (
+	AlgHMACSHA256 = "HS256"
+	AlgEd25519    = "EdDSA"
+)
+
+// Key specification prefixes, see ParseSigner.
+const (
+	keyPrefixHMAC    = "hmac-sha256:"
+	keyPrefixEd25519 = "ed25519:"
+)
+
+// minHMACKeySize is the shortest HMAC secret accepted, the SHA-256 output
+// size recommended by RFC 2104.
+const minHMACKeySize = 32
+
+var (
+	// ErrMalformed is returned for tokens that cannot be decoded.
+	ErrMalformed = errors.New("attest: malformed token")
+	// ErrUnknownKey is returned for tokens signed with a key ID and
+	// algorithm the verifier has no key for.
+	ErrUnknownKey = errors.New("attest: unknown key")
+	// ErrSignature is returned for tokens whose signature does not match.
+	ErrSignature = errors.New("attest: invalid signature")
+	// ErrExpired is returned for tokens past their expiry.
+	ErrExpired = errors.New("attest: token expired")
+)
+
+// Claims are the statements of an attestation.
+type Claims struct {
+	// Version is the claims format, see Version.
+	Version int `json:"v"`
+	// Alg and KeyID identify the key the token is signed with.
+	Alg   string `json:"alg"`
+	KeyID string `json:"kid,omitempty"`
+
+	// IP is the client address the decision was made for.
+	IP string `json:"ip"`
+	// Jurisdiction is the ISO 3166-2 code of the state (US-NY), the
+	// country code outside the US (GB), or empty when the request was let
+	// through without a location, e.g. for whitelisted addresses.
+	Jurisdiction string `json:"jur,omitempty"`
+	// Decision is why the request was let through: allowed,
+	// ip_whitelisted, path_whitelisted, fail_open, or the block reason of
+	// visitors passed to their redirect landing page or let through in
+	// report-only mode.
+	Decision string `json:"dec"`
+	// Database identifies the database build the decision was made with:
+	// epoch:<build_epoch> for MaxMind databases.
+	Database string `json:"db,omitempty"`
+
+	// IssuedAt and Expires are Unix times in seconds.
+	IssuedAt int64 `json:"iat"`
+	Expires  int64 `json:"exp"`
+}
+
+// Signer signs claims with one key.
+type Signer struct {
+	alg     string
+	keyID   string
+	secret  []byte
+	private ed25519.PrivateKey
+}
+
+// NewHMACSigner returns a signer using HMAC-SHA256 with secret, which must
+// be at least 32 bytes long.
+func NewHMACSigner(keyID string, secret []byte) (*Signer, error) {
+	if len(secret) < minHMACKeySize {
+		return nil, fmt.Errorf("attest: HMAC secret must be at least %d bytes", minHMACKeySize)
+	}
+	return &Signer{alg: AlgHMACSHA256, keyID: keyID, secret: append([]byte(nil), secret...)}, nil
+}
+
+// NewEd25519Signer returns a signer using the Ed25519 private key.
+func NewEd25519Signer(keyID string, key ed25519.PrivateKey) (*Signer, error) {
+	if len(key) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("attest: Ed25519 private key must be %d bytes", ed25519.PrivateKeySize)
+	}
+	return &Signer{alg: AlgEd25519, keyID: keyID, private: key}, nil
+}
+
+// ParseSigner returns a signer for a key specification as found in
+// configuration: "hmac-sha256:" followed by the base64 encoded secret, or
+// "ed25519:" followed by the base64 encoded 32 byte seed or 64 byte private
+// key.
+func ParseSigner(keyID, spec string) (*Signer, error) {
+	spec = strings.TrimSpace(spec)
+	switch {
+	case strings.HasPrefix(spec, keyPrefixHMAC):
+		secret, err := decodeKey(strings.TrimPrefix(spec, keyPrefixHMAC))
+		if err != nil {
+			return nil, err
+		}
+		return NewHMACSigner(keyID, secret)
+	case strings.HasPrefix(spec, keyPrefixEd25519):
+		key, err := decodeKey(strings.TrimPrefix(spec, keyPrefixEd25519))
+		if err != nil {
+			return nil, err
+		}
+		if len(key) == ed25519.SeedSize {
+			key = ed25519.NewKeyFromSeed(key)
+		}
+		return NewEd25519Signer(keyID, key)
+	}
+	return nil, fmt.Errorf("attest: key must start with %q or %q", keyPrefixHMAC, keyPrefixEd25519)
+}
+
+// decodeKey accepts standard and URL base64, padded or not.
+func decodeKey(s string) ([]byte, error) {
+	s = strings.TrimRight(strings.TrimSpace(s), "=")
+	if key, err := base64.RawStdEncoding.DecodeString(s); err == nil {
+		return key, nil
+	}
+	key, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.New("attest: key is not valid base64")
+	}
+	return key, nil
+}
+
+// PublicKey returns the Ed25519 public key backends verify with, or nil for
+// HMAC signers.
+func (s *Signer) PublicKey() ed25519.PublicKey {
+	if s.private == nil {
+		return nil
+	}
+	return s.private.Public().(ed25519.PublicKey)
+}
+
+// Sign returns the token for c. Version, Alg and KeyID are set by the
+// signer.
+func (s *Signer) Sign(c Claims) (string, error) {
+	c.Version, c.Alg, c.KeyID = Version, s.alg, s.keyID
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+
+	var sig []byte
+	if s.alg == AlgHMACSHA256 {
+		mac := hmac.New(sha256.New, s.secret)
+		mac.Write([]byte(encoded))
+		sig = mac.Sum(nil)
+	} else {
+		sig = ed25519.Sign(s.private, []byte(encoded))
+	}
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// Verifier checks tokens against a set of keys, so keys can be rotated by
+// adding the new one before the middleware switches to it.
+type Verifier struct {
+	secrets    map[string][]byte
+	publicKeys map[string]ed25519.PublicKey
+}
+
+// NewVerifier returns a verifier without keys.
+func NewVerifier() *Verifier {
+	return &Verifier{secrets: make(map[string][]byte), publicKeys: make(map[string]ed25519.PublicKey)}
+}
+
+// AddHMACKey accepts tokens signed with HMAC-SHA256 and secret under keyID.
+func (v *Verifier) AddHMACKey(keyID string, secret []byte) {
+	v.secrets[keyID] = append([]byte(nil), secret...)
+}
+
+// AddEd25519Key accepts tokens signed with the private key of key under
+// keyID.
+func (v *Verifier) AddEd25519Key(keyID string, key ed25519.PublicKey) {
+	v.publicKeys[keyID] = key
+}
+
+// Verify checks the signature and expiry of token and returns its claims.
+// The algorithm must match the type of the key registered for the key ID,
+// so an Ed25519 public key is never used as an HMAC secret.
+func (v *Verifier) Verify(token string, now time.Time) (Claims, error) {
+	encoded, sigPart, ok := strings.Cut(token, ".")
+	if !ok || encoded == "" || sigPart == "" {
+		return Claims{}, ErrMalformed
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return Claims{}, ErrMalformed
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(sigPart)
+	if err != nil {
+		return Claims{}, ErrMalformed
+	}
+	var c Claims
+	if err := json.Unmarshal(payload, &c); err != nil || c.Version != Version {
+		return Claims{}, ErrMalformed
+	}
+
+	switch c.Alg {
+	case AlgHMACSHA256:
+		secret, ok := v.secrets[c.KeyID]
+		if !ok {
+			return Claims{}, ErrUnknownKey
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(encoded))
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return Claims{}, ErrSignature
+		}
+	case AlgEd25519:
+		key, ok := v.publicKeys[c.KeyID]
+		if !ok {
+			return Claims{}, ErrUnknownKey
+		}
+		if len(key) != ed25519.PublicKeySize || !ed25519.Verify(key, []byte(encoded), sig) {
+			return Claims{}, ErrSignature
+		}
+	default:
+		return Claims{}, ErrUnknownKey
+	}
+
+	if now.Unix() >= c.Expires {
+		return Claims{}, ErrExpired
+	}
+	return c, nil
+}
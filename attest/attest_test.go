@@ -0,0 +1,141 @@
+package attest
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	testSecret = []byte("0123456789abcdef0123456789abcdef")
+	testSeed   = []byte("fedcba9876543210fedcba9876543210")
+	testNow    = time.Unix(1700000000, 0)
+)
+
+func testClaims() Claims {
+	return Claims{
+		IP:           "161.185.160.93",
+		Jurisdiction: "US-NY",
+		Decision:     "allowed",
+		Database:     "epoch:1700000000",
+		IssuedAt:     testNow.Unix(),
+		Expires:      testNow.Add(time.Minute).Unix(),
+	}
+}
+
+func TestSignAndVerify(t *testing.T) {
+	hmacSigner, err := NewHMACSigner("h1", testSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edSigner, err := NewEd25519Signer("e1", ed25519.NewKeyFromSeed(testSeed))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := NewVerifier()
+	v.AddHMACKey("h1", testSecret)
+	v.AddEd25519Key("e1", edSigner.PublicKey())
+
+	for _, signer := range []*Signer{hmacSigner, edSigner} {
+		token, err := signer.Sign(testClaims())
+		if err != nil {
+			t.Fatal(err)
+		}
+		claims, err := v.Verify(token, testNow)
+		if err != nil {
+			t.Fatalf("%s: %v", signer.alg, err)
+		}
+		want := testClaims()
+		want.Version, want.Alg, want.KeyID = Version, signer.alg, signer.keyID
+		if claims != want {
+			t.Errorf("%s: expected %+v, got %+v", signer.alg, want, claims)
+		}
+	}
+	if hmacSigner.PublicKey() != nil {
+		t.Error("expected no public key for HMAC")
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	edSigner, _ := NewEd25519Signer("e1", ed25519.NewKeyFromSeed(testSeed))
+	hmacSigner, _ := NewHMACSigner("h1", testSecret)
+	otherSigner, _ := NewHMACSigner("h1", []byte(strings.Repeat("x", 32)))
+
+	v := NewVerifier()
+	v.AddHMACKey("h1", testSecret)
+	v.AddEd25519Key("e1", edSigner.PublicKey())
+
+	valid, _ := hmacSigner.Sign(testClaims())
+	forged, _ := otherSigner.Sign(testClaims())
+	payload, sig, _ := strings.Cut(valid, ".")
+	tampered := testClaims()
+	tampered.Jurisdiction = "US-CA"
+	tamperedToken, _ := hmacSigner.Sign(tampered)
+	tamperedPayload, _, _ := strings.Cut(tamperedToken, ".")
+	unknownKey, _ := NewHMACSigner("h2", testSecret)
+	unknownToken, _ := unknownKey.Sign(testClaims())
+
+	// An HS256 token naming the Ed25519 key ID must not be checked with the
+	// public key as HMAC secret.
+	confusedPayload := base64.RawURLEncoding.EncodeToString([]byte(
+		`{"v":1,"alg":"HS256","kid":"e1","ip":"x","dec":"allowed","iat":0,"exp":9999999999}`))
+
+	tests := []struct {
+		name  string
+		token string
+		now   time.Time
+		err   error
+	}{
+		{"expired", valid, testNow.Add(time.Minute), ErrExpired},
+		{"wrong secret", forged, testNow, ErrSignature},
+		{"tampered", tamperedPayload + "." + sig, testNow, ErrSignature},
+		{"unknown key", unknownToken, testNow, ErrUnknownKey},
+		{"algorithm confusion", confusedPayload + "." + sig, testNow, ErrUnknownKey},
+		{"empty", "", testNow, ErrMalformed},
+		{"no signature", payload, testNow, ErrMalformed},
+		{"bad base64", "!!." + sig, testNow, ErrMalformed},
+		{"not json", base64.RawURLEncoding.EncodeToString([]byte("nope")) + "." + sig, testNow, ErrMalformed},
+	}
+	for _, tt := range tests {
+		if _, err := v.Verify(tt.token, tt.now); !errors.Is(err, tt.err) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.err, err)
+		}
+	}
+}
+
+func TestParseSigner(t *testing.T) {
+	seed := base64.StdEncoding.EncodeToString(testSeed)
+	private := base64.RawURLEncoding.EncodeToString(ed25519.NewKeyFromSeed(testSeed))
+
+	for _, spec := range []string{
+		"hmac-sha256:" + base64.StdEncoding.EncodeToString(testSecret),
+		"ed25519:" + seed,
+		"ed25519:" + private + "\n",
+	} {
+		if _, err := ParseSigner("k", spec); err != nil {
+			t.Errorf("%q: %v", spec, err)
+		}
+	}
+
+	s1, _ := ParseSigner("k", "ed25519:"+seed)
+	s2, _ := ParseSigner("k", "ed25519:"+private)
+	if !s1.PublicKey().Equal(s2.PublicKey()) {
+		t.Error("expected the seed and the private key to give the same key")
+	}
+
+	for _, spec := range []string{
+		"",
+		"rsa:AAAA",
+		"hmac-sha256:c2hvcnQ=",
+		"hmac-sha256:not base64!",
+		"ed25519:" + base64.StdEncoding.EncodeToString([]byte("short")),
+	} {
+		if _, err := ParseSigner("k", spec); err == nil {
+			t.Errorf("expected %q to be rejected", spec)
+		}
+	}
+}
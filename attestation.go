@@ -0,0 +1,97 @@
+package traefik_plugin_state_geo
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/vikewoods/traefik-plugin-state-geo/attest"
+)
+
+const (
+	defaultAttestationHeader = "X-Geo-Attestation"
+	defaultAttestationTTL    = time.Minute
+)
+
+// attestor adds a signed attestation of the decision to requests passed to
+// the backend, see the attest package.
+type attestor struct {
+	header string
+	signer *attest.Signer
+	ttl    time.Duration
+}
+
+func newAttestor(config *Config) (*attestor, error) {
+	spec := config.AttestationKey
+	if config.AttestationKeyPath != "" {
+		if spec != "" {
+			return nil, fmt.Errorf("attestationKey and attestationKeyPath are mutually exclusive")
+		}
+		content, err := os.ReadFile(config.AttestationKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("invalid attestationKeyPath: %w", err)
+		}
+		spec = string(content)
+	}
+	if spec == "" {
+		if config.AttestationHeader != "" || config.AttestationKeyID != "" || config.AttestationTTL != "" {
+			return nil, fmt.Errorf("attestation options need attestationKey or attestationKeyPath")
+		}
+		return nil, nil
+	}
+
+	signer, err := attest.ParseSigner(config.AttestationKeyID, spec)
+	if err != nil {
+		// The error never contains the key.
+		return nil, fmt.Errorf("invalid attestation key: %w", err)
+	}
+	ttl, err := parseTTL("attestationTTL", config.AttestationTTL, defaultAttestationTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	header := defaultAttestationHeader
+	if config.AttestationHeader != "" {
+		header = http.CanonicalHeaderKey(strings.TrimSpace(config.AttestationHeader))
+	}
+	if header == "" || strings.ContainsAny(header, " \t\r\n:") {
+		return nil, fmt.Errorf("invalid attestationHeader %q", config.AttestationHeader)
+	}
+	return &attestor{header: header, signer: signer, ttl: ttl}, nil
+}
+
+// set replaces the attestation header of req. ip is the client address the
+// decision was made for.
+func (t *attestor) set(req *http.Request, ip string, claims attest.Claims) error {
+	req.Header.Del(t.header)
+
+	now := time.Now()
+	claims.IP = ip
+	claims.IssuedAt = now.Unix()
+	claims.Expires = now.Add(t.ttl).Unix()
+	token, err := t.signer.Sign(claims)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(t.header, token)
+	return nil
+}
+
+// attest adds the attestation for a request let through for reason. addr is
+// invalid when the client address was not parsed.
+func (a *StateBlock) attest(req *http.Request, addr netip.Addr, entry cacheEntry, reason string) {
+	ip := getRemoteIP(req)
+	if addr.IsValid() {
+		ip = addr.String()
+	}
+	claims := attest.Claims{Jurisdiction: entry.jurisdiction(), Decision: reason}
+	if db := a.currentDB(); db != nil {
+		claims.Database = db.currentVersion()
+	}
+	if err := a.attestor.set(req, ip, claims); err != nil {
+		fmt.Fprintf(os.Stderr, "[%s] ERROR: failed to sign geo attestation: %v\n", a.name, err)
+	}
+}
@@ -0,0 +1,104 @@
+package traefik_plugin_state_geo
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/vikewoods/traefik-plugin-state-geo/attest"
+	"github.com/vikewoods/traefik-plugin-state-geo/internal/geoiptest"
+)
+
+func TestAttestation(t *testing.T) {
+	seed := []byte("fedcba9876543210fedcba9876543210")
+	keyPath := writeTemplate(t, "attestation.key", "ed25519:"+base64.StdEncoding.EncodeToString(seed)+"\n")
+
+	cfg := CreateConfig()
+	cfg.BlockedStates = []string{"CA"}
+	cfg.WhitelistedPaths = []string{"/health"}
+	cfg.DBPath = geoiptest.WriteCityDB(t)
+	cfg.AttestationKeyPath = keyPath
+	cfg.AttestationKeyID = "2024-06"
+	cfg.AttestationTTL = "30s"
+
+	var token string
+	var forwarded bool
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		forwarded = true
+		if values := req.Header.Values("X-Geo-Attestation"); len(values) == 1 {
+			token = values[0]
+		}
+	})
+	handler := newTestHandler(t, cfg, next)
+
+	verifier := attest.NewVerifier()
+	verifier.AddEd25519Key("2024-06", ed25519.NewKeyFromSeed(seed).Public().(ed25519.PublicKey))
+
+	tests := []struct {
+		ip           string
+		path         string
+		jurisdiction string
+		decision     string
+	}{
+		{geoiptest.IPNewYork, "/", "US-NY", "allowed"},
+		{geoiptest.IPv6NewYork, "/", "US-NY", "allowed"},
+		{geoiptest.IPCalifornia, "/health", "", "path_whitelisted"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost"+tt.path, nil)
+		req.RemoteAddr = net.JoinHostPort(tt.ip, "1234")
+		// Spoofed by the client.
+		req.Header.Set("X-Geo-Attestation", "forged.token")
+		token = ""
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		claims, err := verifier.Verify(token, time.Now())
+		if err != nil {
+			t.Fatalf("%s %s: %v", tt.ip, tt.path, err)
+		}
+		if claims.IP != tt.ip || claims.Jurisdiction != tt.jurisdiction || claims.Decision != tt.decision {
+			t.Errorf("%s %s: unexpected claims %+v", tt.ip, tt.path, claims)
+		}
+		if claims.Database != "epoch:1700000000" || claims.Expires-claims.IssuedAt != 30 {
+			t.Errorf("%s %s: unexpected database or expiry %+v", tt.ip, tt.path, claims)
+		}
+		if _, err := verifier.Verify(token, time.Now().Add(31*time.Second)); err != attest.ErrExpired {
+			t.Errorf("%s %s: expected the attestation to expire, got %v", tt.ip, tt.path, err)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+	req.RemoteAddr = net.JoinHostPort(geoiptest.IPCalifornia, "1234")
+	forwarded = false
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if forwarded {
+		t.Error("expected the blocked request not to be forwarded")
+	}
+}
+
+func TestAttestationConfig(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	hmacKey := "hmac-sha256:" + base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+
+	invalid := []*Config{
+		{AttestationKey: "hmac-sha256:c2hvcnQ="},
+		{AttestationKey: "plain-secret"},
+		{AttestationKey: hmacKey, AttestationKeyPath: "/dev/null"},
+		{AttestationKeyPath: "/nonexistent/attestation.key"},
+		{AttestationKey: hmacKey, AttestationTTL: "soon"},
+		{AttestationKey: hmacKey, AttestationHeader: "X Geo"},
+		{AttestationKeyID: "2024-06"},
+	}
+	for _, cfg := range invalid {
+		cfg.DBPath = geoiptest.WriteCityDB(t)
+		if _, err := New(context.Background(), next, cfg, "attestation-config-test"); err == nil {
+			t.Errorf("expected %+v to be rejected", cfg)
+		}
+	}
+}
@@ -0,0 +1,463 @@
+package traefik_plugin_state_geo
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	texttemplate "text/template"
+	"time"
+)
+
+// Reason codes of a blocked request, available to templates as .Reason.
+const (
+	reasonStateBlocked    = "state_blocked"
+	reasonCountryBlocked  = "country_blocked"
+	reasonUnknownLocation = "unknown_location"
+	reasonIPDenied        = "ip_denied"
+	reasonDBUnavailable   = "database_unavailable"
+)
+
+// blockReasons lists every reason code, e.g. to validate statusCodes.
+var blockReasons = []string{
+	reasonStateBlocked,
+	reasonCountryBlocked,
+	reasonUnknownLocation,
+	reasonIPDenied,
+	reasonDBUnavailable,
+}
+
+// locationReason reports whether reason is a decision on the visitor's
+// location, the blocks redirects and report-only mode apply to.
+func locationReason(reason string) bool {
+	switch reason {
+	case reasonStateBlocked, reasonCountryBlocked, reasonUnknownLocation:
+		return true
+	}
+	return false
+}
+
+// problemTypePrefix is the stable prefix of the problem+json type URIs; the
+// reason code completes it.
+const problemTypePrefix = "urn:traefik-plugin-state-geo:problem:"
+
+// legacyStatePlaceholder is the placeholder of templates written for the
+// plain text replacement block pages used to do.
+const legacyStatePlaceholder = "{{STATE}}"
+
+var (
+	defaultBlockTemplate = template.Must(template.New("blocked").Parse(
+		"<h1>Access Denied</h1><p>State: {{.Location}}</p>"))
+	defaultTextTemplate = texttemplate.Must(texttemplate.New("blocked").Parse(
+		"{{.Title}}\n{{.Detail}}\nReference: {{.RequestID}}\n"))
+)
+
+var problemTitles = map[string]string{
+	reasonStateBlocked:    "Access from this state is restricted",
+	reasonCountryBlocked:  "Access from this country is restricted",
+	reasonUnknownLocation: "Your location could not be determined",
+	reasonIPDenied:        "Access from this address is restricted",
+	reasonDBUnavailable:   "Location service unavailable",
+}
+
+// BlockPage is the data block response templates are rendered with. HTML
+// templates use html/template, so every value is escaped for the context it
+// appears in; JSON and plain text templates use text/template and can encode
+// values with the json function.
+type BlockPage struct {
+	// Reason is state_blocked, country_blocked, unknown_location, ip_denied
+	// for deniedIPs, or database_unavailable while the database has not
+	// loaded yet.
+	Reason string
+
+	// Status is the HTTP status code of the response. ProblemType, Title
+	// and Detail are the members of the problem+json response.
+	Status      int
+	ProblemType string
+	Title       string
+	Detail      string
+
+	// CountryCode and StateCode are ISO 3166 codes; StateCode is only set
+	// for US visitors. The names are in the language of the template
+	// variant, or the first Accept-Language language the database has names
+	// in, and in English otherwise. Detail always uses the English names.
+	CountryCode string
+	CountryName string
+	StateCode   string
+	StateName   string
+
+	// Location is the value the legacy {{STATE}} placeholder renders: the
+	// state code, the country code outside the US, or "Unknown" for US
+	// addresses without a state.
+	Location string
+
+	ClientIP string
+	// RequestID is the incoming X-Request-Id, or a random ID when the
+	// request has none.
+	RequestID string
+	Timestamp time.Time
+	Host      string
+	Path      string
+
+	// SupportContact is the supportContact option.
+	SupportContact string
+
+	// AssetsPrefix is the path the files of assetsDir are served under,
+	// e.g. /__geoblock/assets/, empty without assetsDir.
+	AssetsPrefix string
+
+	// Language is the language tag of the template variant picked from
+	// Accept-Language, empty for the template without a language.
+	Language string
+}
+
+// problemDetails is the RFC 9457 body of JSON block responses.
+type problemDetails struct {
+	Type           string    `json:"type"`
+	Title          string    `json:"title"`
+	Status         int       `json:"status"`
+	Detail         string    `json:"detail"`
+	Instance       string    `json:"instance,omitempty"`
+	Reason         string    `json:"reason"`
+	CountryCode    string    `json:"countryCode,omitempty"`
+	CountryName    string    `json:"countryName,omitempty"`
+	StateCode      string    `json:"stateCode,omitempty"`
+	StateName      string    `json:"stateName,omitempty"`
+	ClientIP       string    `json:"clientIp,omitempty"`
+	RequestID      string    `json:"requestId"`
+	Timestamp      time.Time `json:"timestamp"`
+	SupportContact string    `json:"supportContact,omitempty"`
+}
+
+// pageTemplate is implemented by both html/template and text/template.
+type pageTemplate interface {
+	Execute(w io.Writer, data interface{}) error
+}
+
+// blockTemplates are the templates of the block response formats. A nil
+// set renders the built-in response of its format. HTML pages can also be
+// chosen per jurisdiction, see jurisdictions.
+type blockTemplates struct {
+	html          *templateSet
+	json          *templateSet
+	text          *templateSet
+	jurisdictions map[string]*templateSet
+}
+
+// loadBlockTemplates parses the configured templates and their language
+// variants. Templates the options do not name are taken from the template
+// directory. A template that does not parse fails the configuration. One
+// that cannot be read is reported and left out at startup, but fails a
+// reload, so a template removed by mistake does not replace the page in use.
+func loadBlockTemplates(c templateConfig, name string, reload bool) (blockTemplates, error) {
+	c, err := c.withDir(name, reload)
+	if err != nil {
+		return blockTemplates{}, err
+	}
+
+	load := func(file templateFile, parse func(name, text string) (pageTemplate, error)) (*templateSet, error) {
+		if file.path == "" {
+			return nil, nil
+		}
+		set, err := loadTemplateSet(file.path, parse)
+		if isMissingFile(err) && !reload {
+			fmt.Fprintf(os.Stderr, "[%s] ERROR: failed to pre-load template: %v\n", name, err)
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", file.option, err)
+		}
+		return set, nil
+	}
+
+	var templates blockTemplates
+	if templates.html, err = load(c.html, parseHTMLTemplate); err != nil {
+		return blockTemplates{}, err
+	}
+	if templates.json, err = load(c.json, parseTextTemplate); err != nil {
+		return blockTemplates{}, err
+	}
+	if templates.text, err = load(c.text, parseTextTemplate); err != nil {
+		return blockTemplates{}, err
+	}
+
+	templates.jurisdictions = make(map[string]*templateSet)
+	for jurisdiction, file := range c.jurisdictions {
+		set, err := load(file, parseHTMLTemplate)
+		if err != nil {
+			return blockTemplates{}, err
+		}
+		if set != nil {
+			templates.jurisdictions[jurisdiction] = set
+		}
+	}
+	return templates, nil
+}
+
+// pick chooses the template for page in format, see templateSet.pick. HTML
+// pages of a jurisdiction with templates of its own use those, the others
+// fall back to the format's template.
+func (t *blockTemplates) pick(format string, page BlockPage, langs []string) (pageTemplate, string) {
+	switch format {
+	case formatJSON:
+		return t.json.pick(langs)
+	case formatText:
+		return t.text.pick(langs)
+	}
+	for _, jurisdiction := range jurisdictions(page) {
+		if set, ok := t.jurisdictions[jurisdiction]; ok {
+			return set.pick(langs)
+		}
+	}
+	return t.html.pick(langs)
+}
+
+func parseHTMLTemplate(name, text string) (pageTemplate, error) {
+	tmpl, err := template.New(name).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+func parseTextTemplate(name, text string) (pageTemplate, error) {
+	tmpl, err := texttemplate.New(name).Funcs(textTemplateFuncs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// textTemplateFuncs are available to JSON and text templates. json encodes a
+// value as a JSON literal, so JSON templates stay valid whatever it holds.
+var textTemplateFuncs = texttemplate.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// resolveStatusCodes returns the status code of every reason: the reason's
+// entry in perReason, otherwise status, otherwise 403.
+func resolveStatusCodes(status int, perReason map[string]int) (map[string]int, error) {
+	if status == 0 {
+		status = http.StatusForbidden
+	}
+	if !validBlockStatus(status) {
+		return nil, fmt.Errorf("invalid statusCode %d", status)
+	}
+
+	codes := make(map[string]int, len(blockReasons))
+	for _, reason := range blockReasons {
+		codes[reason] = status
+	}
+	for reason, code := range perReason {
+		if _, ok := codes[reason]; !ok {
+			return nil, fmt.Errorf("invalid statusCodes entry %q: unknown reason", reason)
+		}
+		if !validBlockStatus(code) {
+			return nil, fmt.Errorf("invalid statusCodes entry %q: status %d", reason, code)
+		}
+		codes[reason] = code
+	}
+	return codes, nil
+}
+
+func validBlockStatus(code int) bool {
+	return code >= 400 && code <= 599
+}
+
+// blockPage collects the template data for a request blocked by entry.
+func (a *StateBlock) blockPage(req *http.Request, entry cacheEntry) BlockPage {
+	page := BlockPage{
+		Reason:         entry.reason,
+		Status:         a.statusCodes[entry.reason],
+		ProblemType:    problemTypePrefix + entry.reason,
+		Title:          problemTitles[entry.reason],
+		CountryCode:    entry.countryCode,
+		CountryName:    countryNames[entry.countryCode],
+		StateCode:      entry.stateCode,
+		Location:       entry.location(),
+		ClientIP:       getRemoteIP(req),
+		RequestID:      req.Header.Get("X-Request-Id"),
+		Timestamp:      time.Now().UTC(),
+		Host:           req.Host,
+		Path:           req.URL.Path,
+		SupportContact: a.supportContact,
+	}
+	if a.assets != nil {
+		page.AssetsPrefix = a.assets.prefix
+	}
+	if entry.countryCode == "US" {
+		page.StateName = usStateNames[entry.stateCode]
+	}
+	if page.RequestID == "" {
+		page.RequestID = newRequestID()
+	}
+	if page.Status == 0 {
+		page.Status = http.StatusForbidden
+	}
+
+	switch {
+	case entry.reason == reasonDBUnavailable:
+		page.Detail = "This service is temporarily unavailable while locations cannot be checked."
+	case entry.reason == reasonIPDenied:
+		page.Detail = "This service is not available from your network."
+	case entry.reason == reasonUnknownLocation:
+		page.Detail = "This service is only available where your location can be determined."
+	case page.StateName != "":
+		page.Detail = fmt.Sprintf("This service is not available in %s (%s).", page.StateName, page.StateCode)
+	case page.CountryName != "":
+		page.Detail = fmt.Sprintf("This service is not available in %s (%s).", page.CountryName, page.CountryCode)
+	default:
+		page.Detail = fmt.Sprintf("This service is not available in %s.", page.Location)
+	}
+	return page
+}
+
+// localizeNames replaces the English country and state names of page with
+// the names the database has in the first of langs, see localizedName.
+// Decisions restored from a snapshot can come before any record naming the
+// location was decoded, so the client address is looked up once to fill in
+// the names.
+func (a *StateBlock) localizeNames(page *BlockPage, langs []string) {
+	if page.CountryCode == "" {
+		return
+	}
+	shared := a.currentDB()
+	if shared == nil {
+		return
+	}
+	h := shared.acquire()
+	if h == nil {
+		return
+	}
+	defer h.release()
+	db := h.db
+	source, ok := db.(nameSource)
+	if !ok {
+		return
+	}
+
+	names := source.localizedNames(page.CountryCode)
+	if names == nil {
+		if ip := net.ParseIP(page.ClientIP); ip != nil {
+			_, _, _ = db.Lookup(ip)
+			names = source.localizedNames(page.CountryCode)
+		}
+	}
+	page.CountryName = localizedName(names, langs, page.CountryName)
+	if page.StateCode != "" {
+		stateNames := source.localizedNames(page.CountryCode + "-" + page.StateCode)
+		page.StateName = localizedName(stateNames, langs, page.StateName)
+	}
+}
+
+func newRequestID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// serveBlocked writes the block response in the format the client accepts:
+// the HTML page for browsers, problem+json for APIs and plain text otherwise.
+// With action=redirect geo blocks are redirected instead, and in report-only
+// mode they are let through.
+func (a *StateBlock) serveBlocked(rw http.ResponseWriter, req *http.Request, entry cacheEntry) {
+	if a.reportOnly != nil && a.reportOnly.applies(entry) {
+		a.serveReportOnly(rw, req, entry)
+		return
+	}
+	if a.serveRedirect(rw, req, entry) {
+		return
+	}
+	if a.debug {
+		fmt.Printf("[%s] DEBUG: Blocking request from state: %s (%s)\n", a.name, entry.location(), entry.reason)
+	}
+
+	page := a.blockPage(req, entry)
+	format := negotiateFormat(req.Header.Get("Accept"))
+
+	langs := parseAcceptLanguage(req.Header.Get("Accept-Language"))
+	templates := a.currentTemplates()
+	tmpl, lang := templates.pick(format, page, langs)
+	page.Language = lang
+	if lang != "" {
+		// Names follow the language of the page.
+		langs = append([]string{lang}, langs...)
+	}
+	a.localizeNames(&page, langs)
+
+	var body bytes.Buffer
+	var err error
+	var contentType string
+	switch format {
+	case formatJSON:
+		contentType = "application/problem+json"
+		err = render(&body, tmpl, page, encodeProblem)
+	case formatText:
+		contentType = "text/plain; charset=utf-8"
+		err = render(&body, tmpl, page, defaultTextTemplate.Execute)
+	default:
+		contentType = "text/html; charset=utf-8"
+		err = render(&body, tmpl, page, defaultBlockTemplate.Execute)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[%s] ERROR: failed to render %s block response: %v\n", a.name, format, err)
+	}
+
+	rw.Header().Set("Content-Type", contentType)
+	rw.Header().Add("Vary", "Accept")
+	rw.Header().Add("Vary", "Accept-Language")
+	if lang != "" {
+		rw.Header().Set("Content-Language", lang)
+	}
+	if a.blockedBy != "" {
+		rw.Header().Set("Link", "<"+a.blockedBy+`>; rel="blocked-by"`)
+	}
+	rw.WriteHeader(page.Status)
+	_, _ = rw.Write(body.Bytes())
+}
+
+// render executes tmpl, falling back to the built-in response when there is
+// no template or it fails. The template error is returned for logging.
+func render(body *bytes.Buffer, tmpl pageTemplate, page BlockPage, fallback func(io.Writer, interface{}) error) error {
+	if tmpl == nil {
+		return fallback(body, page)
+	}
+	err := tmpl.Execute(body, page)
+	if err != nil {
+		body.Reset()
+		_ = fallback(body, page)
+	}
+	return err
+}
+
+// encodeProblem writes the built-in problem+json body for a BlockPage.
+func encodeProblem(w io.Writer, data interface{}) error {
+	page := data.(BlockPage)
+	return json.NewEncoder(w).Encode(&problemDetails{
+		Type:           page.ProblemType,
+		Title:          page.Title,
+		Status:         page.Status,
+		Detail:         page.Detail,
+		Instance:       page.Path,
+		Reason:         page.Reason,
+		CountryCode:    page.CountryCode,
+		CountryName:    page.CountryName,
+		StateCode:      page.StateCode,
+		StateName:      page.StateName,
+		ClientIP:       page.ClientIP,
+		RequestID:      page.RequestID,
+		Timestamp:      page.Timestamp,
+		SupportContact: page.SupportContact,
+	})
+}
@@ -0,0 +1,373 @@
+package traefik_plugin_state_geo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/vikewoods/traefik-plugin-state-geo/internal/geoiptest"
+)
+
+const blockPageTestTemplate = `reason={{.Reason}}
+country={{.CountryCode}}/{{.CountryName}}
+state={{.StateCode}}/{{.StateName}}
+location={{.Location}}
+ip={{.ClientIP}}
+id={{.RequestID}}
+host={{.Host}}
+path={{.Path}}
+support={{.SupportContact}}
+time={{if .Timestamp.IsZero}}missing{{else}}set{{end}}`
+
+func writeTemplate(t *testing.T, name, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestBlockPageData(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.BlockedStates = []string{"CA"}
+	cfg.DBPath = geoiptest.WriteCityDB(t)
+	cfg.SupportContact = "help@example.com"
+	cfg.TemplatePath = writeTemplate(t, "blocked.html", blockPageTestTemplate)
+	handler := newTestHandler(t, cfg, nil)
+
+	tests := []struct {
+		ip       string
+		expected []string
+	}{
+		{geoiptest.IPCalifornia, []string{
+			"reason=state_blocked", "country=US/United States", "state=CA/California", "location=CA",
+		}},
+		{geoiptest.IPCanadaOntario, []string{
+			"reason=country_blocked", "country=CA/Canada", "state=/", "location=CA",
+		}},
+		{geoiptest.IPUSNoSubdivision, []string{
+			"reason=unknown_location", "country=US/United States", "location=Unknown",
+		}},
+		{geoiptest.IPUnknown, []string{
+			"reason=unknown_location", "country=/", "location=\n",
+		}},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://shop.example.com/checkout", nil)
+		req.RemoteAddr = net.JoinHostPort(tt.ip, "1234")
+		req.Header.Set("X-Request-Id", "req-42")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+
+		body := recorder.Body.String()
+		expected := append(tt.expected,
+			"ip="+tt.ip, "id=req-42", "host=shop.example.com", "path=/checkout",
+			"support=help@example.com", "time=set")
+		for _, want := range expected {
+			if !strings.Contains(body, want) {
+				t.Errorf("%s: expected %q in\n%s", tt.ip, want, body)
+			}
+		}
+	}
+}
+
+func TestBlockPageEscapesValues(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.BlockedStates = []string{"CA"}
+	cfg.DBPath = geoiptest.WriteCityDB(t)
+	cfg.TemplatePath = writeTemplate(t, "blocked.html", "<p>{{.RequestID}}</p><p>{{.Location}}</p>")
+	handler := newTestHandler(t, cfg, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+	req.RemoteAddr = net.JoinHostPort(geoiptest.IPCalifornia, "1234")
+	req.Header.Set("X-Request-Id", `<script>alert("x")</script>`)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	body := recorder.Body.String()
+	if strings.Contains(body, "<script>") {
+		t.Errorf("expected the request ID to be escaped, got %s", body)
+	}
+	if !strings.Contains(body, "&lt;script&gt;") {
+		t.Errorf("expected the escaped request ID in the page, got %s", body)
+	}
+}
+
+func TestBlockPageGeneratesRequestID(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.BlockedStates = []string{"CA"}
+	cfg.DBPath = geoiptest.WriteCityDB(t)
+	cfg.TemplatePath = writeTemplate(t, "blocked.html", "{{.RequestID}}")
+	handler := newTestHandler(t, cfg, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+	req.RemoteAddr = net.JoinHostPort(geoiptest.IPCalifornia, "1234")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	if id := recorder.Body.String(); len(id) != 16 {
+		t.Errorf("expected a generated 16 character request ID, got %q", id)
+	}
+}
+
+func TestInvalidTemplateFailsAtNew(t *testing.T) {
+	broken := "<p>{{.StateCode</p>"
+	configs := map[string]*Config{
+		"templatePath":     {TemplatePath: writeTemplate(t, "blocked.html", broken)},
+		"jsonTemplatePath": {JSONTemplatePath: writeTemplate(t, "blocked.json", broken)},
+		"textTemplatePath": {TextTemplatePath: writeTemplate(t, "blocked.txt", broken)},
+	}
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	for option, cfg := range configs {
+		cfg.DBPath = geoiptest.WriteCityDB(t)
+		if _, err := New(context.Background(), next, cfg, "invalid-template-test"); err == nil {
+			t.Errorf("%s: expected a template parse error", option)
+		}
+	}
+}
+
+func serveBlockedWithAccept(handler http.Handler, accept string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/api/orders", nil)
+	req.RemoteAddr = net.JoinHostPort(geoiptest.IPCalifornia, "1234")
+	req.Header.Set("X-Request-Id", "req-42")
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestBlockResponseNegotiation(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.BlockedStates = []string{"CA"}
+	cfg.DBPath = geoiptest.WriteCityDB(t)
+	cfg.TemplatePath = writeTemplate(t, "blocked.html", "<p>{{.StateName}}</p>")
+	handler := newTestHandler(t, cfg, nil)
+
+	tests := []struct {
+		accept      string
+		contentType string
+		body        string
+	}{
+		{"", "text/html; charset=utf-8", "<p>California</p>"},
+		{"text/html", "text/html; charset=utf-8", "<p>California</p>"},
+		{"application/json", "application/problem+json", `"reason":"state_blocked"`},
+		{"text/plain", "text/plain; charset=utf-8", "This service is not available in California (CA)."},
+		{"image/png", "text/plain; charset=utf-8", "Reference: req-42"},
+	}
+
+	for _, tt := range tests {
+		recorder := serveBlockedWithAccept(handler, tt.accept)
+		if recorder.Code != http.StatusForbidden {
+			t.Errorf("%q: expected status 403, got %d", tt.accept, recorder.Code)
+		}
+		if got := recorder.Header().Get("Content-Type"); got != tt.contentType {
+			t.Errorf("%q: expected Content-Type %s, got %s", tt.accept, tt.contentType, got)
+		}
+		if got := recorder.Header().Get("Vary"); got != "Accept" {
+			t.Errorf("%q: expected Vary: Accept, got %q", tt.accept, got)
+		}
+		if !strings.Contains(recorder.Body.String(), tt.body) {
+			t.Errorf("%q: expected %q in %s", tt.accept, tt.body, recorder.Body.String())
+		}
+	}
+}
+
+func TestProblemDetails(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.BlockedStates = []string{"CA"}
+	cfg.DBPath = geoiptest.WriteCityDB(t)
+	cfg.SupportContact = "help@example.com"
+	handler := newTestHandler(t, cfg, nil)
+	recorder := serveBlockedWithAccept(handler, "application/problem+json")
+
+	var problem map[string]interface{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &problem); err != nil {
+		t.Fatalf("invalid problem+json body %s: %v", recorder.Body.String(), err)
+	}
+
+	expected := map[string]interface{}{
+		"type":           "urn:traefik-plugin-state-geo:problem:state_blocked",
+		"title":          "Access from this state is restricted",
+		"status":         float64(http.StatusForbidden),
+		"detail":         "This service is not available in California (CA).",
+		"instance":       "/api/orders",
+		"reason":         "state_blocked",
+		"countryCode":    "US",
+		"stateCode":      "CA",
+		"stateName":      "California",
+		"clientIp":       geoiptest.IPCalifornia,
+		"requestId":      "req-42",
+		"supportContact": "help@example.com",
+	}
+	for key, want := range expected {
+		if problem[key] != want {
+			t.Errorf("%s: expected %v, got %v", key, want, problem[key])
+		}
+	}
+	if _, ok := problem["timestamp"]; !ok {
+		t.Error("expected a timestamp member")
+	}
+}
+
+func TestCustomJSONAndTextTemplates(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.JSONTemplatePath = writeTemplate(t, "blocked.json", `{"error":{{json .Reason}},"where":{{json .StateName}}}`)
+	cfg.TextTemplatePath = writeTemplate(t, "blocked.txt", "blocked in {{.StateCode}}")
+	cfg.BlockedStates = []string{"CA"}
+	cfg.DBPath = geoiptest.WriteCityDB(t)
+	handler := newTestHandler(t, cfg, nil)
+
+	recorder := serveBlockedWithAccept(handler, "application/json")
+	if got := recorder.Body.String(); got != `{"error":"state_blocked","where":"California"}` {
+		t.Errorf("unexpected JSON body %s", got)
+	}
+	if got := recorder.Header().Get("Content-Type"); got != "application/problem+json" {
+		t.Errorf("expected problem+json, got %s", got)
+	}
+
+	recorder = serveBlockedWithAccept(handler, "text/plain")
+	if got := recorder.Body.String(); got != "blocked in CA" {
+		t.Errorf("unexpected text body %q", got)
+	}
+}
+
+func TestBlockStatusCodes(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.StatusCode = http.StatusNotFound
+	cfg.StatusCodes = map[string]int{
+		"state_blocked":   http.StatusUnavailableForLegalReasons,
+		"country_blocked": http.StatusUnavailableForLegalReasons,
+		"ip_denied":       http.StatusForbidden,
+	}
+	cfg.BlockedBy = "https://legal.example.com/geo"
+	cfg.DeniedIPs = []string{geoiptest.IPNewYork}
+	cfg.BlockedStates = []string{"CA"}
+	cfg.DBPath = geoiptest.WriteCityDB(t)
+	handler := newTestHandler(t, cfg, nil)
+
+	tests := []struct {
+		ip           string
+		expectedCode int
+	}{
+		{geoiptest.IPCalifornia, http.StatusUnavailableForLegalReasons},
+		{geoiptest.IPUnitedKingdom, http.StatusUnavailableForLegalReasons},
+		{geoiptest.IPUSNoSubdivision, http.StatusNotFound},
+		{geoiptest.IPNewYork, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+		req.RemoteAddr = net.JoinHostPort(tt.ip, "1234")
+		req.Header.Set("Accept", "application/json")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+
+		if recorder.Code != tt.expectedCode {
+			t.Errorf("%s: expected status %d, got %d", tt.ip, tt.expectedCode, recorder.Code)
+		}
+		if !strings.Contains(recorder.Body.String(), fmt.Sprintf(`"status":%d`, tt.expectedCode)) {
+			t.Errorf("%s: expected the problem status to match, got %s", tt.ip, recorder.Body.String())
+		}
+		if got := recorder.Header().Get("Link"); got != `<https://legal.example.com/geo>; rel="blocked-by"` {
+			t.Errorf("%s: unexpected Link header %q", tt.ip, got)
+		}
+	}
+}
+
+func TestBlockStatusCodesConfig(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	invalid := []*Config{
+		{StatusCode: http.StatusOK},
+		{StatusCodes: map[string]int{"state_blocked": http.StatusFound}},
+		{StatusCodes: map[string]int{"stateBlocked": http.StatusForbidden}},
+		{DeniedIPs: []string{"10.0.0.0/33"}},
+		{DeniedIPs: []string{"not-an-ip"}},
+	}
+	for _, cfg := range invalid {
+		cfg.DBPath = geoiptest.WriteCityDB(t)
+		if _, err := New(context.Background(), next, cfg, "status-config-test"); err == nil {
+			t.Errorf("expected %+v to be rejected", cfg)
+		}
+	}
+}
+
+func TestBlockPageLocalizedNames(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.BlockedStates = []string{"CA"}
+	cfg.DBPath = geoiptest.WriteCityDB(t)
+	cfg.TemplatePath = writeTemplate(t, "blocked.html", "{{.StateName}}, {{.CountryName}}")
+	handler := newTestHandler(t, cfg, nil)
+
+	tests := []struct {
+		ip       string
+		language string
+		expected string
+	}{
+		{geoiptest.IPCalifornia, "", "California, United States"},
+		{geoiptest.IPCalifornia, "fr-CA,fr;q=0.9", "Californie, États Unis"},
+		{geoiptest.IPCalifornia, "de", "Kalifornien, Vereinigte Staaten"},
+		{geoiptest.IPCalifornia, "ja,de;q=0.5", "Kalifornien, Vereinigte Staaten"},
+		{geoiptest.IPCalifornia, "ja", "California, United States"},
+		// English wins over later languages.
+		{geoiptest.IPCalifornia, "en-US,fr;q=0.9", "California, United States"},
+		{geoiptest.IPMexico, "es", ", México"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+		req.RemoteAddr = net.JoinHostPort(tt.ip, "1234")
+		if tt.language != "" {
+			req.Header.Set("Accept-Language", tt.language)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+
+		if got := recorder.Body.String(); got != tt.expected {
+			t.Errorf("%s %q: expected %q, got %q", tt.ip, tt.language, tt.expected, got)
+		}
+	}
+}
+
+func TestProblemDetailsLocalizedNames(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.BlockedStates = []string{"CA"}
+	cfg.DBPath = geoiptest.WriteCityDB(t)
+	handler := newTestHandler(t, cfg, nil)
+
+	// Decisions restored from a snapshot skip the lookup that decodes names.
+	handler.cache.set(netip.MustParsePrefix("76.79.129.0/24"),
+		cacheEntry{reason: reasonStateBlocked, countryCode: "US", stateCode: "CA"})
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+	req.RemoteAddr = net.JoinHostPort(geoiptest.IPCalifornia, "1234")
+	req.Header.Set("Accept", "application/problem+json")
+	req.Header.Set("Accept-Language", "fr")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	var problem map[string]interface{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &problem); err != nil {
+		t.Fatalf("invalid problem+json body %s: %v", recorder.Body.String(), err)
+	}
+	if problem["stateName"] != "Californie" || problem["countryName"] != "États Unis" {
+		t.Errorf("expected French names, got %v and %v", problem["stateName"], problem["countryName"])
+	}
+	if problem["detail"] != "This service is not available in California (CA)." {
+		t.Errorf("expected the English detail, got %v", problem["detail"])
+	}
+}
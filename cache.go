@@ -0,0 +1,272 @@
+package traefik_plugin_state_geo
+
+import (
+	"container/list"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultCacheSize     = 10000
+	defaultCacheAllowTTL = time.Hour
+	defaultCacheBlockTTL = 10 * time.Minute
+	cacheShards          = 16
+)
+
+// cacheEntry is the decision for a network. reason is empty for allowed
+// entries.
+type cacheEntry struct {
+	allowed     bool
+	reason      string
+	countryCode string
+	stateCode   string
+}
+
+// location is what block pages traditionally show: the state code, the
+// country code outside the US, or "Unknown" for US addresses without a state.
+func (e cacheEntry) location() string {
+	switch {
+	case e.stateCode != "":
+		return e.stateCode
+	case e.countryCode == "US":
+		return "Unknown"
+	}
+	return e.countryCode
+}
+
+// jurisdiction is the ISO 3166-2 code of the state (US-NY), else the country
+// code, see jurisdictions.
+func (e cacheEntry) jurisdiction() string {
+	if e.countryCode != "" && e.stateCode != "" {
+		return e.countryCode + "-" + e.stateCode
+	}
+	return e.countryCode
+}
+
+// CacheStats are the decision cache counters of one middleware instance.
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	// Coalesced counts requests that waited for a concurrent lookup of the
+	// same address instead of running their own.
+	Coalesced uint64
+	Entries   int
+}
+
+// decisionCache is a sharded LRU of decisions keyed by the network the
+// database returned, so one lookup covers every address in the network.
+// Every shard has its own lock and list, so concurrent requests for different
+// networks rarely contend. Allowed and blocked decisions expire after their
+// own TTL.
+//
+// Lookups probe the prefix lengths currently in use, longest first, so a
+// cached override network wins over a cached network around it.
+type decisionCache struct {
+	// Accessed atomically. Here and elsewhere in the package such 64-bit
+	// counters come first in their struct, which keeps them aligned on
+	// 32-bit platforms.
+	hits      uint64
+	misses    uint64
+	evictions uint64
+	gen       uint64 // incremented by reset
+
+	shards   [cacheShards]cacheShard
+	allowTTL time.Duration
+	blockTTL time.Duration
+	now      func() time.Time
+
+	// lengths counts the cached networks per address family and prefix
+	// length; index 0 is IPv4 and 1 is IPv6.
+	lengths [2][129]int32
+}
+
+type cacheShard struct {
+	mu       sync.Mutex
+	capacity int
+	items    map[netip.Prefix]*list.Element
+	order    *list.List // front is most recently used
+}
+
+type cacheItem struct {
+	key     netip.Prefix
+	entry   cacheEntry
+	expires time.Time
+}
+
+func newDecisionCache(size int, allowTTL, blockTTL time.Duration) *decisionCache {
+	c := &decisionCache{allowTTL: allowTTL, blockTTL: blockTTL, now: time.Now}
+
+	perShard := (size + cacheShards - 1) / cacheShards
+	if perShard < 1 {
+		perShard = 1
+	}
+	for i := range c.shards {
+		c.shards[i].capacity = perShard
+		c.shards[i].items = make(map[netip.Prefix]*list.Element)
+		c.shards[i].order = list.New()
+	}
+	return c
+}
+
+func (c *decisionCache) shard(key netip.Prefix) *cacheShard {
+	// FNV-1a, inlined to avoid allocating a hash.Hash per request.
+	h := uint32(2166136261)
+	b := key.Addr().As16()
+	for i := 0; i < len(b); i++ {
+		h ^= uint32(b[i])
+		h *= 16777619
+	}
+	h ^= uint32(key.Bits())
+	h *= 16777619
+	return &c.shards[h%cacheShards]
+}
+
+func family(addr netip.Addr) int {
+	if addr.Is4() {
+		return 0
+	}
+	return 1
+}
+
+// get returns the decision of the longest cached network containing addr.
+func (c *decisionCache) get(addr netip.Addr) (cacheEntry, bool) {
+	lengths := &c.lengths[family(addr)]
+	now := c.now()
+
+	for bits := addr.BitLen(); bits >= 0; bits-- {
+		if atomic.LoadInt32(&lengths[bits]) == 0 {
+			continue
+		}
+		key, _ := addr.Prefix(bits)
+		s := c.shard(key)
+
+		s.mu.Lock()
+		elem, ok := s.items[key]
+		if !ok {
+			s.mu.Unlock()
+			continue
+		}
+		item := elem.Value.(*cacheItem)
+		if now.Before(item.expires) {
+			s.order.MoveToFront(elem)
+			s.mu.Unlock()
+			atomic.AddUint64(&c.hits, 1)
+			return item.entry, true
+		}
+		c.remove(s, elem)
+		s.mu.Unlock()
+	}
+
+	atomic.AddUint64(&c.misses, 1)
+	return cacheEntry{}, false
+}
+
+func (c *decisionCache) set(key netip.Prefix, entry cacheEntry) {
+	c.setFrom(c.generation(), key, entry)
+}
+
+// generation identifies the cache contents between two resets.
+func (c *decisionCache) generation() uint64 {
+	return atomic.LoadUint64(&c.gen)
+}
+
+// setFrom caches entry unless the cache was reset since gen was read, so a
+// decision made with a database that was swapped out meanwhile is dropped.
+func (c *decisionCache) setFrom(gen uint64, key netip.Prefix, entry cacheEntry) {
+	ttl := c.allowTTL
+	if !entry.allowed {
+		ttl = c.blockTTL
+	}
+	c.store(gen, key, entry, c.now().Add(ttl))
+}
+
+// setUntil caches entry until expires, e.g. for entries restored from a
+// snapshot that keep their original expiry.
+func (c *decisionCache) setUntil(key netip.Prefix, entry cacheEntry, expires time.Time) {
+	c.store(c.generation(), key, entry, expires)
+}
+
+func (c *decisionCache) store(gen uint64, key netip.Prefix, entry cacheEntry, expires time.Time) {
+	key = key.Masked()
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Checked under the shard lock: reset starts a new generation before
+	// it clears the shards, so an entry stored before then is cleared.
+	if atomic.LoadUint64(&c.gen) != gen {
+		return
+	}
+
+	if elem, ok := s.items[key]; ok {
+		item := elem.Value.(*cacheItem)
+		item.entry = entry
+		item.expires = expires
+		s.order.MoveToFront(elem)
+		return
+	}
+
+	for s.order.Len() >= s.capacity {
+		c.remove(s, s.order.Back())
+		atomic.AddUint64(&c.evictions, 1)
+	}
+	s.items[key] = s.order.PushFront(&cacheItem{key: key, entry: entry, expires: expires})
+	atomic.AddInt32(&c.lengths[family(key.Addr())][key.Bits()], 1)
+}
+
+// remove drops elem from s. The caller holds s.mu.
+func (c *decisionCache) remove(s *cacheShard, elem *list.Element) {
+	key := elem.Value.(*cacheItem).key
+	s.order.Remove(elem)
+	delete(s.items, key)
+	atomic.AddInt32(&c.lengths[family(key.Addr())][key.Bits()], -1)
+}
+
+// each calls fn for every entry that has not expired, least recently used
+// first within a shard, so replaying the calls through setUntil keeps the
+// recency order. fn runs with the shard locked.
+func (c *decisionCache) each(fn func(key netip.Prefix, entry cacheEntry, expires time.Time)) {
+	now := c.now()
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		for elem := s.order.Back(); elem != nil; elem = elem.Prev() {
+			item := elem.Value.(*cacheItem)
+			if now.Before(item.expires) {
+				fn(item.key, item.entry, item.expires)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// reset drops every entry but keeps the counters.
+func (c *decisionCache) reset() {
+	atomic.AddUint64(&c.gen, 1)
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		for s.order.Len() > 0 {
+			c.remove(s, s.order.Back())
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (c *decisionCache) stats() CacheStats {
+	stats := CacheStats{
+		Hits:      atomic.LoadUint64(&c.hits),
+		Misses:    atomic.LoadUint64(&c.misses),
+		Evictions: atomic.LoadUint64(&c.evictions),
+	}
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		stats.Entries += s.order.Len()
+		s.mu.Unlock()
+	}
+	return stats
+}
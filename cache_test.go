@@ -0,0 +1,165 @@
+package traefik_plugin_state_geo
+
+import (
+	"fmt"
+	"net/netip"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDecisionCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newDecisionCache(cacheShards, time.Hour, time.Hour) // one entry per shard
+
+	// Find two networks in the same shard.
+	first := netip.MustParsePrefix("10.0.0.0/24")
+	var second netip.Prefix
+	for i := 1; !second.IsValid(); i++ {
+		p := netip.MustParsePrefix(fmt.Sprintf("10.0.%d.0/24", i))
+		if c.shard(p) == c.shard(first) {
+			second = p
+		}
+	}
+
+	c.set(first, cacheEntry{allowed: true})
+	c.set(second, cacheEntry{allowed: true})
+
+	if _, ok := c.get(first.Addr()); ok {
+		t.Error("expected least recently used entry to be evicted")
+	}
+	if _, ok := c.get(second.Addr().Next()); !ok {
+		t.Error("expected newest entry to be cached")
+	}
+
+	stats := c.stats()
+	if stats.Hits != 1 || stats.Misses != 1 || stats.Evictions != 1 || stats.Entries != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestDecisionCacheTTL(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	c := newDecisionCache(100, time.Hour, time.Minute)
+	c.now = func() time.Time { return now }
+
+	allowed := netip.MustParseAddr("10.0.0.1")
+	blocked := netip.MustParseAddr("2001:db8::1")
+	c.set(netip.PrefixFrom(allowed, 32), cacheEntry{allowed: true})
+	c.set(netip.PrefixFrom(blocked, 128), cacheEntry{allowed: false, stateCode: "CA"})
+
+	now = now.Add(2 * time.Minute)
+	if _, ok := c.get(blocked); ok {
+		t.Error("expected blocked decision to expire after its TTL")
+	}
+	if _, ok := c.get(allowed); !ok {
+		t.Error("expected allowed decision to outlive the blocked TTL")
+	}
+
+	now = now.Add(time.Hour)
+	if _, ok := c.get(allowed); ok {
+		t.Error("expected allowed decision to expire after its TTL")
+	}
+	if entries := c.stats().Entries; entries != 0 {
+		t.Errorf("expected expired entries to be dropped, got %d", entries)
+	}
+}
+
+func TestDecisionCacheLongestPrefix(t *testing.T) {
+	c := newDecisionCache(100, time.Hour, time.Hour)
+
+	c.set(netip.MustParsePrefix("23.116.0.0/16"), cacheEntry{allowed: true, stateCode: "TX"})
+	c.set(netip.MustParsePrefix("23.116.5.0/24"), cacheEntry{allowed: false, stateCode: "CA"})
+	c.set(netip.MustParsePrefix("2600:1000::/28"), cacheEntry{allowed: true, stateCode: "NY"})
+
+	tests := []struct {
+		ip    string
+		state string
+		found bool
+	}{
+		{"23.116.0.10", "TX", true},
+		{"23.116.5.10", "CA", true},
+		{"23.116.255.255", "TX", true},
+		{"23.117.0.1", "", false},
+		{"2600:1000:abcd::1", "NY", true},
+		{"2600:1010::1", "", false},
+		{"::ffff:23.116.0.10", "", false}, // callers unmap addresses
+	}
+	for _, tt := range tests {
+		entry, found := c.get(netip.MustParseAddr(tt.ip))
+		if found != tt.found || entry.stateCode != tt.state {
+			t.Errorf("%s: got (%q, %v), want (%q, %v)", tt.ip, entry.stateCode, found, tt.state, tt.found)
+		}
+	}
+}
+
+func TestDecisionCacheBounded(t *testing.T) {
+	c := newDecisionCache(1000, time.Hour, time.Hour)
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 5000; i++ {
+				addr := netip.AddrFrom4([4]byte{byte(w), byte(i / 256), byte(i % 256), 1})
+				c.set(netip.PrefixFrom(addr, 32), cacheEntry{allowed: true})
+				c.get(addr)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	stats := c.stats()
+	if stats.Entries > 1000+cacheShards {
+		t.Errorf("cache grew to %d entries", stats.Entries)
+	}
+	if stats.Evictions == 0 {
+		t.Error("expected evictions")
+	}
+
+	c.reset()
+	if entries := c.stats().Entries; entries != 0 {
+		t.Errorf("expected reset to drop entries, got %d", entries)
+	}
+	for bits, n := range c.lengths[0] {
+		if n != 0 {
+			t.Errorf("expected no cached /%d networks after reset, got %d", bits, n)
+		}
+	}
+}
+
+func TestLookupDuringResetIsNotCached(t *testing.T) {
+	db := &blockingDB{release: make(chan struct{})}
+	block := &StateBlock{
+		blockedStates: map[string]struct{}{"CA": {}},
+		db:            &sharedDB{current: newDBHandle(db)},
+		name:          "reset-test",
+		cache:         newDecisionCache(100, time.Hour, time.Hour),
+	}
+
+	done := make(chan cacheEntry)
+	go func() {
+		entry, _, _ := block.lookup(netip.MustParseAddr("76.79.129.110"))
+		done <- entry
+	}()
+	for atomic.LoadInt32(&db.lookups) == 0 {
+		runtime.Gosched()
+	}
+	// The database is swapped while the lookup runs on the old one.
+	block.cache.reset()
+	close(db.release)
+
+	if entry := <-done; entry.reason != reasonStateBlocked {
+		t.Errorf("expected the lookup to return its decision, got %+v", entry)
+	}
+	if stats := block.cache.stats(); stats.Entries != 0 {
+		t.Errorf("expected the stale decision to be dropped, got %d entries", stats.Entries)
+	}
+
+	block.cache.set(netip.MustParsePrefix("76.79.129.0/24"), cacheEntry{allowed: true})
+	if _, ok := block.cache.get(netip.MustParseAddr("76.79.129.110")); !ok {
+		t.Error("expected decisions after the reset to be cached")
+	}
+}
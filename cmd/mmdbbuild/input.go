@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// row is one network with its record, in input order.
+type row struct {
+	network netip.Prefix
+	record  map[string]any
+}
+
+// csvTypes are the type suffixes accepted in CSV headers.
+var csvTypes = map[string]bool{
+	"string": true, "double": true, "float": true, "uint16": true,
+	"uint32": true, "uint64": true, "int32": true, "bool": true,
+}
+
+// floatKeys are always written as doubles from JSON input, so that a
+// latitude of 40 does not end up as an integer.
+var floatKeys = map[string]bool{"latitude": true, "longitude": true}
+
+// readCSV reads rows from a CSV file with a header. The "network" column
+// holds the CIDR; every other column is a dotted path into the record with an
+// optional type suffix, e.g. "subdivisions.0.iso_code" or
+// "location.latitude:double". Empty cells are skipped.
+func readCSV(r io.Reader, emit func(row) error) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("failed to read header: %w", err)
+	}
+
+	type column struct {
+		path     []string
+		typeName string
+	}
+	networkCol := -1
+	columns := make([]column, len(header))
+	for i, name := range header {
+		name = strings.TrimSpace(strings.TrimPrefix(name, "\ufeff"))
+		if name == "network" {
+			networkCol = i
+			continue
+		}
+		typeName := "string"
+		if idx := strings.LastIndex(name, ":"); idx >= 0 {
+			name, typeName = name[:idx], name[idx+1:]
+			if !csvTypes[typeName] {
+				return fmt.Errorf("column %q: unknown type %q", header[i], typeName)
+			}
+		}
+		columns[i] = column{path: strings.Split(name, "."), typeName: typeName}
+	}
+	if networkCol < 0 {
+		return errors.New(`missing "network" column`)
+	}
+
+	for line := 2; ; line++ {
+		fields, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		network, err := netip.ParsePrefix(strings.TrimSpace(fields[networkCol]))
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+
+		record := map[string]any{}
+		for i, value := range fields {
+			if i == networkCol || value == "" || i >= len(columns) {
+				continue
+			}
+			v, err := convert(value, columns[i].typeName)
+			if err != nil {
+				return fmt.Errorf("line %d, column %q: %w", line, header[i], err)
+			}
+			if err := setPath(record, columns[i].path, v); err != nil {
+				return fmt.Errorf("line %d, column %q: %w", line, header[i], err)
+			}
+		}
+
+		if err := emit(row{network: network, record: record}); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+}
+
+// readJSONL reads one JSON object per line. The "network" key holds the
+// CIDR and the remaining keys form the record. Blank lines and lines
+// starting with # are skipped.
+func readJSONL(r io.Reader, emit func(row) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		decoder := json.NewDecoder(strings.NewReader(text))
+		decoder.UseNumber()
+		var object map[string]any
+		if err := decoder.Decode(&object); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+
+		cidr, _ := object["network"].(string)
+		network, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		delete(object, "network")
+
+		record, err := fromJSON("", object)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		if err := emit(row{network: network, record: record.(map[string]any)}); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// fromJSON converts decoded JSON into writer values. Integers become uint32,
+// uint64 or int32; numbers with a fraction or exponent become doubles.
+func fromJSON(key string, v any) (any, error) {
+	switch v := v.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for k, e := range v {
+			c, err := fromJSON(k, e)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", k, err)
+			}
+			out[k] = c
+		}
+		return out, nil
+	case []any:
+		out := make([]any, len(v))
+		for i, e := range v {
+			c, err := fromJSON(key, e)
+			if err != nil {
+				return nil, fmt.Errorf("[%d]: %w", i, err)
+			}
+			out[i] = c
+		}
+		return out, nil
+	case json.Number:
+		if floatKeys[key] || strings.ContainsAny(v.String(), ".eE") {
+			return convert(v.String(), "double")
+		}
+		if strings.HasPrefix(v.String(), "-") {
+			return convert(v.String(), "int32")
+		}
+		n, err := strconv.ParseUint(v.String(), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		if n <= math.MaxUint32 {
+			return uint32(n), nil
+		}
+		return n, nil
+	case string, bool:
+		return v, nil
+	case nil:
+		return nil, errors.New("null values are not supported")
+	default:
+		return nil, fmt.Errorf("unsupported value %v", v)
+	}
+}
+
+// convert parses a CSV cell as typeName.
+func convert(value, typeName string) (any, error) {
+	switch typeName {
+	case "string":
+		return value, nil
+	case "double":
+		return strconv.ParseFloat(value, 64)
+	case "float":
+		f, err := strconv.ParseFloat(value, 32)
+		return float32(f), err
+	case "uint16":
+		n, err := strconv.ParseUint(value, 10, 16)
+		return uint16(n), err
+	case "uint32":
+		n, err := strconv.ParseUint(value, 10, 32)
+		return uint32(n), err
+	case "uint64":
+		return strconv.ParseUint(value, 10, 64)
+	case "int32":
+		n, err := strconv.ParseInt(value, 10, 32)
+		return int32(n), err
+	case "bool":
+		return strconv.ParseBool(value)
+	default:
+		return nil, fmt.Errorf("unknown type %q", typeName)
+	}
+}
+
+// setPath stores value at the dotted path in record. Numeric segments index
+// into arrays, which grow as needed.
+func setPath(record map[string]any, path []string, value any) error {
+	key := path[0]
+	if len(path) == 1 {
+		record[key] = value
+		return nil
+	}
+
+	if isIndex(path[1]) {
+		arr, ok := record[key].([]any)
+		if !ok && record[key] != nil {
+			return errConflict(path)
+		}
+		arr, err := setIndex(arr, path[1:], value)
+		record[key] = arr
+		return err
+	}
+
+	child, ok := record[key].(map[string]any)
+	if !ok {
+		if record[key] != nil {
+			return errConflict(path)
+		}
+		child = map[string]any{}
+		record[key] = child
+	}
+	return setPath(child, path[1:], value)
+}
+
+func setIndex(arr []any, path []string, value any) ([]any, error) {
+	idx, _ := strconv.Atoi(path[0])
+	for len(arr) <= idx {
+		arr = append(arr, nil)
+	}
+
+	if len(path) == 1 {
+		arr[idx] = value
+		return arr, nil
+	}
+
+	if isIndex(path[1]) {
+		child, ok := arr[idx].([]any)
+		if !ok && arr[idx] != nil {
+			return arr, errConflict(path)
+		}
+		child, err := setIndex(child, path[1:], value)
+		arr[idx] = child
+		return arr, err
+	}
+
+	child, ok := arr[idx].(map[string]any)
+	if !ok {
+		if arr[idx] != nil {
+			return arr, errConflict(path)
+		}
+		child = map[string]any{}
+		arr[idx] = child
+	}
+	return arr, setPath(child, path[1:], value)
+}
+
+func isIndex(segment string) bool {
+	n, err := strconv.Atoi(segment)
+	return err == nil && n >= 0
+}
+
+func errConflict(path []string) error {
+	return fmt.Errorf("path %q conflicts with another column", strings.Join(path, "."))
+}
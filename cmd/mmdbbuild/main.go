@@ -0,0 +1,195 @@
+// Command mmdbbuild compiles CSV or JSONL network-to-location rows into a
+// MaxMind DB file, for overrides, test data and internal ranges.
+//
+//	mmdbbuild -o overrides.mmdb -type Custom-City -description en="Office ranges" rows.csv more.jsonl
+//
+// CSV files need a header with a "network" column; other columns are dotted
+// record paths with an optional type suffix:
+//
+//	network,country.iso_code,subdivisions.0.iso_code,location.latitude:double
+//	10.10.0.0/16,US,NY,40.71
+//
+// JSONL files carry one object per line with a "network" key; the other keys
+// form the record:
+//
+//	{"network":"10.20.0.0/16","country":{"iso_code":"US"},"subdivisions":[{"iso_code":"CA"}]}
+//
+// Overlapping networks are resolved deterministically: more specific networks
+// win, and identical networks are applied in input order. With -merge deep a
+// more specific network's record is merged into the covering one instead of
+// replacing it. The result is checked with the maxminddb reader's Verify
+// before it is written.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/vikewoods/traefik-plugin-state-geo/internal/mmdbwriter"
+)
+
+type descriptions map[string]string
+
+func (d descriptions) String() string {
+	parts := make([]string, 0, len(d))
+	for lang, text := range d {
+		parts = append(parts, lang+"="+text)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (d descriptions) Set(value string) error {
+	lang, text, ok := strings.Cut(value, "=")
+	if !ok || lang == "" {
+		return fmt.Errorf("expected lang=text, got %q", value)
+	}
+	d[lang] = text
+	return nil
+}
+
+func main() {
+	if err := run(os.Args[1:], os.Stderr); err != nil {
+		fmt.Fprintf(os.Stderr, "mmdbbuild: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, stderr io.Writer) error {
+	flags := flag.NewFlagSet("mmdbbuild", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+
+	desc := descriptions{}
+	out := flags.String("o", "", "output `file` (required)")
+	format := flags.String("format", "auto", "input format: auto, csv or jsonl")
+	dbType := flags.String("type", "Custom-City", "database_type metadata")
+	flags.Var(desc, "description", "description metadata as `lang=text`, repeatable")
+	languages := flags.String("languages", "en", "comma separated languages metadata")
+	ipVersion := flags.Int("ip-version", 6, "4 or 6")
+	recordSize := flags.Int("record-size", 0, "24, 28 or 32 bits, 0 picks the smallest that fits")
+	buildEpoch := flags.Int64("build-epoch", 0,
+		"build_epoch metadata as unix seconds (default $SOURCE_DATE_EPOCH or now)")
+	merge := flags.String("merge", "replace", "overlap strategy: replace or deep")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *out == "" || flags.NArg() == 0 {
+		flags.Usage()
+		return errors.New("an output file and at least one input are required")
+	}
+
+	opts := mmdbwriter.Options{
+		DatabaseType: *dbType,
+		Description:  desc,
+		IPVersion:    *ipVersion,
+		RecordSize:   *recordSize,
+	}
+	if len(desc) == 0 {
+		opts.Description = map[string]string{"en": *dbType}
+	}
+	if *languages != "" {
+		opts.Languages = strings.Split(*languages, ",")
+	}
+
+	switch *merge {
+	case "replace":
+		opts.Merge = mmdbwriter.MergeReplace
+	case "deep":
+		opts.Merge = mmdbwriter.MergeDeep
+	default:
+		return fmt.Errorf("unknown merge strategy %q", *merge)
+	}
+
+	epoch := *buildEpoch
+	if epoch == 0 {
+		if env := os.Getenv("SOURCE_DATE_EPOCH"); env != "" {
+			parsed, err := strconv.ParseInt(env, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid SOURCE_DATE_EPOCH: %w", err)
+			}
+			epoch = parsed
+		}
+	}
+	if epoch != 0 {
+		opts.BuildEpoch = time.Unix(epoch, 0)
+	}
+
+	writer, err := mmdbwriter.New(opts)
+	if err != nil {
+		return err
+	}
+
+	count := 0
+	for _, path := range flags.Args() {
+		n, err := readInput(path, *format, writer)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		count += n
+	}
+
+	var buf bytes.Buffer
+	if _, err := writer.WriteTo(&buf); err != nil {
+		return err
+	}
+
+	reader, err := maxminddb.FromBytes(buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("generated database cannot be opened: %w", err)
+	}
+	if err := reader.Verify(); err != nil {
+		return fmt.Errorf("generated database failed verification: %w", err)
+	}
+
+	if err := os.WriteFile(*out, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stderr, "wrote %s: %d networks, %d nodes, %d bytes\n",
+		*out, count, reader.Metadata.NodeCount, buf.Len())
+	return nil
+}
+
+func readInput(path, format string, writer *mmdbwriter.Writer) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	if format == "auto" {
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".csv":
+			format = "csv"
+		case ".jsonl", ".ndjson", ".json":
+			format = "jsonl"
+		default:
+			return 0, errors.New("cannot detect format from extension, use -format")
+		}
+	}
+
+	count := 0
+	emit := func(r row) error {
+		count++
+		return writer.Insert(r.network, r.record)
+	}
+
+	switch format {
+	case "csv":
+		err = readCSV(f, emit)
+	case "jsonl":
+		err = readJSONL(f, emit)
+	default:
+		err = fmt.Errorf("unknown format %q", format)
+	}
+	return count, err
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+type testRecord struct {
+	Country struct {
+		IsoCode   string `maxminddb:"iso_code"`
+		GeonameID uint   `maxminddb:"geoname_id"`
+	} `maxminddb:"country"`
+	Subdivisions []struct {
+		IsoCode string `maxminddb:"iso_code"`
+	} `maxminddb:"subdivisions"`
+	Location struct {
+		Latitude float64 `maxminddb:"latitude"`
+	} `maxminddb:"location"`
+	Internal bool `maxminddb:"internal"`
+}
+
+func writeFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRunBuildsVerifiedDatabase(t *testing.T) {
+	dir := t.TempDir()
+	csvPath := writeFile(t, dir, "rows.csv", "network,country.iso_code,country.geoname_id:uint32,"+
+		"subdivisions.0.iso_code,location.latitude:double,internal:bool"+`
+10.10.0.0/16,US,6252001,NY,40.71,true
+10.10.5.0/24,US,6252001,CA,37.77,
+`)
+	jsonlPath := writeFile(t, dir, "rows.jsonl", "# internal IPv6 range\n"+
+		`{"network":"fd00::/8","country":{"iso_code":"US","geoname_id":6252001},`+
+		`"subdivisions":[{"iso_code":"TX"}],"location":{"latitude":32}}`+"\n"+
+		"\n"+
+		`{"network":"10.20.0.0/16","country":{"iso_code":"GB"}}`+"\n")
+	out := filepath.Join(dir, "custom.mmdb")
+
+	err := run([]string{
+		"-o", out, "-type", "Custom-City", "-description", "en=Test ranges",
+		"-build-epoch", "1700000000", csvPath, jsonlPath,
+	}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := maxminddb.Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	metadata := reader.Metadata
+	if metadata.DatabaseType != "Custom-City" || metadata.Description["en"] != "Test ranges" ||
+		metadata.BuildEpoch != 1700000000 {
+		t.Errorf("unexpected metadata %+v", reader.Metadata)
+	}
+
+	tests := []struct {
+		ip          string
+		country     string
+		subdivision string
+		latitude    float64
+	}{
+		{"10.10.1.1", "US", "NY", 40.71},
+		{"10.10.5.1", "US", "CA", 37.77},
+		{"10.20.0.1", "GB", "", 0},
+		{"fd00::1", "US", "TX", 32},
+		{"192.168.0.1", "", "", 0},
+	}
+
+	for _, tt := range tests {
+		var rec testRecord
+		if err := reader.Lookup(net.ParseIP(tt.ip), &rec); err != nil {
+			t.Fatalf("%s: %v", tt.ip, err)
+		}
+		if rec.Country.IsoCode != tt.country || rec.Location.Latitude != tt.latitude {
+			t.Errorf("%s: unexpected record %+v", tt.ip, rec)
+		}
+		if tt.subdivision != "" && (len(rec.Subdivisions) == 0 || rec.Subdivisions[0].IsoCode != tt.subdivision) {
+			t.Errorf("%s: expected subdivision %s, got %+v", tt.ip, tt.subdivision, rec.Subdivisions)
+		}
+		if tt.country == "US" && rec.Country.GeonameID != 6252001 {
+			t.Errorf("%s: expected geoname_id to decode as an integer, got %+v", tt.ip, rec.Country)
+		}
+	}
+
+	var rec testRecord
+	_ = reader.Lookup(net.ParseIP("10.10.1.1"), &rec)
+	if !rec.Internal {
+		t.Error("expected bool column to round trip")
+	}
+}
+
+func TestRunDeepMerge(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "rows.jsonl",
+		`{"network":"10.0.0.0/8","country":{"iso_code":"US"},"subdivisions":[{"iso_code":"NY"}]}
+{"network":"10.1.0.0/16","subdivisions":[{"iso_code":"CA"}]}
+`)
+	out := filepath.Join(dir, "merged.mmdb")
+
+	if err := run([]string{"-o", out, "-merge", "deep", input}, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := maxminddb.Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	var rec testRecord
+	if err := reader.Lookup(net.ParseIP("10.1.0.1"), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Country.IsoCode != "US" || rec.Subdivisions[0].IsoCode != "CA" {
+		t.Errorf("expected the override to keep the covering country, got %+v", rec)
+	}
+}
+
+func TestRunRejectsBadInput(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out.mmdb")
+
+	tests := map[string]string{
+		"missing.csv": "country.iso_code\nUS\n",
+		"type.csv":    "network,location.latitude:decimal\n10.0.0.0/8,1\n",
+		"network.csv": "network,country.iso_code\nnot-a-network,US\n",
+		"null.jsonl":  `{"network":"10.0.0.0/8","country":null}`,
+		"rows.txt":    "",
+	}
+
+	for name, content := range tests {
+		path := writeFile(t, dir, name, content)
+		err := run([]string{"-o", out, path}, io.Discard)
+		if err == nil {
+			t.Errorf("%s: expected an error", name)
+		} else if !strings.Contains(err.Error(), name) {
+			t.Errorf("%s: expected error to name the input, got %v", name, err)
+		}
+	}
+}
+
+func TestSetPath(t *testing.T) {
+	record := map[string]any{}
+	for path, value := range map[string]any{
+		"country.iso_code":        "US",
+		"subdivisions.0.iso_code": "CA",
+		"subdivisions.1.iso_code": "XX",
+		"location.latitude":       1.5,
+	} {
+		if err := setPath(record, strings.Split(path, "."), value); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+	}
+
+	subdivisions := record["subdivisions"].([]any)
+	if len(subdivisions) != 2 || subdivisions[1].(map[string]any)["iso_code"] != "XX" {
+		t.Errorf("unexpected subdivisions %v", subdivisions)
+	}
+
+	if err := setPath(record, []string{"country", "iso_code", "x"}, "y"); err == nil {
+		t.Error("expected conflicting path to fail")
+	}
+}
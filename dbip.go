@@ -0,0 +1,191 @@
+package traefik_plugin_state_geo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sort"
+)
+
+// DB-IP lite CSV columns. The city edition is
+// ip_start,ip_end,continent,country,stateprov,city,latitude,longitude while
+// the country edition only carries ip_start,ip_end,country.
+const (
+	dbipCityColumns    = 8
+	dbipCountryColumns = 3
+)
+
+type dbipRangeV4 struct {
+	start, end uint32
+	result     int32
+}
+
+type dbipRangeV6 struct {
+	start, end [16]byte
+	result     int32
+}
+
+// dbipDB keeps the sorted ranges of a DB-IP CSV file in memory. Results are
+// interned since millions of ranges share a few thousand locations.
+type dbipDB struct {
+	v4      []dbipRangeV4
+	v6      []dbipRangeV6
+	results []geoResult
+}
+
+func openDBIP(path string) (*dbipDB, error) {
+	r, err := openDataFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return parseDBIP(r)
+}
+
+func parseDBIP(r io.Reader) (*dbipDB, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+
+	db := &dbipDB{}
+	interned := make(map[geoResult]int32)
+
+	for line := 1; ; line++ {
+		row, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid DB-IP CSV: %w", err)
+		}
+
+		var res geoResult
+		switch len(row) {
+		case dbipCityColumns:
+			res.CountryCode = row[3]
+			res.SubdivisionCode = subdivisionCode(row[3], row[4])
+		case dbipCountryColumns:
+			res.CountryCode = row[2]
+		default:
+			return nil, fmt.Errorf("invalid DB-IP CSV: line %d has %d columns", line, len(row))
+		}
+		// DB-IP marks unallocated ranges with "ZZ".
+		if res.CountryCode == "ZZ" {
+			res = geoResult{}
+		}
+
+		idx, ok := interned[res]
+		if !ok {
+			idx = int32(len(db.results))
+			db.results = append(db.results, res)
+			interned[res] = idx
+		}
+
+		start, end := net.ParseIP(row[0]), net.ParseIP(row[1])
+		if start == nil || end == nil {
+			return nil, fmt.Errorf("invalid DB-IP CSV: line %d has an invalid range", line)
+		}
+
+		start4, end4 := start.To4(), end.To4()
+		switch {
+		case start4 != nil && end4 != nil:
+			db.v4 = append(db.v4, dbipRangeV4{
+				start:  binary.BigEndian.Uint32(start4),
+				end:    binary.BigEndian.Uint32(end4),
+				result: idx,
+			})
+		case start4 == nil && end4 == nil:
+			rng := dbipRangeV6{result: idx}
+			copy(rng.start[:], start.To16())
+			copy(rng.end[:], end.To16())
+			db.v6 = append(db.v6, rng)
+		default:
+			return nil, fmt.Errorf("invalid DB-IP CSV: line %d mixes IPv4 and IPv6", line)
+		}
+	}
+
+	sort.Slice(db.v4, func(i, j int) bool { return db.v4[i].start < db.v4[j].start })
+	sort.Slice(db.v6, func(i, j int) bool {
+		return bytes.Compare(db.v6[i].start[:], db.v6[j].start[:]) < 0
+	})
+
+	return db, nil
+}
+
+// Lookup finds the range holding ip. Addresses between two ranges resolve to
+// the gap, so misses can be cached per network too.
+func (d *dbipDB) Lookup(ip net.IP) (geoResult, netip.Prefix, error) {
+	if v4 := ip.To4(); v4 != nil {
+		n := binary.BigEndian.Uint32(v4)
+		addr, _ := netip.AddrFromSlice(v4)
+		i := sort.Search(len(d.v4), func(i int) bool { return d.v4[i].end >= n })
+		if i < len(d.v4) && d.v4[i].start <= n {
+			r := d.v4[i]
+			return d.results[r.result], rangePrefix(addr, uint32Addr(r.start), uint32Addr(r.end)), nil
+		}
+
+		first, last := uint32(0), ^uint32(0)
+		if i > 0 {
+			first = d.v4[i-1].end + 1
+		}
+		if i < len(d.v4) {
+			last = d.v4[i].start - 1
+		}
+		return geoResult{}, rangePrefix(addr, uint32Addr(first), uint32Addr(last)), nil
+	}
+
+	v6 := ip.To16()
+	if v6 == nil {
+		return geoResult{}, netip.Prefix{}, nil
+	}
+	addr, _ := netip.AddrFromSlice(v6)
+	i := sort.Search(len(d.v6), func(i int) bool { return bytes.Compare(d.v6[i].end[:], v6) >= 0 })
+	if i < len(d.v6) && bytes.Compare(d.v6[i].start[:], v6) <= 0 {
+		r := d.v6[i]
+		return d.results[r.result], rangePrefix(addr, netip.AddrFrom16(r.start), netip.AddrFrom16(r.end)), nil
+	}
+
+	first, last := netip.IPv6Unspecified(), maxIPv6
+	if i > 0 {
+		first = netip.AddrFrom16(d.v6[i-1].end).Next()
+	}
+	if i < len(d.v6) {
+		last = netip.AddrFrom16(d.v6[i].start).Prev()
+	}
+	return geoResult{}, rangePrefix(addr, first, last), nil
+}
+
+func (d *dbipDB) walkNetworks(fn func(netip.Prefix, geoResult)) error {
+	for _, r := range d.v4 {
+		res := d.results[r.result]
+		rangePrefixes(uint32Addr(r.start), uint32Addr(r.end), func(prefix netip.Prefix) {
+			fn(prefix, res)
+		})
+	}
+	for _, r := range d.v6 {
+		res := d.results[r.result]
+		rangePrefixes(netip.AddrFrom16(r.start), netip.AddrFrom16(r.end), func(prefix netip.Prefix) {
+			fn(prefix, res)
+		})
+	}
+	return nil
+}
+
+var maxIPv6 = netip.MustParseAddr("ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff")
+
+func uint32Addr(n uint32) netip.Addr {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], n)
+	return netip.AddrFrom4(b)
+}
+
+// Close leaves the ranges alone, see csvDB.Close.
+func (d *dbipDB) Close() error {
+	return nil
+}
@@ -0,0 +1,88 @@
+package traefik_plugin_state_geo
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	degradedFailOpen    = "fail-open"
+	degradedFailClosed  = "fail-closed"
+	degradedMaintenance = "maintenance"
+
+	defaultDBRetryInterval = 30 * time.Second
+
+	defaultMaintenancePage = "<h1>Service Unavailable</h1><p>Please try again shortly.</p>"
+)
+
+func validDegradedMode(mode string) bool {
+	switch mode {
+	case "", degradedFailOpen, degradedFailClosed, degradedMaintenance:
+		return true
+	}
+	return false
+}
+
+// serveDegraded answers requests while the database has not been loaded yet
+// or after the instance has been closed.
+func (a *StateBlock) serveDegraded(rw http.ResponseWriter, req *http.Request) {
+	switch a.degradedMode {
+	case degradedFailOpen:
+		a.forward(rw, req, netip.Addr{}, cacheEntry{}, reasonFailOpen)
+	case degradedMaintenance:
+		rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+		rw.Header().Set("Retry-After", strconv.Itoa(int((a.retryInterval+time.Second-1)/time.Second)))
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = rw.Write([]byte(a.maintenancePage))
+	default:
+		a.serveBlocked(rw, req, cacheEntry{reason: reasonDBUnavailable})
+	}
+}
+
+// retryDB keeps trying to open the database until it loads or ctx is
+// cancelled, then switches the instance to normal enforcement.
+func (a *StateBlock) retryDB(ctx context.Context, format, path string, reloadInterval time.Duration) {
+	defer close(a.retryDone)
+
+	ticker := time.NewTicker(a.retryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		shared, err := acquireDB(format, path, reloadInterval, a)
+		if err != nil {
+			if a.debug {
+				fmt.Printf("[%s] DEBUG: geoip database still unavailable: %v\n", a.name, err)
+			}
+			continue
+		}
+
+		if a.precompile {
+			table, err := a.compileShared(shared)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "[%s] ERROR: failed to precompile policy, falling back to lookups: %v\n",
+					a.name, err)
+			} else {
+				a.setVerdicts(table)
+			}
+		}
+		a.setDB(shared)
+		if a.snapshotPath != "" {
+			if err := a.loadSnapshot(); err != nil {
+				fmt.Fprintf(os.Stderr, "[%s] ERROR: failed to load cache snapshot: %v\n", a.name, err)
+			}
+		}
+		fmt.Printf("[%s] INFO: Loaded geoip database %s, leaving %s mode\n", a.name, path, a.degradedMode)
+		return
+	}
+}
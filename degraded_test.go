@@ -0,0 +1,124 @@
+package traefik_plugin_state_geo
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/vikewoods/traefik-plugin-state-geo/internal/geoiptest"
+)
+
+func TestDegradedStartup(t *testing.T) {
+	tests := []struct {
+		mode         string
+		precompile   bool
+		expectedCode int
+	}{
+		{degradedFailOpen, false, http.StatusOK},
+		{degradedFailClosed, false, http.StatusForbidden},
+		{degradedMaintenance, false, http.StatusServiceUnavailable},
+		{degradedFailClosed, true, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		dbPath := filepath.Join(t.TempDir(), "city.mmdb")
+
+		cfg := CreateConfig()
+		cfg.BlockedStates = []string{"CA"}
+		cfg.DBPath = dbPath
+		cfg.DegradedMode = tt.mode
+		cfg.DBRetryInterval = "10ms"
+		cfg.PrecompilePolicy = tt.precompile
+		handler := newTestHandler(t, cfg, nil)
+
+		for _, ip := range []string{geoiptest.IPNewYork, geoiptest.IPCalifornia} {
+			if code := serveIP(handler, ip); code != tt.expectedCode {
+				t.Errorf("%s: expected status %d for %s before the database loads, got %d",
+					tt.mode, tt.expectedCode, ip, code)
+			}
+		}
+
+		// The database shows up, e.g. once the volume is mounted.
+		data, err := os.ReadFile(geoiptest.WriteCityDB(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(dbPath+".tmp", data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(dbPath+".tmp", dbPath); err != nil {
+			t.Fatal(err)
+		}
+
+		deadline := time.Now().Add(2 * time.Second)
+		for serveIP(handler, geoiptest.IPCalifornia) != http.StatusForbidden ||
+			serveIP(handler, geoiptest.IPNewYork) != http.StatusOK {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: policy was not enforced after the database loaded", tt.mode)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if tt.precompile && handler.currentVerdicts() == nil {
+			t.Errorf("%s: expected the policy to be precompiled once the database loaded", tt.mode)
+		}
+		_ = handler.Close()
+	}
+}
+
+func TestMaintenancePage(t *testing.T) {
+	page := filepath.Join(t.TempDir(), "maintenance.html")
+	if err := os.WriteFile(page, []byte("<p>Back soon</p>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := CreateConfig()
+	cfg.DBPath = filepath.Join(t.TempDir(), "missing.mmdb")
+	cfg.DegradedMode = degradedMaintenance
+	cfg.DBRetryInterval = "90s"
+	cfg.MaintenancePagePath = page
+	cfg.WhitelistedPaths = []string{"/health"}
+	handler := newTestHandler(t, cfg, nil)
+
+	serve := func(target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.RemoteAddr = net.JoinHostPort(geoiptest.IPNewYork, "1234")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	recorder := serve("http://localhost/")
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status 503, got %d", recorder.Code)
+	}
+	if got := recorder.Header().Get("Retry-After"); got != "90" {
+		t.Errorf("expected Retry-After 90, got %q", got)
+	}
+	if got := recorder.Body.String(); got != "<p>Back soon</p>" {
+		t.Errorf("expected the maintenance page, got %q", got)
+	}
+
+	if recorder := serve("http://localhost/health"); recorder.Code != http.StatusOK {
+		t.Errorf("expected whitelisted path to be served in degraded mode, got %d", recorder.Code)
+	}
+}
+
+func TestDegradedModeConfig(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	cfg := CreateConfig()
+	cfg.DBPath = filepath.Join(t.TempDir(), "missing.mmdb")
+	if _, err := New(context.Background(), next, cfg, "degraded-config-test"); err == nil {
+		t.Error("expected a missing database to fail without degradedMode")
+	}
+
+	cfg.DegradedMode = "fail-sideways"
+	if _, err := New(context.Background(), next, cfg, "degraded-config-test"); err == nil {
+		t.Error("expected an unknown degradedMode to be rejected")
+	}
+}
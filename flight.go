@@ -0,0 +1,59 @@
+package traefik_plugin_state_geo
+
+import (
+	"net/netip"
+	"sync"
+	"sync/atomic"
+)
+
+// flightGroup coalesces concurrent lookups of the same address: the first
+// caller runs the lookup while later callers wait for its decision.
+type flightGroup struct {
+	waiters uint64 // accessed atomically
+
+	mu    sync.Mutex
+	calls map[netip.Addr]*flightCall
+}
+
+type flightCall struct {
+	done    sync.WaitGroup
+	entry   cacheEntry
+	network netip.Prefix
+	err     error
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{calls: make(map[netip.Addr]*flightCall)}
+}
+
+// do runs fn once for concurrent callers with the same addr and hands every
+// caller its result.
+func (g *flightGroup) do(
+	addr netip.Addr, fn func() (cacheEntry, netip.Prefix, error),
+) (cacheEntry, netip.Prefix, error) {
+	g.mu.Lock()
+	if call, ok := g.calls[addr]; ok {
+		g.mu.Unlock()
+		atomic.AddUint64(&g.waiters, 1)
+		call.done.Wait()
+		return call.entry, call.network, call.err
+	}
+	call := &flightCall{}
+	call.done.Add(1)
+	g.calls[addr] = call
+	g.mu.Unlock()
+
+	call.entry, call.network, call.err = fn()
+
+	g.mu.Lock()
+	delete(g.calls, addr)
+	g.mu.Unlock()
+	call.done.Done()
+
+	return call.entry, call.network, call.err
+}
+
+// coalesced reports how many callers waited for another caller's lookup.
+func (g *flightGroup) coalesced() uint64 {
+	return atomic.LoadUint64(&g.waiters)
+}
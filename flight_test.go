@@ -0,0 +1,84 @@
+package traefik_plugin_state_geo
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockingDB answers every lookup with California once release is closed.
+type blockingDB struct {
+	lookups int32
+	closed  int32
+	release chan struct{}
+}
+
+func (d *blockingDB) Lookup(ip net.IP) (geoResult, netip.Prefix, error) {
+	atomic.AddInt32(&d.lookups, 1)
+	<-d.release
+	return geoResult{CountryCode: "US", SubdivisionCode: "CA"}, netip.Prefix{}, nil
+}
+
+func (d *blockingDB) Close() error {
+	atomic.StoreInt32(&d.closed, 1)
+	return nil
+}
+
+func TestConcurrentLookupsAreCoalesced(t *testing.T) {
+	db := &blockingDB{release: make(chan struct{})}
+	block := &StateBlock{
+		next:          http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}),
+		blockedStates: map[string]struct{}{"CA": {}},
+		db:            &sharedDB{current: newDBHandle(db)},
+		name:          "coalesce-test",
+		cache:         newDecisionCache(100, time.Hour, time.Hour),
+		flights:       newFlightGroup(),
+	}
+
+	const requests = 20
+	codes := make([]int, requests)
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+			req.RemoteAddr = "76.79.129.110:1234"
+			recorder := httptest.NewRecorder()
+			block.ServeHTTP(recorder, req)
+			codes[i] = recorder.Code
+		}(i)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for block.CacheStats().Coalesced < requests-1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d waiters, got %d", requests-1, block.CacheStats().Coalesced)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(db.release)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&db.lookups); n != 1 {
+		t.Errorf("expected 1 database lookup, got %d", n)
+	}
+	for i, code := range codes {
+		if code != http.StatusForbidden {
+			t.Errorf("request %d: expected status %d, got %d", i, http.StatusForbidden, code)
+		}
+	}
+
+	// Later requests are served from the cache the lookup filled.
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+	req.RemoteAddr = "76.79.129.110:1234"
+	block.ServeHTTP(httptest.NewRecorder(), req)
+	if n := atomic.LoadInt32(&db.lookups); n != 1 {
+		t.Errorf("expected the decision to be cached, got %d lookups", n)
+	}
+}
@@ -0,0 +1,162 @@
+package traefik_plugin_state_geo
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Fields geo headers can carry.
+const (
+	geoFieldCountry     = "country"
+	geoFieldSubdivision = "subdivision"
+	geoFieldCity        = "city"
+	geoFieldLatitude    = "latitude"
+	geoFieldLongitude   = "longitude"
+	geoFieldASN         = "asn"
+	geoFieldReason      = "reason"
+)
+
+// Reasons forwarded for requests that are let through. Visitors passed to
+// their redirect landing page or let through in report-only mode carry the
+// reason they were blocked for.
+const (
+	reasonAllowed         = "allowed"
+	reasonIPWhitelisted   = "ip_whitelisted"
+	reasonPathWhitelisted = "path_whitelisted"
+	reasonFailOpen        = "fail_open"
+)
+
+// geoHeaders are the request headers that tell the backend where a visitor
+// is. Incoming copies are removed from every request passed on, so clients
+// cannot spoof them.
+type geoHeaders struct {
+	names   []string // canonical header names
+	fields  []string // the field of names[i]
+	details bool     // a field needs geoDetails
+}
+
+// newGeoHeaders builds the headers from the geoHeaders option, which maps
+// header names to fields.
+func newGeoHeaders(config map[string]string) (*geoHeaders, error) {
+	if len(config) == 0 {
+		return nil, nil
+	}
+
+	h := &geoHeaders{}
+	seen := make(map[string]bool)
+	for name, field := range config {
+		canonical := http.CanonicalHeaderKey(strings.TrimSpace(name))
+		if canonical == "" || strings.ContainsAny(canonical, " \t\r\n:") {
+			return nil, fmt.Errorf("invalid geoHeaders entry %q: invalid header name", name)
+		}
+		if seen[canonical] {
+			return nil, fmt.Errorf("invalid geoHeaders entry %q: duplicate header", name)
+		}
+		seen[canonical] = true
+
+		field = strings.ToLower(strings.TrimSpace(field))
+		switch field {
+		case geoFieldCountry, geoFieldSubdivision, geoFieldReason:
+		case geoFieldCity, geoFieldLatitude, geoFieldLongitude, geoFieldASN:
+			h.details = true
+		default:
+			return nil, fmt.Errorf("invalid geoHeaders entry %q: unknown field %q", name, field)
+		}
+		h.names = append(h.names, canonical)
+		h.fields = append(h.fields, field)
+	}
+	return h, nil
+}
+
+// set replaces the geo headers of header. Fields without a value leave their
+// header unset.
+func (h *geoHeaders) set(header http.Header, entry cacheEntry, details geoDetails, reason string) {
+	for i, name := range h.names {
+		header.Del(name)
+
+		var value string
+		switch h.fields[i] {
+		case geoFieldCountry:
+			value = entry.countryCode
+		case geoFieldSubdivision:
+			value = entry.stateCode
+		case geoFieldCity:
+			value = details.City
+		case geoFieldLatitude:
+			if details.HasLocation {
+				value = coarsen(details.Latitude)
+			}
+		case geoFieldLongitude:
+			if details.HasLocation {
+				value = coarsen(details.Longitude)
+			}
+		case geoFieldASN:
+			if details.ASN != 0 {
+				value = strconv.FormatUint(details.ASN, 10)
+			}
+		case geoFieldReason:
+			value = reason
+		}
+		if value != "" {
+			header.Set(name, value)
+		}
+	}
+}
+
+// coarsen rounds a coordinate to one decimal, roughly 11 km, so backends
+// get the region rather than the address.
+func coarsen(v float64) string {
+	v = math.Round(v*10) / 10
+	if v == 0 {
+		v = 0 // no -0
+	}
+	return strconv.FormatFloat(v, 'f', 1, 64)
+}
+
+// forward passes req to the next handler with the geo headers and the
+// attestation set for the decision entry. addr is the client address,
+// invalid when it is unknown.
+func (a *StateBlock) forward(
+	rw http.ResponseWriter, req *http.Request, addr netip.Addr, entry cacheEntry, reason string,
+) {
+	if h := a.geoHeaders; h != nil {
+		var details geoDetails
+		if h.details && entry.countryCode != "" && addr.IsValid() {
+			details = a.lookupDetails(addr)
+		}
+		h.set(req.Header, entry, details, reason)
+	}
+	if a.attestor != nil {
+		a.attest(req, addr, entry, reason)
+	}
+	a.next.ServeHTTP(rw, req)
+}
+
+// lookupDetails returns the geoDetails of addr. Failures leave the detail
+// headers out rather than failing the request.
+func (a *StateBlock) lookupDetails(addr netip.Addr) geoDetails {
+	shared := a.currentDB()
+	if shared == nil {
+		return geoDetails{}
+	}
+	h := shared.acquire()
+	if h == nil {
+		return geoDetails{}
+	}
+	defer h.release()
+	source, ok := h.db.(detailSource)
+	if !ok {
+		return geoDetails{}
+	}
+	details, err := source.lookupDetails(net.IP(addr.AsSlice()))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[%s] ERROR: GeoIP detail lookup failed for %s: %v\n", a.name, addr, err)
+	}
+	return details
+}
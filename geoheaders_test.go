@@ -0,0 +1,114 @@
+package traefik_plugin_state_geo
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/vikewoods/traefik-plugin-state-geo/internal/geoiptest"
+)
+
+func TestGeoHeaders(t *testing.T) {
+	const ipNewYorkASN = "192.0.2.10"
+
+	cfg := CreateConfig()
+	cfg.BlockedStates = []string{"CA"}
+	cfg.WhitelistedIPs = []string{geoiptest.IPTexas}
+	cfg.WhitelistedPaths = []string{"/health"}
+	cfg.DBPath = geoiptest.WriteCityDB(t, geoiptest.Network{
+		CIDR: "192.0.2.0/24", IP: ipNewYorkASN, Country: "US", Subdivision: "NY",
+		Latitude: -0.04, Longitude: 73.96, ASN: 64500,
+	})
+	cfg.GeoHeaders = map[string]string{
+		"X-Geo-Country":     "country",
+		"x-geo-subdivision": "Subdivision",
+		"X-Geo-City":        "city",
+		"X-Geo-Lat":         "latitude",
+		"X-Geo-Lon":         "longitude",
+		"X-Geo-ASN":         "asn",
+		"X-Geo-Reason":      "reason",
+	}
+
+	var forwarded http.Header
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		forwarded = req.Header.Clone()
+	})
+	handler := newTestHandler(t, cfg, next)
+
+	tests := []struct {
+		ip       string
+		path     string
+		expected map[string]string
+	}{
+		{geoiptest.IPNewYork, "/", map[string]string{
+			"X-Geo-Country": "US", "X-Geo-Subdivision": "NY", "X-Geo-City": "New York",
+			"X-Geo-Lat": "40.7", "X-Geo-Lon": "-74.0", "X-Geo-Reason": "allowed",
+		}},
+		{ipNewYorkASN, "/", map[string]string{
+			"X-Geo-Country": "US", "X-Geo-Subdivision": "NY",
+			"X-Geo-Lat": "0.0", "X-Geo-Lon": "74.0", "X-Geo-Asn": "64500", "X-Geo-Reason": "allowed",
+		}},
+		{geoiptest.IPTexas, "/", map[string]string{"X-Geo-Reason": "ip_whitelisted"}},
+		{geoiptest.IPCalifornia, "/health", map[string]string{"X-Geo-Reason": "path_whitelisted"}},
+		{"not-an-ip", "/", map[string]string{"X-Geo-Reason": "fail_open"}},
+	}
+
+	headers := []string{
+		"X-Geo-Country", "X-Geo-Subdivision", "X-Geo-City", "X-Geo-Lat", "X-Geo-Lon", "X-Geo-Asn", "X-Geo-Reason",
+	}
+	for _, tt := range tests {
+		// Every run asks twice, so cached decisions are covered too.
+		for i := 0; i < 2; i++ {
+			req := httptest.NewRequest(http.MethodGet, "http://localhost"+tt.path, nil)
+			req.RemoteAddr = net.JoinHostPort("127.0.0.1", "1234")
+			req.Header.Set("X-Forwarded-For", tt.ip)
+			// Spoofed by the client.
+			for _, name := range headers {
+				req.Header.Add(name, "spoofed")
+			}
+			forwarded = nil
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			if forwarded == nil {
+				t.Fatalf("%s %s: expected the request to be forwarded", tt.ip, tt.path)
+			}
+			for _, name := range headers {
+				got := forwarded.Values(name)
+				want := tt.expected[name]
+				if (want == "" && len(got) != 0) || (want != "" && (len(got) != 1 || got[0] != want)) {
+					t.Errorf("%s %s: expected %s %q, got %q", tt.ip, tt.path, name, want, got)
+				}
+			}
+		}
+	}
+
+	// Blocked visitors never reach the backend.
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+	req.RemoteAddr = net.JoinHostPort(geoiptest.IPCalifornia, "1234")
+	forwarded = nil
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if forwarded != nil {
+		t.Error("expected the blocked request not to be forwarded")
+	}
+}
+
+func TestGeoHeadersConfig(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	invalid := []map[string]string{
+		{"X-Geo-Zip": "postal_code"},
+		{"X-Geo-A": "country", "x-geo-a": "city"},
+		{"X Geo": "country"},
+		{"": "country"},
+	}
+	for _, headers := range invalid {
+		cfg := CreateConfig()
+		cfg.DBPath = geoiptest.WriteCityDB(t)
+		cfg.GeoHeaders = headers
+		if _, err := New(context.Background(), next, cfg, "geo-headers-config-test"); err == nil {
+			t.Errorf("expected %v to be rejected", headers)
+		}
+	}
+}
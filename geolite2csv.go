@@ -0,0 +1,212 @@
+package traefik_plugin_state_geo
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// GeoLite2 CSV file name suffixes. The edition prefix (GeoLite2-City,
+// GeoIP2-City, ...) is not checked so any City-shaped export works.
+var (
+	csvBlocksSuffixes   = []string{"-Blocks-IPv4.csv", "-Blocks-IPv6.csv"}
+	csvLocationsSuffix  = "-Locations-en.csv"
+	csvCompressedSuffix = ".gz"
+)
+
+// csvDB holds a GeoLite2 CSV edition in an in-memory prefix tree. Columns are
+// looked up by header name, so extra enrichment columns are ignored.
+type csvDB struct {
+	tree    *prefixTree
+	results []geoResult
+}
+
+// openGeoLite2CSV loads the blocks and locations files found in dir.
+func openGeoLite2CSV(dir string) (*csvDB, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("dbPath must be a directory for dbFormat %q", formatCSV)
+	}
+
+	locationsPath, err := findCSV(dir, csvLocationsSuffix)
+	if err != nil {
+		return nil, err
+	}
+	if locationsPath == "" {
+		return nil, fmt.Errorf("no *%s file in %s", csvLocationsSuffix, dir)
+	}
+
+	locations, err := readCSVLocations(locationsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	db := &csvDB{tree: newPrefixTree()}
+	interned := make(map[geoResult]int32)
+	loaded := 0
+
+	for _, suffix := range csvBlocksSuffixes {
+		path, err := findCSV(dir, suffix)
+		if err != nil {
+			return nil, err
+		}
+		if path == "" {
+			continue
+		}
+		if err := db.readBlocks(path, locations, interned); err != nil {
+			return nil, err
+		}
+		loaded++
+	}
+	if loaded == 0 {
+		return nil, fmt.Errorf("no *-Blocks-IPv4.csv or *-Blocks-IPv6.csv file in %s", dir)
+	}
+
+	return db, nil
+}
+
+func findCSV(dir, suffix string) (string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), csvCompressedSuffix)
+		if !entry.IsDir() && strings.HasSuffix(name, suffix) {
+			return filepath.Join(dir, entry.Name()), nil
+		}
+	}
+	return "", nil
+}
+
+// readCSVLocations maps geoname_id to the location columns we care about.
+func readCSVLocations(path string) (map[string]geoResult, error) {
+	locations := make(map[string]geoResult)
+
+	err := readCSVFile(path, func(row func(string) string) error {
+		locations[row("geoname_id")] = geoResult{
+			CountryCode:     row("country_iso_code"),
+			SubdivisionCode: row("subdivision_1_iso_code"),
+		}
+		return nil
+	}, "geoname_id", "country_iso_code")
+
+	return locations, err
+}
+
+func (d *csvDB) readBlocks(path string, locations map[string]geoResult, interned map[geoResult]int32) error {
+	return readCSVFile(path, func(row func(string) string) error {
+		prefix, err := netip.ParsePrefix(row("network"))
+		if err != nil {
+			return err
+		}
+
+		// Same as the mmdb edition: without a geoname_id the record carries no
+		// country, only the registered one.
+		var res geoResult
+		if id := row("geoname_id"); id != "" {
+			loc, ok := locations[id]
+			if !ok {
+				return fmt.Errorf("unknown geoname_id %s", id)
+			}
+			res = loc
+		}
+
+		idx, ok := interned[res]
+		if !ok {
+			idx = int32(len(d.results))
+			d.results = append(d.results, res)
+			interned[res] = idx
+		}
+		d.tree.insert(prefix, idx)
+		return nil
+	}, "network", "geoname_id")
+}
+
+// readCSVFile calls fn for every data row of a headed CSV file. fn receives a
+// column accessor by header name; required columns are checked up front.
+func readCSVFile(path string, fn func(row func(string) string) error, required ...string) error {
+	f, err := openDataFile(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("%s: failed to read header: %w", filepath.Base(path), err)
+	}
+
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.TrimSpace(strings.TrimPrefix(name, "\ufeff"))] = i
+	}
+	for _, name := range required {
+		if _, ok := columns[name]; !ok {
+			return fmt.Errorf("%s: missing column %q", filepath.Base(path), name)
+		}
+	}
+
+	var record []string
+	row := func(name string) string {
+		i, ok := columns[name]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return record[i]
+	}
+
+	for line := 2; ; line++ {
+		record, err = reader.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", filepath.Base(path), err)
+		}
+		if err := fn(row); err != nil {
+			return fmt.Errorf("%s: line %d: %w", filepath.Base(path), line, err)
+		}
+	}
+}
+
+func (d *csvDB) Lookup(ip net.IP) (geoResult, netip.Prefix, error) {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return geoResult{}, netip.Prefix{}, nil
+	}
+	idx, network, found := d.tree.lookup(addr)
+	if !found {
+		return geoResult{}, network, nil
+	}
+	return d.results[idx], network, nil
+}
+
+func (d *csvDB) walkNetworks(fn func(netip.Prefix, geoResult)) error {
+	d.tree.leaves(func(prefix netip.Prefix, idx int32) {
+		if idx != noValue {
+			fn(prefix, d.results[idx])
+		}
+	})
+	return nil
+}
+
+// Close leaves the tables alone: lookups still running on a database that was
+// swapped out finish on them, and they are collected once nothing refers to
+// the database anymore.
+func (d *csvDB) Close() error {
+	return nil
+}
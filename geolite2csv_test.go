@@ -0,0 +1,206 @@
+package traefik_plugin_state_geo
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	csvTestBlocksHeader = "network,geoname_id,registered_country_geoname_id," +
+		"represented_country_geoname_id,is_anonymous_proxy,is_satellite_provider,postal_code," +
+		"latitude,longitude,accuracy_radius,is_anycast"
+
+	csvTestLocations = "geoname_id,locale_code,continent_code,continent_name,country_iso_code," +
+		"country_name,subdivision_1_iso_code,subdivision_1_name,subdivision_2_iso_code," +
+		"subdivision_2_name,city_name,metro_code,time_zone,is_in_european_union" + `
+5391959,en,NA,"North America",US,"United States",CA,California,,,"San Francisco",807,America/Los_Angeles,0
+5128581,en,NA,"North America",US,"United States",NY,"New York",,,"New York",501,America/New_York,0
+2643743,en,EU,Europe,GB,"United Kingdom",ENG,England,,,London,,Europe/London,0
+6252001,en,NA,"North America",US,"United States",,,,,,,America/Chicago,0
+`
+	csvTestBlocksV4 = csvTestBlocksHeader + ",internal_segment" + `
+76.79.129.0/24,5391959,6252001,,0,0,94107,37.7749,-122.4194,10,,edge
+76.79.129.128/25,5128581,6252001,,0,0,10001,40.7128,-74.0060,10,,edge
+140.228.62.0/24,2643743,2635167,,0,0,,51.5074,-0.1278,50,,
+161.185.160.0/24,5128581,6252001,,0,0,10001,40.7128,-74.0060,10,,core
+8.8.8.0/24,6252001,6252001,,0,0,,37.751,-97.822,1000,,
+9.9.9.0/24,,6252001,,0,0,,,,,,
+`
+	csvTestBlocksV6 = csvTestBlocksHeader + `
+2600:1700::/28,5391959,6252001,,0,0,,37.7749,-122.4194,100,
+`
+)
+
+func writeGeoLite2CSV(t *testing.T, dir, locations string) {
+	t.Helper()
+
+	files := map[string]string{
+		"GeoLite2-City-Locations-en.csv": locations,
+		"GeoLite2-City-Blocks-IPv4.csv":  csvTestBlocksV4,
+		"GeoLite2-City-Blocks-IPv6.csv":  csvTestBlocksV6,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestGeoLite2CSVLookup(t *testing.T) {
+	dir := t.TempDir()
+	writeGeoLite2CSV(t, dir, csvTestLocations)
+
+	db, err := openGeoDB(formatCSV, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	tests := []struct {
+		ip       string
+		expected geoResult
+		network  string
+	}{
+		{"76.79.129.110", geoResult{CountryCode: "US", SubdivisionCode: "CA"}, "76.79.129.0/25"},
+		{"76.79.129.200", geoResult{CountryCode: "US", SubdivisionCode: "NY"}, "76.79.129.128/25"},
+		{"161.185.160.93", geoResult{CountryCode: "US", SubdivisionCode: "NY"}, "161.185.160.0/24"},
+		{"140.228.62.32", geoResult{CountryCode: "GB", SubdivisionCode: "ENG"}, "140.228.62.0/24"},
+		{"8.8.8.8", geoResult{CountryCode: "US"}, "8.8.8.0/24"},
+		{"9.9.9.9", geoResult{}, "9.9.9.0/24"},
+		{"10.0.0.1", geoResult{}, "10.0.0.0/7"},
+		{"2600:1700::1", geoResult{CountryCode: "US", SubdivisionCode: "CA"}, "2600:1700::/28"},
+		{"2a00::1", geoResult{}, "2800::/5"},
+	}
+
+	for _, tt := range tests {
+		res, network, err := db.Lookup(net.ParseIP(tt.ip))
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.ip, err)
+		}
+		if res != tt.expected {
+			t.Errorf("%s: expected %+v, got %+v", tt.ip, tt.expected, res)
+		}
+		if network.String() != tt.network {
+			t.Errorf("%s: expected network %s, got %s", tt.ip, tt.network, network)
+		}
+	}
+}
+
+func TestGeoLite2CSVErrors(t *testing.T) {
+	if _, err := openGeoDB(formatCSV, t.TempDir()); err == nil {
+		t.Error("expected an empty directory to fail")
+	}
+
+	dir := t.TempDir()
+	writeGeoLite2CSV(t, dir, "geoname_id,country_iso_code\n1,US\n")
+	if _, err := openGeoDB(formatCSV, dir); err == nil {
+		t.Error("expected unknown geoname_id references to fail")
+	}
+}
+
+func TestGeoLite2CSVReload(t *testing.T) {
+	for _, precompile := range []bool{false, true} {
+		testGeoLite2CSVReload(t, precompile)
+	}
+}
+
+func testGeoLite2CSVReload(t *testing.T, precompile bool) {
+	dir := t.TempDir()
+	writeGeoLite2CSV(t, dir, csvTestLocations)
+
+	cfg := CreateConfig()
+	cfg.BlockedStates = []string{"CA"}
+	cfg.DBPath = dir
+	cfg.DBFormat = "csv"
+	cfg.DBReloadInterval = "10ms"
+	cfg.PrecompilePolicy = precompile
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	handler, err := New(ctx, next, cfg, "csv-reload-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handler.(*StateBlock).Close()
+
+	serve := func() int {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = "76.79.129.110:1234" // CA in the first version
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	if code := serve(); code != http.StatusForbidden {
+		t.Fatalf("expected CA visitor to be blocked, got %d", code)
+	}
+
+	// Move San Francisco's geoname to Texas; the cached decision must go too.
+	moved := "geoname_id,country_iso_code,subdivision_1_iso_code\n" +
+		"5391959,US,TX\n5128581,US,NY\n2643743,GB,ENG\n6252001,US,\n"
+	writeGeoLite2CSV(t, dir, moved)
+	future := time.Now().Add(time.Minute)
+	_ = os.Chtimes(filepath.Join(dir, "GeoLite2-City-Locations-en.csv"), future, future)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for serve() != http.StatusOK {
+		if time.Now().After(deadline) {
+			t.Fatalf("database was not reloaded (precompile=%v)", precompile)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestGeoLite2CSVSwapDuringLookups(t *testing.T) {
+	dir := t.TempDir()
+	writeGeoLite2CSV(t, dir, csvTestLocations)
+	open := func() geoDB {
+		db, err := openGeoDB(formatCSV, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+	shared := &sharedDB{name: "csv-swap-test", current: newDBHandle(open()), users: make(map[*StateBlock]struct{})}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ip := net.ParseIP("76.79.129.110")
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				h := shared.acquire()
+				_, _, err := h.db.Lookup(ip)
+				h.release()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 50; i++ {
+		shared.swap(open(), nil, dbStamp{})
+	}
+	close(stop)
+	wg.Wait()
+}
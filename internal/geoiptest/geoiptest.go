@@ -0,0 +1,202 @@
+// Package geoiptest generates a small GeoLite2-City shaped database at test
+// time, so tests never depend on a licensed database being present. Every
+// fixture network comes with a sample address to look up.
+package geoiptest
+
+import (
+	"bytes"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/vikewoods/traefik-plugin-state-geo/internal/mmdbwriter"
+)
+
+// BuildEpoch is the build_epoch of every generated database.
+const BuildEpoch = 1700000000
+
+// Network is one fixture network and the location it resolves to.
+type Network struct {
+	// CIDR is the network inserted into the database.
+	CIDR string
+	// IP is a sample address inside CIDR.
+	IP string
+	// Country is the ISO 3166-1 code, empty for networks without location.
+	Country string
+	// Subdivision is the ISO 3166-2 subdivision code without country prefix.
+	Subdivision string
+	// Names holds localized names of the subdivision.
+	Names map[string]string
+	// City is the English city name, if any.
+	City string
+	// Latitude and Longitude locate the network.
+	Latitude, Longitude float64
+	// ASN is the autonomous system number, stored in traits like GeoIP2
+	// Enterprise does. Zero leaves it out.
+	ASN uint32
+}
+
+// Sample addresses of the default fixture networks.
+const (
+	IPNewYork         = "161.185.160.93"
+	IPCalifornia      = "76.79.129.110"
+	IPTexas           = "23.116.0.10"
+	IPWashington      = "71.231.0.10"
+	IPUSNoSubdivision = "8.8.8.8"
+	IPPuertoRico      = "66.50.0.10"
+	IPGuam            = "202.128.0.10"
+	IPUnitedKingdom   = "140.228.62.32"
+	IPUKWhitelisted   = "140.228.62.31"
+	IPCanadaOntario   = "99.224.0.10"
+	IPMexico          = "187.141.0.10"
+	IPNoLocation      = "198.51.100.10"
+	IPUnknown         = "203.0.113.10"
+
+	IPv6California    = "2600:1700::1"
+	IPv6NewYork       = "2600:1000::1"
+	IPv6UnitedKingdom = "2a02:c7c::1"
+)
+
+var (
+	californiaNames = localizedNames("California", "California", "Californie", "Kalifornien")
+	newYorkNames    = localizedNames("New York", "Nueva York", "New York", "New York")
+	texasNames      = localizedNames("Texas", "Texas", "Texas", "Texas")
+	washingtonNames = localizedNames("Washington", "Washington", "Washington", "Washington")
+	ontarioNames    = localizedNames("Ontario", "Ontario", "Ontario", "Ontario")
+	englandNames    = localizedNames("England", "Inglaterra", "Angleterre", "England")
+	usNames         = localizedNames("United States", "Estados Unidos", "États Unis", "Vereinigte Staaten")
+	prNames         = localizedNames("Puerto Rico", "Puerto Rico", "Porto Rico", "Puerto Rico")
+	guNames         = localizedNames("Guam", "Guam", "Guam", "Guam")
+	mxNames         = localizedNames("Mexico", "México", "Mexique", "Mexiko")
+)
+
+// Networks are the default fixture networks. They cover blocked and allowed
+// US states, US territories (reported as their own countries, like MaxMind
+// does), foreign countries with and without subdivisions, a US record without
+// subdivisions, a network without any location and IPv6.
+var Networks = []Network{
+	{CIDR: "161.185.160.0/24", IP: IPNewYork, Country: "US", Subdivision: "NY",
+		Names: newYorkNames, City: "New York", Latitude: 40.7128, Longitude: -74.006},
+	{CIDR: "76.79.129.0/24", IP: IPCalifornia, Country: "US", Subdivision: "CA",
+		Names: californiaNames, City: "San Francisco", Latitude: 37.7749, Longitude: -122.4194},
+	{CIDR: "23.116.0.0/16", IP: IPTexas, Country: "US", Subdivision: "TX",
+		Names: texasNames, City: "Dallas", Latitude: 32.7767, Longitude: -96.797},
+	{CIDR: "71.231.0.0/16", IP: IPWashington, Country: "US", Subdivision: "WA",
+		Names: washingtonNames, City: "Seattle", Latitude: 47.6062, Longitude: -122.3321},
+	{CIDR: "8.8.8.0/24", IP: IPUSNoSubdivision, Country: "US",
+		Latitude: 37.751, Longitude: -97.822},
+	{CIDR: "66.50.0.0/16", IP: IPPuertoRico, Country: "PR",
+		City: "San Juan", Latitude: 18.4655, Longitude: -66.1057},
+	{CIDR: "202.128.0.0/19", IP: IPGuam, Country: "GU",
+		City: "Hagåtña", Latitude: 13.4757, Longitude: 144.7489},
+	{CIDR: "140.228.62.0/24", IP: IPUnitedKingdom, Country: "GB", Subdivision: "ENG",
+		Names: englandNames, City: "London", Latitude: 51.5074, Longitude: -0.1278},
+	{CIDR: "99.224.0.0/16", IP: IPCanadaOntario, Country: "CA", Subdivision: "ON",
+		Names: ontarioNames, City: "Toronto", Latitude: 43.6532, Longitude: -79.3832},
+	{CIDR: "187.141.0.0/16", IP: IPMexico, Country: "MX", Latitude: 19.4326, Longitude: -99.1332},
+	{CIDR: "198.51.100.0/24", IP: IPNoLocation},
+	{CIDR: "2600:1700::/28", IP: IPv6California, Country: "US", Subdivision: "CA",
+		Names: californiaNames, City: "San Francisco", Latitude: 37.7749, Longitude: -122.4194},
+	{CIDR: "2600:1000::/28", IP: IPv6NewYork, Country: "US", Subdivision: "NY",
+		Names: newYorkNames, City: "New York", Latitude: 40.7128, Longitude: -74.006},
+	{CIDR: "2a02:c7c::/32", IP: IPv6UnitedKingdom, Country: "GB", Subdivision: "ENG",
+		Names: englandNames, City: "London", Latitude: 51.5074, Longitude: -0.1278},
+}
+
+var countryNames = map[string]map[string]string{
+	"US": usNames,
+	"PR": prNames,
+	"GU": guNames,
+	"GB": localizedNames("United Kingdom", "Reino Unido", "Royaume-Uni", "Vereinigtes Königreich"),
+	"CA": localizedNames("Canada", "Canadá", "Canada", "Kanada"),
+	"MX": mxNames,
+}
+
+// localizedNames returns names in English, Spanish, French and German.
+func localizedNames(en, es, fr, de string) map[string]string {
+	return map[string]string{"en": en, "es": es, "fr": fr, "de": de}
+}
+
+// Record returns the GeoLite2-City shaped record for n.
+func (n Network) Record() map[string]any {
+	record := map[string]any{}
+	if n.Country == "" {
+		return record
+	}
+
+	names := countryNames[n.Country]
+	if names == nil {
+		names = map[string]string{"en": n.Country}
+	}
+	country := map[string]any{"iso_code": n.Country, "names": names}
+	record["country"] = country
+	record["registered_country"] = country
+	record["location"] = map[string]any{
+		"latitude":        n.Latitude,
+		"longitude":       n.Longitude,
+		"accuracy_radius": uint16(10),
+	}
+
+	if n.Subdivision != "" {
+		record["subdivisions"] = []any{map[string]any{
+			"iso_code": n.Subdivision,
+			"names":    n.Names,
+		}}
+	}
+	if n.City != "" {
+		record["city"] = map[string]any{"names": map[string]string{"en": n.City}}
+	}
+	if n.ASN != 0 {
+		record["traits"] = map[string]any{"autonomous_system_number": n.ASN}
+	}
+	return record
+}
+
+// Build returns a database holding Networks followed by extra. Extra networks
+// are inserted last, so they override fixture networks with the same CIDR.
+func Build(extra ...Network) ([]byte, error) {
+	w, err := mmdbwriter.New(mmdbwriter.Options{
+		DatabaseType: "GeoLite2-City",
+		Description:  map[string]string{"en": "geoiptest fixture database"},
+		Languages:    []string{"de", "en", "es", "fr"},
+		BuildEpoch:   time.Unix(BuildEpoch, 0),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, n := range append(append([]Network{}, Networks...), extra...) {
+		prefix, err := netip.ParsePrefix(n.CIDR)
+		if err != nil {
+			return nil, err
+		}
+		if err := w.Insert(prefix, n.Record()); err != nil {
+			return nil, err
+		}
+	}
+
+	var buf bytes.Buffer
+	if _, err := w.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// WriteCityDB writes the fixture database into a temporary directory and
+// returns its path.
+func WriteCityDB(tb testing.TB, extra ...Network) string {
+	tb.Helper()
+
+	data, err := Build(extra...)
+	if err != nil {
+		tb.Fatalf("geoiptest: %v", err)
+	}
+
+	path := filepath.Join(tb.TempDir(), "GeoLite2-City.mmdb")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		tb.Fatalf("geoiptest: %v", err)
+	}
+	return path
+}
@@ -0,0 +1,71 @@
+package geoiptest
+
+import (
+	"net"
+	"testing"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+type record struct {
+	Country struct {
+		IsoCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	Subdivisions []struct {
+		IsoCode string `maxminddb:"iso_code"`
+	} `maxminddb:"subdivisions"`
+}
+
+func TestFixtureDatabase(t *testing.T) {
+	reader, err := maxminddb.Open(WriteCityDB(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	if err := reader.Verify(); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+
+	for _, n := range Networks {
+		_, network, _ := net.ParseCIDR(n.CIDR)
+		if !network.Contains(net.ParseIP(n.IP)) {
+			t.Errorf("%s: sample %s is outside the network", n.CIDR, n.IP)
+		}
+
+		var rec record
+		if err := reader.Lookup(net.ParseIP(n.IP), &rec); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Country.IsoCode != n.Country {
+			t.Errorf("%s: expected country %q, got %q", n.IP, n.Country, rec.Country.IsoCode)
+		}
+		if n.Subdivision != "" && (len(rec.Subdivisions) == 0 || rec.Subdivisions[0].IsoCode != n.Subdivision) {
+			t.Errorf("%s: expected subdivision %q, got %+v", n.IP, n.Subdivision, rec.Subdivisions)
+		}
+		if n.Subdivision == "" && len(rec.Subdivisions) != 0 {
+			t.Errorf("%s: expected no subdivisions, got %+v", n.IP, rec.Subdivisions)
+		}
+	}
+
+	var rec record
+	if err := reader.Lookup(net.ParseIP(IPUnknown), &rec); err != nil || rec.Country.IsoCode != "" {
+		t.Errorf("expected %s to be absent, got %+v (%v)", IPUnknown, rec, err)
+	}
+}
+
+func TestExtraNetworksOverride(t *testing.T) {
+	reader, err := maxminddb.Open(WriteCityDB(t, Network{CIDR: "76.79.129.0/24", Country: "US", Subdivision: "NV"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	var rec record
+	if err := reader.Lookup(net.ParseIP(IPCalifornia), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.Subdivisions) == 0 || rec.Subdivisions[0].IsoCode != "NV" {
+		t.Errorf("expected override to win, got %+v", rec)
+	}
+}
@@ -0,0 +1,189 @@
+package mmdbwriter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/big"
+	"sort"
+)
+
+// MaxMind DB data section types, see
+// https://maxmind.github.io/MaxMind-DB/#output-data-section
+const (
+	typeString  = 2
+	typeDouble  = 3
+	typeBytes   = 4
+	typeUint16  = 5
+	typeUint32  = 6
+	typeMap     = 7
+	typeInt32   = 8
+	typeUint64  = 9
+	typeUint128 = 10
+	typeArray   = 11
+	typeBool    = 14
+	typeFloat   = 15
+)
+
+// encode appends the MaxMind DB encoding of v to buf. Maps are written with
+// sorted keys so equal values always produce equal bytes.
+//
+// Supported values are string, float64 (double), float32, []byte, uint16,
+// uint32, uint64, *big.Int (uint128), int32, bool, map[string]any, []any and
+// the []string / map[string]string shorthands. Plain int and uint are written
+// as uint32 when they fit, as int32 when negative and as uint64 otherwise.
+func encode(buf *bytes.Buffer, v any) error {
+	switch v := v.(type) {
+	case string:
+		writeCtrl(buf, typeString, len(v))
+		buf.WriteString(v)
+	case []byte:
+		writeCtrl(buf, typeBytes, len(v))
+		buf.Write(v)
+	case float64:
+		writeCtrl(buf, typeDouble, 8)
+		_ = binary.Write(buf, binary.BigEndian, math.Float64bits(v))
+	case float32:
+		writeCtrl(buf, typeFloat, 4)
+		_ = binary.Write(buf, binary.BigEndian, math.Float32bits(v))
+	case bool:
+		size := 0
+		if v {
+			size = 1
+		}
+		writeCtrl(buf, typeBool, size)
+	case uint16:
+		writeUint(buf, typeUint16, uint64(v))
+	case uint32:
+		writeUint(buf, typeUint32, uint64(v))
+	case uint64:
+		writeUint(buf, typeUint64, v)
+	case uint:
+		if v > math.MaxUint32 {
+			return encode(buf, uint64(v))
+		}
+		return encode(buf, uint32(v))
+	case int:
+		return encodeInt(buf, int64(v))
+	case int64:
+		return encodeInt(buf, v)
+	case int32:
+		if v >= 0 {
+			b := trimLeadingZeros(uint64(v))
+			writeCtrl(buf, typeInt32, len(b))
+			buf.Write(b)
+			return nil
+		}
+		writeCtrl(buf, typeInt32, 4)
+		_ = binary.Write(buf, binary.BigEndian, v)
+	case *big.Int:
+		if v.Sign() < 0 || v.BitLen() > 128 {
+			return fmt.Errorf("uint128 out of range: %s", v)
+		}
+		b := v.Bytes()
+		writeCtrl(buf, typeUint128, len(b))
+		buf.Write(b)
+	case map[string]string:
+		m := make(map[string]any, len(v))
+		for k, s := range v {
+			m[k] = s
+		}
+		return encode(buf, m)
+	case []string:
+		a := make([]any, len(v))
+		for i, s := range v {
+			a[i] = s
+		}
+		return encode(buf, a)
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		writeCtrl(buf, typeMap, len(v))
+		for _, k := range keys {
+			if err := encode(buf, k); err != nil {
+				return err
+			}
+			if err := encode(buf, v[k]); err != nil {
+				return fmt.Errorf("%s: %w", k, err)
+			}
+		}
+	case []any:
+		writeCtrl(buf, typeArray, len(v))
+		for i, e := range v {
+			if err := encode(buf, e); err != nil {
+				return fmt.Errorf("[%d]: %w", i, err)
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported value type %T", v)
+	}
+	return nil
+}
+
+// encodeInt picks the MaxMind type for an untyped Go integer.
+func encodeInt(buf *bytes.Buffer, v int64) error {
+	switch {
+	case v < math.MinInt32:
+		return fmt.Errorf("integer %d does not fit int32", v)
+	case v < 0:
+		return encode(buf, int32(v))
+	case v <= math.MaxUint32:
+		return encode(buf, uint32(v))
+	default:
+		return encode(buf, uint64(v))
+	}
+}
+
+func writeUint(buf *bytes.Buffer, typeNum int, v uint64) {
+	b := trimLeadingZeros(v)
+	writeCtrl(buf, typeNum, len(b))
+	buf.Write(b)
+}
+
+func trimLeadingZeros(v uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	i := 0
+	for i < len(b) && b[i] == 0 {
+		i++
+	}
+	return b[i:]
+}
+
+// writeCtrl writes the control byte, the extended type byte and the size
+// bytes that precede every value.
+func writeCtrl(buf *bytes.Buffer, typeNum, size int) {
+	var ctrl byte
+	extended := typeNum > 7
+	if !extended {
+		ctrl = byte(typeNum) << 5
+	}
+
+	var sizeBytes []byte
+	switch {
+	case size < 29:
+		ctrl |= byte(size)
+	case size < 285:
+		ctrl |= 29
+		sizeBytes = []byte{byte(size - 29)}
+	case size < 65821:
+		ctrl |= 30
+		s := size - 285
+		sizeBytes = []byte{byte(s >> 8), byte(s)}
+	default:
+		ctrl |= 31
+		s := size - 65821
+		sizeBytes = []byte{byte(s >> 16), byte(s >> 8), byte(s)}
+	}
+
+	buf.WriteByte(ctrl)
+	if extended {
+		buf.WriteByte(byte(typeNum - 7))
+	}
+	buf.Write(sizeBytes)
+}
@@ -0,0 +1,359 @@
+// Package mmdbwriter builds MaxMind DB files that the maxminddb reader can
+// open. It supports what custom override, test and internal-range databases
+// need: a search tree over IPv4 or IPv6, a deduplicated data section and
+// configurable metadata. IPv4 networks in IPv6 databases live in ::/96; the
+// ::ffff:0:0/96 and 2002::/16 aliases are not written.
+package mmdbwriter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/netip"
+	"sort"
+	"time"
+)
+
+// MergeStrategy decides what happens when a network is inserted inside, or
+// exactly on top of, a network that already carries a record.
+type MergeStrategy int
+
+const (
+	// MergeReplace gives the more specific (or, for equal networks, the later)
+	// insert its own record unchanged.
+	MergeReplace MergeStrategy = iota
+	// MergeDeep merges maps key by key, recursively; other values are
+	// replaced. Useful for overrides that only change a few fields.
+	MergeDeep
+)
+
+const dataSectionSeparatorSize = 16
+
+var metadataStartMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+// Options configure the database metadata and layout.
+type Options struct {
+	// DatabaseType is stored as database_type, e.g. "GeoLite2-City".
+	DatabaseType string
+	// Description maps language codes to descriptions. At least one entry is
+	// required by Reader.Verify.
+	Description map[string]string
+	// Languages lists the locales used in names maps.
+	Languages []string
+	// IPVersion is 4 or 6 (default).
+	IPVersion int
+	// RecordSize is 24, 28 or 32 bits, or 0 for the smallest that fits.
+	RecordSize int
+	// BuildEpoch is stored as build_epoch; the zero value means now.
+	BuildEpoch time.Time
+	// Merge is the strategy for overlapping networks.
+	Merge MergeStrategy
+}
+
+type insert struct {
+	key    [16]byte
+	bits   int
+	seq    int
+	record any
+}
+
+// Writer collects networks and writes them as a MaxMind DB. Networks can be
+// inserted in any order; the output only depends on the set of inserts and
+// their relative order for identical networks.
+type Writer struct {
+	opts    Options
+	inserts []insert
+}
+
+// New returns a Writer for opts.
+func New(opts Options) (*Writer, error) {
+	if opts.IPVersion == 0 {
+		opts.IPVersion = 6
+	}
+	if opts.IPVersion != 4 && opts.IPVersion != 6 {
+		return nil, fmt.Errorf("ip version must be 4 or 6, got %d", opts.IPVersion)
+	}
+	switch opts.RecordSize {
+	case 0, 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("record size must be 24, 28 or 32, got %d", opts.RecordSize)
+	}
+	if opts.DatabaseType == "" {
+		return nil, fmt.Errorf("database type is required")
+	}
+	if len(opts.Description) == 0 {
+		return nil, fmt.Errorf("at least one description is required")
+	}
+	if opts.BuildEpoch.IsZero() {
+		opts.BuildEpoch = time.Now()
+	}
+	return &Writer{opts: opts}, nil
+}
+
+// Insert associates record with network. The record is validated right away
+// so unsupported value types fail at the offending input.
+func (w *Writer) Insert(network netip.Prefix, record any) error {
+	if !network.IsValid() {
+		return fmt.Errorf("invalid network %v", network)
+	}
+	if err := encode(&bytes.Buffer{}, record); err != nil {
+		return fmt.Errorf("%s: %w", network, err)
+	}
+
+	network = network.Masked()
+	addr, bits := network.Addr(), network.Bits()
+	switch {
+	case addr.Is4In6() && bits >= 96:
+		addr, bits = addr.Unmap(), bits-96
+	case addr.Is6() && w.opts.IPVersion == 4:
+		return fmt.Errorf("%s: IPv6 network in an IPv4 database", network)
+	}
+
+	var key [16]byte
+	if addr.Is4() {
+		v4 := addr.As4()
+		if w.opts.IPVersion == 6 {
+			copy(key[12:], v4[:])
+			bits += 96
+		} else {
+			copy(key[:], v4[:])
+		}
+	} else {
+		key = addr.As16()
+	}
+
+	w.inserts = append(w.inserts, insert{key: key, bits: bits, seq: len(w.inserts), record: record})
+	return nil
+}
+
+type node struct {
+	children [2]*node
+	record   any
+	// number is assigned to inner nodes while writing.
+	number int
+}
+
+func (n *node) isLeaf() bool {
+	return n.children[0] == nil
+}
+
+// build applies the inserts least specific first, so more specific networks
+// always win, and collapses subtrees that resolve to the same data.
+func (w *Writer) build() (*node, error) {
+	inserts := make([]insert, len(w.inserts))
+	copy(inserts, w.inserts)
+	sort.SliceStable(inserts, func(i, j int) bool {
+		a, b := inserts[i], inserts[j]
+		if a.bits != b.bits {
+			return a.bits < b.bits
+		}
+		if c := bytes.Compare(a.key[:], b.key[:]); c != 0 {
+			return c < 0
+		}
+		return a.seq < b.seq
+	})
+
+	root := &node{}
+	for _, ins := range inserts {
+		n := root
+		for i := 0; i < ins.bits; i++ {
+			if n.isLeaf() {
+				n.children = [2]*node{{record: n.record}, {record: n.record}}
+				n.record = nil
+			}
+			n = n.children[(ins.key[i/8]>>(7-i%8))&1]
+		}
+
+		if w.opts.Merge == MergeDeep {
+			n.record = deepMerge(n.record, ins.record)
+		} else {
+			n.record = ins.record
+		}
+	}
+
+	if _, err := collapse(root); err != nil {
+		return nil, err
+	}
+	// The reader needs at least one node, even for an empty database.
+	if root.isLeaf() {
+		root.children = [2]*node{{record: root.record}, {record: root.record}}
+		root.record = nil
+	}
+	return root, nil
+}
+
+// collapse merges sibling leaves with identical encodings into their parent
+// and returns the encoding of n when n is a leaf.
+func collapse(n *node) ([]byte, error) {
+	if n.isLeaf() {
+		if n.record == nil {
+			return nil, nil
+		}
+		var buf bytes.Buffer
+		if err := encode(&buf, n.record); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	left, err := collapse(n.children[0])
+	if err != nil {
+		return nil, err
+	}
+	right, err := collapse(n.children[1])
+	if err != nil {
+		return nil, err
+	}
+
+	if n.children[0].isLeaf() && n.children[1].isLeaf() && bytes.Equal(left, right) {
+		n.record = n.children[0].record
+		n.children = [2]*node{}
+		return left, nil
+	}
+	return nil, nil
+}
+
+// WriteTo writes the complete database to out.
+func (w *Writer) WriteTo(out io.Writer) (int64, error) {
+	root, err := w.build()
+	if err != nil {
+		return 0, err
+	}
+
+	// Number the inner nodes breadth first.
+	var nodes []*node
+	queue := []*node{root}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		n.number = len(nodes)
+		nodes = append(nodes, n)
+		for _, c := range n.children {
+			if !c.isLeaf() {
+				queue = append(queue, c)
+			}
+		}
+	}
+	nodeCount := len(nodes)
+
+	// Write each distinct record once, in tree order.
+	var data bytes.Buffer
+	offsets := make(map[string]int)
+	recordValue := func(c *node) (uint64, error) {
+		if !c.isLeaf() {
+			return uint64(c.number), nil
+		}
+		if c.record == nil {
+			return uint64(nodeCount), nil
+		}
+
+		var buf bytes.Buffer
+		if err := encode(&buf, c.record); err != nil {
+			return 0, err
+		}
+		offset, ok := offsets[buf.String()]
+		if !ok {
+			offset = data.Len()
+			offsets[buf.String()] = offset
+			data.Write(buf.Bytes())
+		}
+		return uint64(nodeCount + dataSectionSeparatorSize + offset), nil
+	}
+
+	records := make([][2]uint64, nodeCount)
+	var maxValue uint64
+	for i, n := range nodes {
+		for side, c := range n.children {
+			v, err := recordValue(c)
+			if err != nil {
+				return 0, err
+			}
+			records[i][side] = v
+			if v > maxValue {
+				maxValue = v
+			}
+		}
+	}
+
+	recordSize := w.opts.RecordSize
+	if recordSize == 0 {
+		switch {
+		case maxValue < 1<<24:
+			recordSize = 24
+		case maxValue < 1<<28:
+			recordSize = 28
+		default:
+			recordSize = 32
+		}
+	}
+	if maxValue >= 1<<uint(recordSize) {
+		return 0, fmt.Errorf("database too large for %d bit records", recordSize)
+	}
+
+	var file bytes.Buffer
+	for _, r := range records {
+		writeNode(&file, recordSize, r[0], r[1])
+	}
+	file.Write(make([]byte, dataSectionSeparatorSize))
+	file.Write(data.Bytes())
+	file.Write(metadataStartMarker)
+
+	metadata := map[string]any{
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint64(w.opts.BuildEpoch.Unix()),
+		"database_type":               w.opts.DatabaseType,
+		"description":                 w.opts.Description,
+		"ip_version":                  uint16(w.opts.IPVersion),
+		"languages":                   append([]string{}, w.opts.Languages...),
+		"node_count":                  uint32(nodeCount),
+		"record_size":                 uint16(recordSize),
+	}
+	if err := encode(&file, metadata); err != nil {
+		return 0, err
+	}
+
+	n, err := out.Write(file.Bytes())
+	return int64(n), err
+}
+
+func writeNode(buf *bytes.Buffer, recordSize int, left, right uint64) {
+	switch recordSize {
+	case 24:
+		buf.Write([]byte{
+			byte(left >> 16), byte(left >> 8), byte(left),
+			byte(right >> 16), byte(right >> 8), byte(right),
+		})
+	case 28:
+		buf.Write([]byte{
+			byte(left >> 16), byte(left >> 8), byte(left),
+			byte((left>>24)&0x0f)<<4 | byte((right>>24)&0x0f),
+			byte(right >> 16), byte(right >> 8), byte(right),
+		})
+	default:
+		var b [8]byte
+		binary.BigEndian.PutUint32(b[:4], uint32(left))
+		binary.BigEndian.PutUint32(b[4:], uint32(right))
+		buf.Write(b[:])
+	}
+}
+
+// deepMerge overlays update on base. Maps are merged recursively without
+// modifying either input; any other value in update replaces base.
+func deepMerge(base, update any) any {
+	baseMap, ok1 := base.(map[string]any)
+	updateMap, ok2 := update.(map[string]any)
+	if !ok1 || !ok2 {
+		return update
+	}
+
+	merged := make(map[string]any, len(baseMap)+len(updateMap))
+	for k, v := range baseMap {
+		merged[k] = v
+	}
+	for k, v := range updateMap {
+		merged[k] = deepMerge(merged[k], v)
+	}
+	return merged
+}
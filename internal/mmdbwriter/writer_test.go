@@ -0,0 +1,277 @@
+package mmdbwriter
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+type cityRecord struct {
+	Country struct {
+		IsoCode   string `maxminddb:"iso_code"`
+		GeonameID uint   `maxminddb:"geoname_id"`
+	} `maxminddb:"country"`
+	Subdivisions []struct {
+		IsoCode string `maxminddb:"iso_code"`
+	} `maxminddb:"subdivisions"`
+	Location struct {
+		Latitude  float64 `maxminddb:"latitude"`
+		Longitude float64 `maxminddb:"longitude"`
+	} `maxminddb:"location"`
+	Names map[string]string `maxminddb:"names"`
+}
+
+func testOptions() Options {
+	return Options{
+		DatabaseType: "Test-City",
+		Description:  map[string]string{"en": "test database"},
+		Languages:    []string{"en"},
+		BuildEpoch:   time.Unix(1700000000, 0),
+	}
+}
+
+func build(t *testing.T, opts Options, inserts map[string]any) *maxminddb.Reader {
+	t.Helper()
+
+	w, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for network, record := range inserts {
+		if err := w.Insert(netip.MustParsePrefix(network), record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if _, err := w.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := maxminddb.FromBytes(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reader.Verify(); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	return reader
+}
+
+func state(country, subdivision string) map[string]any {
+	return map[string]any{
+		"country":      map[string]any{"iso_code": country, "geoname_id": uint32(6252001)},
+		"subdivisions": []any{map[string]any{"iso_code": subdivision}},
+		"location":     map[string]any{"latitude": 37.5, "longitude": -122.25},
+		"names":        map[string]string{"en": subdivision},
+	}
+}
+
+func TestWriterRoundTrip(t *testing.T) {
+	for _, recordSize := range []int{0, 24, 28, 32} {
+		for _, ipVersion := range []int{4, 6} {
+			opts := testOptions()
+			opts.RecordSize = recordSize
+			opts.IPVersion = ipVersion
+
+			inserts := map[string]any{
+				"76.79.129.0/24":   state("US", "CA"),
+				"161.185.160.0/24": state("US", "NY"),
+				"140.228.62.0/23":  map[string]any{"country": map[string]any{"iso_code": "GB"}},
+			}
+			if ipVersion == 6 {
+				inserts["2600:1700::/28"] = state("US", "TX")
+			}
+			reader := build(t, opts, inserts)
+
+			if reader.Metadata.BuildEpoch != 1700000000 || reader.Metadata.DatabaseType != "Test-City" {
+				t.Errorf("unexpected metadata %+v", reader.Metadata)
+			}
+
+			tests := []struct {
+				ip          string
+				country     string
+				subdivision string
+				network     string
+			}{
+				{"76.79.129.110", "US", "CA", "76.79.129.0/24"},
+				{"161.185.160.93", "US", "NY", "161.185.160.0/24"},
+				{"140.228.63.1", "GB", "", "140.228.62.0/23"},
+				{"10.0.0.1", "", "", ""},
+			}
+			if ipVersion == 6 {
+				tests = append(tests, struct {
+					ip          string
+					country     string
+					subdivision string
+					network     string
+				}{"2600:1700::1", "US", "TX", "2600:1700::/28"})
+			}
+
+			for _, tt := range tests {
+				var rec cityRecord
+				network, ok, err := reader.LookupNetwork(net.ParseIP(tt.ip), &rec)
+				if err != nil {
+					t.Fatalf("%s: %v", tt.ip, err)
+				}
+				if rec.Country.IsoCode != tt.country {
+					t.Errorf("v%d/%d %s: expected country %q, got %q",
+						ipVersion, recordSize, tt.ip, tt.country, rec.Country.IsoCode)
+				}
+				subdivisions := rec.Subdivisions
+				if tt.subdivision != "" && (len(subdivisions) == 0 || subdivisions[0].IsoCode != tt.subdivision) {
+					t.Errorf("v%d/%d %s: expected subdivision %q, got %+v",
+						ipVersion, recordSize, tt.ip, tt.subdivision, subdivisions)
+				}
+				if tt.network != "" && (!ok || network.String() != tt.network) {
+					t.Errorf("v%d/%d %s: expected network %s, got %v",
+						ipVersion, recordSize, tt.ip, tt.network, network)
+				}
+				if tt.country == "US" && (rec.Location.Latitude != 37.5 || rec.Country.GeonameID != 6252001) {
+					t.Errorf("v%d/%d %s: unexpected location %+v", ipVersion, recordSize, tt.ip, rec)
+				}
+			}
+		}
+	}
+}
+
+func TestWriterMergeStrategies(t *testing.T) {
+	inserts := map[string]any{
+		"10.0.0.0/8":  map[string]any{"country": map[string]any{"iso_code": "US"}, "tag": "wide"},
+		"10.1.0.0/16": map[string]any{"tag": "override"},
+	}
+
+	type tagged struct {
+		Country struct {
+			IsoCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+		Tag string `maxminddb:"tag"`
+	}
+
+	opts := testOptions()
+	reader := build(t, opts, inserts)
+	var rec tagged
+	if err := reader.Lookup(net.ParseIP("10.1.2.3"), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Tag != "override" || rec.Country.IsoCode != "" {
+		t.Errorf("replace: unexpected record %+v", rec)
+	}
+
+	opts.Merge = MergeDeep
+	reader = build(t, opts, inserts)
+	rec = tagged{}
+	if err := reader.Lookup(net.ParseIP("10.1.2.3"), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Tag != "override" || rec.Country.IsoCode != "US" {
+		t.Errorf("deep: unexpected record %+v", rec)
+	}
+
+	rec = tagged{}
+	if err := reader.Lookup(net.ParseIP("10.200.0.1"), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Tag != "wide" {
+		t.Errorf("deep: covering network changed: %+v", rec)
+	}
+}
+
+func TestWriterIsDeterministic(t *testing.T) {
+	write := func(order []string) []byte {
+		w, err := New(testOptions())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, network := range order {
+			if err := w.Insert(netip.MustParsePrefix(network), map[string]any{"n": network}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var buf bytes.Buffer
+		if _, err := w.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	a := write([]string{"10.0.0.0/8", "10.1.0.0/16", "2001:db8::/32", "192.168.0.0/16"})
+	b := write([]string{"192.168.0.0/16", "2001:db8::/32", "10.1.0.0/16", "10.0.0.0/8"})
+	if !bytes.Equal(a, b) {
+		t.Error("output depends on insertion order")
+	}
+}
+
+func TestWriterCollapsesIdenticalSiblings(t *testing.T) {
+	record := map[string]any{"country": map[string]any{"iso_code": "US"}}
+	reader := build(t, testOptions(), map[string]any{
+		"10.0.0.0/9":   record,
+		"10.128.0.0/9": record,
+	})
+
+	network, ok, err := reader.LookupNetwork(net.ParseIP("10.1.1.1"), &struct{}{})
+	if err != nil || !ok {
+		t.Fatal(ok, err)
+	}
+	if network.String() != "10.0.0.0/8" {
+		t.Errorf("expected siblings to collapse into 10.0.0.0/8, got %s", network)
+	}
+}
+
+func TestWriterRejectsInvalidInput(t *testing.T) {
+	if _, err := New(Options{DatabaseType: "x"}); err == nil {
+		t.Error("expected missing description to fail")
+	}
+	invalid := Options{DatabaseType: "x", Description: map[string]string{"en": "x"}, RecordSize: 20}
+	if _, err := New(invalid); err == nil {
+		t.Error("expected record size 20 to fail")
+	}
+
+	opts := testOptions()
+	opts.IPVersion = 4
+	w, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Insert(netip.MustParsePrefix("2001:db8::/32"), "x"); err == nil {
+		t.Error("expected IPv6 network in IPv4 database to fail")
+	}
+	if err := w.Insert(netip.MustParsePrefix("10.0.0.0/8"), struct{}{}); err == nil {
+		t.Error("expected unsupported record type to fail")
+	}
+}
+
+func TestWriterEncodesAllSizeClasses(t *testing.T) {
+	record := map[string]any{}
+	for _, n := range []int{28, 100, 1000, 70000} {
+		record[fmt.Sprintf("s%d", n)] = string(bytes.Repeat([]byte{'x'}, n))
+	}
+	record["neg"] = int32(-5)
+	record["pos"] = int32(5)
+	record["big"] = uint64(1 << 40)
+	record["flag"] = true
+	record["f32"] = float32(1.5)
+
+	reader := build(t, testOptions(), map[string]any{"10.0.0.0/8": record})
+
+	var got map[string]any
+	if err := reader.Lookup(net.ParseIP("10.0.0.1"), &got); err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range record {
+		if s, ok := v.(string); ok {
+			if got[k] != s {
+				t.Errorf("%s: string of length %d did not round trip", k, len(s))
+			}
+		}
+	}
+	if got["neg"] != -5 || got["pos"] != 5 || got["big"] != uint64(1<<40) || got["flag"] != true ||
+		got["f32"] != float32(1.5) {
+		t.Errorf("unexpected scalars %v %v %v %v %v", got["neg"], got["pos"], got["big"], got["flag"], got["f32"])
+	}
+}
@@ -0,0 +1,329 @@
+package traefik_plugin_state_geo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+)
+
+// IP2Location BIN layout, see https://www.ip2location.com/development-libraries.
+// All offsets stored in the header are 1-based, string pointers are 0-based.
+const (
+	ip2lHeaderSize = 30
+
+	// Every BIN edition stores the country in column 2 and, from DB3 on, the
+	// region in column 3. Column 1 is the range start.
+	ip2lCountryColumn = 2
+	ip2lRegionColumn  = 3
+	ip2lMinRegionType = 3
+)
+
+type ip2locationDB struct {
+	data []byte
+
+	columns   uint32
+	ipv4Count uint32
+	ipv4Addr  uint32
+	ipv6Count uint32
+	ipv6Addr  uint32
+	ipv4Index uint32
+	ipv6Index uint32
+}
+
+func openIP2Location(path string) (*ip2locationDB, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return newIP2Location(data)
+}
+
+func newIP2Location(data []byte) (*ip2locationDB, error) {
+	if len(data) < ip2lHeaderSize {
+		return nil, fmt.Errorf("invalid IP2Location BIN file: header too short")
+	}
+
+	dbType := data[0]
+	if dbType < ip2lMinRegionType {
+		return nil, fmt.Errorf("IP2Location DB%d has no region column, use DB3 or later", dbType)
+	}
+
+	db := &ip2locationDB{
+		data:      data,
+		columns:   uint32(data[1]),
+		ipv4Count: binary.LittleEndian.Uint32(data[5:]),
+		ipv4Addr:  binary.LittleEndian.Uint32(data[9:]),
+		ipv6Count: binary.LittleEndian.Uint32(data[13:]),
+		ipv6Addr:  binary.LittleEndian.Uint32(data[17:]),
+		ipv4Index: binary.LittleEndian.Uint32(data[21:]),
+		ipv6Index: binary.LittleEndian.Uint32(data[25:]),
+	}
+	if db.columns < ip2lRegionColumn {
+		return nil, fmt.Errorf("invalid IP2Location BIN file: %d columns", db.columns)
+	}
+	return db, nil
+}
+
+func (d *ip2locationDB) Lookup(ip net.IP) (geoResult, netip.Prefix, error) {
+	if v4 := ip.To4(); v4 != nil {
+		return d.lookupV4(binary.BigEndian.Uint32(v4))
+	}
+	if v6 := ip.To16(); v6 != nil && d.ipv6Count > 0 {
+		return d.lookupV6(v6)
+	}
+	return geoResult{}, netip.Prefix{}, nil
+}
+
+func (d *ip2locationDB) lookupV4(ipNum uint32) (geoResult, netip.Prefix, error) {
+	colSize := d.columns * 4
+	low, high := 0, int(d.ipv4Count)-1
+
+	if d.ipv4Index > 0 {
+		l, h, err := d.indexRange(d.ipv4Index + (ipNum>>16)<<3)
+		if err != nil {
+			return geoResult{}, netip.Prefix{}, err
+		}
+		low = l
+		if h < high {
+			high = h
+		}
+	}
+
+	// The upper bound of a range is the start of the next row and therefore
+	// exclusive, so the very last address is looked up as its predecessor.
+	if ipNum == ^uint32(0) {
+		ipNum--
+	}
+
+	for low <= high {
+		mid := (low + high) / 2
+		row := d.ipv4Addr + uint32(mid)*colSize
+
+		from, err := d.uint32At(row)
+		if err != nil {
+			return geoResult{}, netip.Prefix{}, err
+		}
+		to := ^uint32(0)
+		if uint32(mid+1) < d.ipv4Count {
+			if to, err = d.uint32At(row + colSize); err != nil {
+				return geoResult{}, netip.Prefix{}, err
+			}
+		}
+
+		switch {
+		case ipNum < from:
+			high = mid - 1
+		case ipNum >= to:
+			low = mid + 1
+		default:
+			// Rows store the start of the next range as their end, except
+			// for the last row which runs to the end of the address space.
+			last := to
+			if uint32(mid+1) < d.ipv4Count {
+				last--
+			}
+			res, err := d.readRecord(row + 4)
+			return res, rangePrefix(uint32Addr(ipNum), uint32Addr(from), uint32Addr(last)), err
+		}
+	}
+	return geoResult{}, netip.Prefix{}, nil
+}
+
+func (d *ip2locationDB) lookupV6(ip net.IP) (geoResult, netip.Prefix, error) {
+	colSize := 16 + (d.columns-1)*4
+	low, high := 0, int(d.ipv6Count)-1
+
+	if d.ipv6Index > 0 {
+		l, h, err := d.indexRange(d.ipv6Index + uint32(binary.BigEndian.Uint16(ip))<<3)
+		if err != nil {
+			return geoResult{}, netip.Prefix{}, err
+		}
+		low = l
+		if h < high {
+			high = h
+		}
+	}
+
+	target := make([]byte, 16)
+	copy(target, ip)
+	if bytes.Equal(target, bytes.Repeat([]byte{0xff}, 16)) {
+		target[15]--
+	}
+
+	for low <= high {
+		mid := (low + high) / 2
+		row := d.ipv6Addr + uint32(mid)*colSize
+
+		from, err := d.uint128At(row)
+		if err != nil {
+			return geoResult{}, netip.Prefix{}, err
+		}
+		to := bytes.Repeat([]byte{0xff}, 16)
+		if uint32(mid+1) < d.ipv6Count {
+			if to, err = d.uint128At(row + colSize); err != nil {
+				return geoResult{}, netip.Prefix{}, err
+			}
+		}
+
+		switch {
+		case bytes.Compare(target, from) < 0:
+			high = mid - 1
+		case bytes.Compare(target, to) >= 0:
+			low = mid + 1
+		default:
+			addr, _ := netip.AddrFromSlice(target)
+			first, _ := netip.AddrFromSlice(from)
+			last, _ := netip.AddrFromSlice(to)
+			if uint32(mid+1) < d.ipv6Count {
+				last = last.Prev()
+			}
+			res, err := d.readRecord(row + 16)
+			return res, rangePrefix(addr, first, last), err
+		}
+	}
+	return geoResult{}, netip.Prefix{}, nil
+}
+
+func (d *ip2locationDB) walkNetworks(fn func(netip.Prefix, geoResult)) error {
+	colSize := d.columns * 4
+	for i := uint32(0); i < d.ipv4Count; i++ {
+		row := d.ipv4Addr + i*colSize
+		from, err := d.uint32At(row)
+		if err != nil {
+			return err
+		}
+		last := ^uint32(0)
+		if i+1 < d.ipv4Count {
+			next, err := d.uint32At(row + colSize)
+			if err != nil {
+				return err
+			}
+			last = next - 1
+		}
+		if last < from {
+			continue
+		}
+		res, err := d.readRecord(row + 4)
+		if err != nil {
+			return err
+		}
+		rangePrefixes(uint32Addr(from), uint32Addr(last), func(prefix netip.Prefix) {
+			fn(prefix, res)
+		})
+	}
+
+	colSize = 16 + (d.columns-1)*4
+	for i := uint32(0); i < d.ipv6Count; i++ {
+		row := d.ipv6Addr + i*colSize
+		from, err := d.uint128At(row)
+		if err != nil {
+			return err
+		}
+		first, _ := netip.AddrFromSlice(from)
+		last := maxIPv6
+		if i+1 < d.ipv6Count {
+			next, err := d.uint128At(row + colSize)
+			if err != nil {
+				return err
+			}
+			last, _ = netip.AddrFromSlice(next)
+			last = last.Prev()
+		}
+		if last.Less(first) {
+			continue
+		}
+		res, err := d.readRecord(row + 16)
+		if err != nil {
+			return err
+		}
+		rangePrefixes(first, last, func(prefix netip.Prefix) {
+			fn(prefix, res)
+		})
+	}
+	return nil
+}
+
+// readRecord decodes the country and region columns of the row whose first
+// data column starts at pos.
+func (d *ip2locationDB) readRecord(pos uint32) (geoResult, error) {
+	countryPtr, err := d.uint32At(pos + (ip2lCountryColumn-2)*4)
+	if err != nil {
+		return geoResult{}, err
+	}
+	regionPtr, err := d.uint32At(pos + (ip2lRegionColumn-2)*4)
+	if err != nil {
+		return geoResult{}, err
+	}
+
+	country, err := d.stringAt(countryPtr)
+	if err != nil {
+		return geoResult{}, err
+	}
+	region, err := d.stringAt(regionPtr)
+	if err != nil {
+		return geoResult{}, err
+	}
+
+	// IP2Location uses "-" for ranges it has no data for.
+	if country == "-" {
+		return geoResult{}, nil
+	}
+	return geoResult{
+		CountryCode:     country,
+		SubdivisionCode: subdivisionCode(country, region),
+	}, nil
+}
+
+func (d *ip2locationDB) indexRange(pos uint32) (int, int, error) {
+	low, err := d.uint32At(pos)
+	if err != nil {
+		return 0, 0, err
+	}
+	high, err := d.uint32At(pos + 4)
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(low), int(high), nil
+}
+
+// uint32At reads a little endian value at the 1-based offset pos.
+func (d *ip2locationDB) uint32At(pos uint32) (uint32, error) {
+	if pos == 0 || int(pos-1)+4 > len(d.data) {
+		return 0, fmt.Errorf("invalid IP2Location BIN file: offset %d out of range", pos)
+	}
+	return binary.LittleEndian.Uint32(d.data[pos-1:]), nil
+}
+
+// uint128At reads a little endian 128-bit value at the 1-based offset pos and
+// returns it big endian so it compares like a net.IP.
+func (d *ip2locationDB) uint128At(pos uint32) ([]byte, error) {
+	if pos == 0 || int(pos-1)+16 > len(d.data) {
+		return nil, fmt.Errorf("invalid IP2Location BIN file: offset %d out of range", pos)
+	}
+	out := make([]byte, 16)
+	for i := 0; i < 16; i++ {
+		out[i] = d.data[int(pos-1)+15-i]
+	}
+	return out, nil
+}
+
+// stringAt reads a length prefixed string at the 0-based offset pos.
+func (d *ip2locationDB) stringAt(pos uint32) (string, error) {
+	if int(pos) >= len(d.data) {
+		return "", fmt.Errorf("invalid IP2Location BIN file: string offset %d out of range", pos)
+	}
+	end := int(pos) + 1 + int(d.data[pos])
+	if end > len(d.data) {
+		return "", fmt.Errorf("invalid IP2Location BIN file: string offset %d out of range", pos)
+	}
+	return string(d.data[pos+1 : end]), nil
+}
+
+// Close leaves the file contents alone, see csvDB.Close. Readers check
+// len(d.data) before indexing it, so it must not change under them.
+func (d *ip2locationDB) Close() error {
+	return nil
+}
@@ -0,0 +1,159 @@
+package traefik_plugin_state_geo
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// templateSet is a block response template with its language variants.
+// Variants live next to the template and carry the language tag before the
+// extension: blocked.html, blocked.es.html, blocked.pt-br.html.
+type templateSet struct {
+	base     pageTemplate
+	variants map[string]pageTemplate // keyed by lower-case language tag
+}
+
+// loadTemplateSet parses the template at path and its language variants.
+// The legacy {{STATE}} placeholder is rewritten to {{.Location}}. Variants
+// are optional: one removed while the set loads is left out.
+func loadTemplateSet(path string, parse func(name, text string) (pageTemplate, error)) (*templateSet, error) {
+	base, err := loadTemplateFile(path, parse)
+	if err != nil {
+		return nil, err
+	}
+	set := &templateSet{base: base, variants: make(map[string]pageTemplate)}
+
+	dir, file := filepath.Split(path)
+	ext := filepath.Ext(file)
+	stem := strings.TrimSuffix(file, ext)
+	entries, err := os.ReadDir(filepath.Clean(dir))
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, stem+".") || !strings.HasSuffix(name, ext) {
+			continue
+		}
+		lang := strings.TrimSuffix(strings.TrimPrefix(name, stem+"."), ext)
+		if !isLanguageTag(lang) {
+			continue
+		}
+		variant, err := loadTemplateFile(filepath.Join(dir, name), parse)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		set.variants[strings.ToLower(lang)] = variant
+	}
+	return set, nil
+}
+
+func loadTemplateFile(path string, parse func(name, text string) (pageTemplate, error)) (pageTemplate, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	text := strings.ReplaceAll(string(content), legacyStatePlaceholder, "{{.Location}}")
+	tmpl, err := parse(filepath.Base(path), text)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return tmpl, nil
+}
+
+// isMissingFile reports errors that leave a template out at startup instead
+// of failing the configuration.
+func isMissingFile(err error) bool {
+	return errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrPermission)
+}
+
+// isLanguageTag accepts the shape of BCP 47 tags: a 2-3 letter language
+// followed by alphanumeric subtags, e.g. es, pt-BR or zh-Hant-TW.
+func isLanguageTag(s string) bool {
+	for i, part := range strings.Split(s, "-") {
+		if len(part) == 0 || len(part) > 8 || (i == 0 && (len(part) < 2 || len(part) > 3)) {
+			return false
+		}
+		for _, r := range part {
+			isLetter := (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+			if !isLetter && (i == 0 || r < '0' || r > '9') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// pick returns the variant for the first language in langs the set has, or
+// the base template. Tags fall back to their primary language, so es-MX
+// matches an es variant. A nil set picks nothing.
+func (s *templateSet) pick(langs []string) (pageTemplate, string) {
+	if s == nil {
+		return nil, ""
+	}
+	for _, lang := range langs {
+		if tmpl, ok := s.variants[lang]; ok {
+			return tmpl, lang
+		}
+		if i := strings.IndexByte(lang, '-'); i > 0 {
+			if tmpl, ok := s.variants[lang[:i]]; ok {
+				return tmpl, lang[:i]
+			}
+		}
+	}
+	return s.base, ""
+}
+
+// parseAcceptLanguage returns the languages of an Accept-Language header,
+// lower-cased and ordered by preference. The wildcard and languages with
+// q=0 are dropped.
+func parseAcceptLanguage(header string) []string {
+	if header == "" {
+		return nil
+	}
+
+	type weighted struct {
+		lang string
+		q    float64
+	}
+	var langs []weighted
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		lang := strings.ToLower(strings.TrimSpace(params[0]))
+		if lang == "" || lang == "*" {
+			continue
+		}
+		if q := qValue(params[1:]); q > 0 {
+			langs = append(langs, weighted{lang: lang, q: q})
+		}
+	}
+	sort.SliceStable(langs, func(i, j int) bool { return langs[i].q > langs[j].q })
+
+	out := make([]string, len(langs))
+	for i, l := range langs {
+		out[i] = l.lang
+	}
+	return out
+}
+
+// jurisdictions returns the keys of per-jurisdiction options that apply to
+// page, most specific first: the ISO 3166-2 state code (US-NY), then the
+// country code.
+func jurisdictions(page BlockPage) []string {
+	var keys []string
+	if page.CountryCode != "" && page.StateCode != "" {
+		keys = append(keys, page.CountryCode+"-"+page.StateCode)
+	}
+	if page.CountryCode != "" {
+		keys = append(keys, page.CountryCode)
+	}
+	return keys
+}
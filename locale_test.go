@@ -0,0 +1,130 @@
+package traefik_plugin_state_geo
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/vikewoods/traefik-plugin-state-geo/internal/geoiptest"
+)
+
+func TestParseAcceptLanguage(t *testing.T) {
+	tests := []struct {
+		header   string
+		expected []string
+	}{
+		{"", nil},
+		{"es", []string{"es"}},
+		{"en-US,en;q=0.9,es;q=0.8", []string{"en-us", "en", "es"}},
+		{"fr;q=0.5, es-MX, *;q=0.1", []string{"es-mx", "fr"}},
+		{"de;q=0, it", []string{"it"}},
+		{"pt-BR;q=0.7,pt;q=0.7,en;q=0.8", []string{"en", "pt-br", "pt"}},
+	}
+
+	for _, tt := range tests {
+		got := parseAcceptLanguage(tt.header)
+		if len(got) == 0 && len(tt.expected) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("%q: expected %v, got %v", tt.header, tt.expected, got)
+		}
+	}
+}
+
+func TestIsLanguageTag(t *testing.T) {
+	for _, tag := range []string{"es", "pt-BR", "zh-Hant-TW", "es-419", "fil"} {
+		if !isLanguageTag(tag) {
+			t.Errorf("expected %q to be a language tag", tag)
+		}
+	}
+	for _, tag := range []string{"", "e", "backup", "es-", "1e", "es_MX"} {
+		if isLanguageTag(tag) {
+			t.Errorf("expected %q not to be a language tag", tag)
+		}
+	}
+}
+
+func TestJurisdictionTemplatesAndLanguages(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"blocked.html":    "default {{.Location}}",
+		"blocked.es.html": "predeterminado {{.Location}}",
+		"ny.html":         "new york legal text",
+		"ny.es.html":      "texto legal de nueva york",
+		"ny.pt-br.html":   "texto legal de nova york",
+		"gb.html":         "uk legal text",
+		"ny.backup.html":  "{{.Broken",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := CreateConfig()
+	cfg.BlockedStates = []string{"CA", "NY"}
+	cfg.DBPath = geoiptest.WriteCityDB(t)
+	cfg.TemplatePath = filepath.Join(dir, "blocked.html")
+	cfg.Templates = map[string]string{
+		"us-ny": filepath.Join(dir, "ny.html"),
+		"GB":    filepath.Join(dir, "gb.html"),
+	}
+	handler := newTestHandler(t, cfg, nil)
+
+	tests := []struct {
+		ip       string
+		language string
+		body     string
+		content  string
+	}{
+		{geoiptest.IPNewYork, "", "new york legal text", ""},
+		{geoiptest.IPNewYork, "es-MX,en;q=0.5", "texto legal de nueva york", "es"},
+		{geoiptest.IPNewYork, "pt-BR", "texto legal de nova york", "pt-br"},
+		{geoiptest.IPNewYork, "fr", "new york legal text", ""},
+		{geoiptest.IPCalifornia, "es", "predeterminado CA", "es"},
+		{geoiptest.IPCalifornia, "de, en;q=0.1", "default CA", ""},
+		{geoiptest.IPUnitedKingdom, "es", "uk legal text", ""},
+		{geoiptest.IPMexico, "es", "predeterminado MX", "es"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+		req.RemoteAddr = net.JoinHostPort(tt.ip, "1234")
+		if tt.language != "" {
+			req.Header.Set("Accept-Language", tt.language)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+
+		if got := recorder.Body.String(); got != tt.body {
+			t.Errorf("%s %q: expected %q, got %q", tt.ip, tt.language, tt.body, got)
+		}
+		if got := recorder.Header().Get("Content-Language"); got != tt.content {
+			t.Errorf("%s %q: expected Content-Language %q, got %q", tt.ip, tt.language, tt.content, got)
+		}
+	}
+}
+
+func TestBrokenLanguageVariantFailsAtNew(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{"ny.html": "ok", "ny.es.html": "{{.Broken"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := CreateConfig()
+	cfg.DBPath = geoiptest.WriteCityDB(t)
+	cfg.Templates = map[string]string{"US-NY": filepath.Join(dir, "ny.html")}
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	if _, err := New(context.Background(), next, cfg, "broken-variant-test"); err == nil {
+		t.Fatal("expected a broken language variant to fail")
+	}
+}
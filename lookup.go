@@ -0,0 +1,311 @@
+package traefik_plugin_state_geo
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+const (
+	formatMMDB        = "mmdb"
+	formatIP2Location = "ip2location"
+	formatDBIP        = "dbip"
+	formatCSV         = "csv"
+)
+
+var errDBClosed = errors.New("geoip database is closed")
+
+// geoResult is the backend independent view of a database record. Every
+// backend maps its own record layout onto it so the blocking decision in
+// ServeHTTP does not depend on where the data came from.
+type geoResult struct {
+	CountryCode     string
+	SubdivisionCode string
+}
+
+// geoDetails are the record fields that are only forwarded to backends, see
+// geoHeaders. They are decoded on demand, so they do not slow down decisions.
+type geoDetails struct {
+	City        string
+	Latitude    float64
+	Longitude   float64
+	HasLocation bool
+	ASN         uint64
+}
+
+// geoDB is implemented by every supported database backend. A lookup for an
+// address the database does not know returns a zero geoResult and no error.
+//
+// Lookup also returns the network the result applies to: every address in it
+// resolves to the same result. Backends that cannot tell return the zero
+// Prefix, and callers treat the result as valid for ip alone.
+type geoDB interface {
+	Lookup(ip net.IP) (geoResult, netip.Prefix, error)
+	Close() error
+}
+
+// nameSource is implemented by backends whose records carry localized
+// location names. localizedNames returns the names of a country (US) or
+// subdivision (US-CA) keyed by lower-case language tag, or nil when no record
+// naming it has been read yet.
+type nameSource interface {
+	localizedNames(code string) map[string]string
+}
+
+// detailSource is implemented by backends that can report geoDetails. An
+// address the database does not know returns zero details and no error.
+type detailSource interface {
+	lookupDetails(ip net.IP) (geoDetails, error)
+}
+
+// openGeoDB opens path with the backend selected by format. An empty format
+// picks the backend from the file extension, treats directories as GeoLite2
+// CSV editions and falls back to mmdb.
+func openGeoDB(format, path string) (geoDB, error) {
+	if format == "" || format == "auto" {
+		format = detectFormat(path)
+	}
+
+	switch strings.ToLower(format) {
+	case formatMMDB:
+		return openMMDB(path)
+	case formatIP2Location:
+		return openIP2Location(path)
+	case formatDBIP:
+		return openDBIP(path)
+	case formatCSV:
+		return openGeoLite2CSV(path)
+	default:
+		return nil, fmt.Errorf("unsupported dbFormat %q", format)
+	}
+}
+
+func detectFormat(path string) string {
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return formatCSV
+	}
+
+	name := strings.ToLower(filepath.Base(path))
+	name = strings.TrimSuffix(name, ".gz")
+
+	switch filepath.Ext(name) {
+	case ".bin":
+		return formatIP2Location
+	case ".csv":
+		return formatDBIP
+	default:
+		return formatMMDB
+	}
+}
+
+// mmdbDB looks up GeoIP2/GeoLite2 databases. Records are decoded by
+// recordDecoder and cached by offset, so the reflection based decoder of the
+// reader is never used. The localized names of decoded records are kept in
+// names, their details in details once asked for.
+type mmdbDB struct {
+	reader  *maxminddb.Reader
+	records recordCache
+	names   nameTable
+	details detailCache
+}
+
+func openMMDB(path string) (*mmdbDB, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &mmdbDB{
+		reader:  reader,
+		records: recordCache{records: make(map[uintptr]geoResult)},
+		names:   nameTable{names: make(map[string]map[string]string)},
+		details: detailCache{details: make(map[uintptr]geoDetails)},
+	}, nil
+}
+
+func (m *mmdbDB) Lookup(ip net.IP) (geoResult, netip.Prefix, error) {
+	var capture offsetCapture
+	network, _, err := m.reader.LookupNetwork(ip, &capture)
+	if err != nil {
+		return geoResult{}, netip.Prefix{}, err
+	}
+	prefix := prefixFromIPNet(network)
+	if !capture.found {
+		return geoResult{}, prefix, nil
+	}
+	res, err := m.record(capture.offset)
+	return res, prefix, err
+}
+
+func (m *mmdbDB) walkNetworks(fn func(netip.Prefix, geoResult)) error {
+	networks := m.reader.Networks(maxminddb.SkipAliasedNetworks)
+	for networks.Next() {
+		var capture offsetCapture
+		network, err := networks.Network(&capture)
+		if err != nil {
+			return err
+		}
+		prefix := prefixFromIPNet(network)
+		if !prefix.IsValid() || !capture.found {
+			continue
+		}
+		res, err := m.record(capture.offset)
+		if err != nil {
+			return err
+		}
+		fn(prefix, res)
+	}
+	return networks.Err()
+}
+
+// record decodes the record at offset, at most once per record.
+func (m *mmdbDB) record(offset uintptr) (geoResult, error) {
+	if res, ok := m.records.get(offset); ok {
+		return res, nil
+	}
+	var dec recordDecoder
+	if err := m.reader.Decode(offset, &dec); err != nil {
+		return geoResult{}, err
+	}
+	m.records.put(offset, dec.result)
+	m.names.add(dec.result.CountryCode, dec.countryNames)
+	if dec.result.SubdivisionCode != "" {
+		m.names.add(dec.result.CountryCode+"-"+dec.result.SubdivisionCode, dec.subdivisionNames)
+	}
+	return dec.result, nil
+}
+
+func (m *mmdbDB) lookupDetails(ip net.IP) (geoDetails, error) {
+	var capture offsetCapture
+	if _, _, err := m.reader.LookupNetwork(ip, &capture); err != nil || !capture.found {
+		return geoDetails{}, err
+	}
+	if details, ok := m.details.get(capture.offset); ok {
+		return details, nil
+	}
+	dec := recordDecoder{details: &geoDetails{}}
+	if err := m.reader.Decode(capture.offset, &dec); err != nil {
+		return geoDetails{}, err
+	}
+	m.details.put(capture.offset, *dec.details)
+	return *dec.details, nil
+}
+
+func (m *mmdbDB) localizedNames(code string) map[string]string {
+	return m.names.get(code)
+}
+
+func (m *mmdbDB) Close() error {
+	return m.reader.Close()
+}
+
+// prefixFromIPNet converts a network returned by the maxminddb reader. IPv4
+// networks come back as IPv4 addresses with a 32 bit mask.
+func prefixFromIPNet(network *net.IPNet) netip.Prefix {
+	if network == nil {
+		return netip.Prefix{}
+	}
+	addr, ok := netip.AddrFromSlice(network.IP)
+	if !ok {
+		return netip.Prefix{}
+	}
+	ones, bits := network.Mask.Size()
+	addr = addr.Unmap()
+	if addr.Is4() && bits == 128 {
+		ones -= 96
+	}
+	prefix, err := addr.Prefix(ones)
+	if err != nil {
+		return netip.Prefix{}
+	}
+	return prefix
+}
+
+// rangePrefix returns the largest prefix around addr that lies within the
+// inclusive range first..last. It turns the address ranges of range based
+// backends into networks that can be cached as a whole.
+func rangePrefix(addr, first, last netip.Addr) netip.Prefix {
+	best, _ := addr.Prefix(addr.BitLen())
+	for bits := addr.BitLen() - 1; bits >= 0; bits-- {
+		candidate, _ := addr.Prefix(bits)
+		if candidate.Addr().Less(first) || last.Less(lastAddr(candidate)) {
+			break
+		}
+		best = candidate
+	}
+	return best
+}
+
+// rangePrefixes calls fn for the fewest aligned prefixes that exactly cover
+// the inclusive range first..last, in ascending order.
+func rangePrefixes(first, last netip.Addr, fn func(netip.Prefix)) {
+	for !last.Less(first) {
+		prefix := netip.PrefixFrom(first, first.BitLen())
+		for bits := first.BitLen() - 1; bits >= 0; bits-- {
+			candidate, _ := first.Prefix(bits)
+			if candidate.Addr() != first || last.Less(lastAddr(candidate)) {
+				break
+			}
+			prefix = candidate
+		}
+		fn(prefix)
+
+		end := lastAddr(prefix)
+		if end == last {
+			return
+		}
+		first = end.Next()
+	}
+}
+
+// lastAddr returns the highest address of prefix.
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	addr := prefix.Addr()
+	if addr.Is4() {
+		b := addr.As4()
+		for i := prefix.Bits(); i < 32; i++ {
+			b[i/8] |= 0x80 >> (i % 8)
+		}
+		return netip.AddrFrom4(b)
+	}
+	b := addr.As16()
+	for i := prefix.Bits(); i < 128; i++ {
+		b[i/8] |= 0x80 >> (i % 8)
+	}
+	return netip.AddrFrom16(b)
+}
+
+type gzipFile struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (g gzipFile) Close() error {
+	_ = g.Reader.Close()
+	return g.file.Close()
+}
+
+// openDataFile opens a text database, transparently decompressing .gz files.
+func openDataFile(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(strings.ToLower(path), ".gz") {
+		return f, nil
+	}
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return gzipFile{Reader: gz, file: f}, nil
+}
@@ -0,0 +1,283 @@
+package traefik_plugin_state_geo
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type ip2lTestRow struct {
+	from    string
+	country string
+	region  string
+}
+
+// writeIP2LocationBIN builds a minimal DB3 file (country, region, city). Rows
+// must be sorted and the first row of each family must start at the lowest
+// address. With indexed set an IPv4 index table is appended.
+func writeIP2LocationBIN(t *testing.T, v4, v6 []ip2lTestRow, indexed bool) string {
+	t.Helper()
+
+	const columns = 4 // ip_from, country, region, city
+	v4Size := columns * 4
+	v6Size := 16 + (columns-1)*4
+
+	header := make([]byte, 64)
+	v4Addr := len(header) + 1
+	v6Addr := v4Addr + len(v4)*v4Size
+	strBase := v6Addr - 1 + len(v6)*v6Size
+
+	var strs bytes.Buffer
+	offsets := map[string]uint32{}
+	str := func(s string) uint32 {
+		if off, ok := offsets[s]; ok {
+			return off
+		}
+		off := uint32(strBase + strs.Len())
+		strs.WriteByte(byte(len(s)))
+		strs.WriteString(s)
+		offsets[s] = off
+		return off
+	}
+
+	var body bytes.Buffer
+	fields := func(row ip2lTestRow) {
+		_ = binary.Write(&body, binary.LittleEndian, str(row.country))
+		_ = binary.Write(&body, binary.LittleEndian, str(row.region))
+		_ = binary.Write(&body, binary.LittleEndian, str("-"))
+	}
+	for _, row := range v4 {
+		_ = binary.Write(&body, binary.LittleEndian, binary.BigEndian.Uint32(net.ParseIP(row.from).To4()))
+		fields(row)
+	}
+	for _, row := range v6 {
+		ip := net.ParseIP(row.from).To16()
+		for i := 15; i >= 0; i-- {
+			body.WriteByte(ip[i])
+		}
+		fields(row)
+	}
+
+	header[0] = 3
+	header[1] = columns
+	binary.LittleEndian.PutUint32(header[5:], uint32(len(v4)))
+	binary.LittleEndian.PutUint32(header[9:], uint32(v4Addr))
+	binary.LittleEndian.PutUint32(header[13:], uint32(len(v6)))
+	binary.LittleEndian.PutUint32(header[17:], uint32(v6Addr))
+
+	data := append(append(header, body.Bytes()...), strs.Bytes()...)
+
+	if indexed {
+		rowFor := func(ip uint32) uint32 {
+			idx := 0
+			for i, row := range v4 {
+				if binary.BigEndian.Uint32(net.ParseIP(row.from).To4()) <= ip {
+					idx = i
+				}
+			}
+			return uint32(idx)
+		}
+
+		binary.LittleEndian.PutUint32(data[21:], uint32(len(data)+1))
+		index := make([]byte, 8<<16)
+		for i := uint32(0); i < 1<<16; i++ {
+			binary.LittleEndian.PutUint32(index[i*8:], rowFor(i<<16))
+			binary.LittleEndian.PutUint32(index[i*8+4:], rowFor(i<<16|0xffff))
+		}
+		data = append(data, index...)
+	}
+
+	path := filepath.Join(t.TempDir(), "IP2LOCATION-DB3.BIN")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestIP2LocationLookup(t *testing.T) {
+	for _, indexed := range []bool{false, true} {
+		testIP2LocationLookup(t, indexed)
+	}
+}
+
+func testIP2LocationLookup(t *testing.T, indexed bool) {
+	path := writeIP2LocationBIN(t,
+		[]ip2lTestRow{
+			{"0.0.0.0", "-", "-"},
+			{"76.79.129.0", "US", "California"},
+			{"76.79.130.0", "-", "-"},
+			{"140.228.62.0", "GB", "England"},
+			{"140.228.63.0", "-", "-"},
+			{"161.185.160.0", "US", "New York"},
+			{"161.185.161.0", "-", "-"},
+		},
+		[]ip2lTestRow{
+			{"::", "-", "-"},
+			{"2600:1700::", "US", "Texas"},
+			{"2600:1701::", "-", "-"},
+		},
+		indexed,
+	)
+
+	db, err := openGeoDB("", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	tests := []struct {
+		ip       string
+		expected geoResult
+		network  string
+	}{
+		{"76.79.129.110", geoResult{CountryCode: "US", SubdivisionCode: "CA"}, "76.79.129.0/24"},
+		{"161.185.160.93", geoResult{CountryCode: "US", SubdivisionCode: "NY"}, "161.185.160.0/24"},
+		{"140.228.62.32", geoResult{CountryCode: "GB"}, "140.228.62.0/24"},
+		{"10.0.0.1", geoResult{}, "0.0.0.0/2"},
+		{"255.255.255.255", geoResult{}, "192.0.0.0/2"},
+		{"2600:1700::1", geoResult{CountryCode: "US", SubdivisionCode: "TX"}, "2600:1700::/32"},
+		{"2a00::1", geoResult{}, "2800::/5"},
+	}
+
+	for _, tt := range tests {
+		res, network, err := db.Lookup(net.ParseIP(tt.ip))
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.ip, err)
+		}
+		if res != tt.expected {
+			t.Errorf("%s (indexed=%v): expected %+v, got %+v", tt.ip, indexed, tt.expected, res)
+		}
+		if network.String() != tt.network {
+			t.Errorf("%s (indexed=%v): expected network %s, got %s", tt.ip, indexed, tt.network, network)
+		}
+	}
+}
+
+func TestIP2LocationRejectsCountryOnlyEdition(t *testing.T) {
+	header := make([]byte, 64)
+	header[0] = 1
+	header[1] = 2
+
+	if _, err := newIP2Location(header); err == nil {
+		t.Error("expected DB1 to be rejected")
+	}
+}
+
+const dbipTestCSV = `1.0.0.0,1.0.0.255,OC,AU,Queensland,"South Brisbane",-27.4767,153.017
+76.79.129.0,76.79.129.255,NA,US,California,"San Francisco",37.7749,-122.419
+140.228.62.0,140.228.62.255,EU,GB,England,London,51.5074,-0.127758
+161.185.160.0,161.185.160.255,NA,US,"New York","New York",40.7128,-74.006
+2600:1700::,2600:1700:ffff:ffff:ffff:ffff:ffff:ffff,NA,US,Texas,Dallas,32.7767,-96.797
+`
+
+func TestDBIPLookup(t *testing.T) {
+	dir := t.TempDir()
+
+	plain := filepath.Join(dir, "dbip-city-lite.csv")
+	if err := os.WriteFile(plain, []byte(dbipTestCSV), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	_, _ = w.Write([]byte(dbipTestCSV))
+	_ = w.Close()
+	compressed := filepath.Join(dir, "dbip-city-lite.csv.gz")
+	if err := os.WriteFile(compressed, gz.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{plain, compressed} {
+		db, err := openGeoDB("", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tests := []struct {
+			ip       string
+			expected geoResult
+			network  string
+		}{
+			{"76.79.129.110", geoResult{CountryCode: "US", SubdivisionCode: "CA"}, "76.79.129.0/24"},
+			{"161.185.160.93", geoResult{CountryCode: "US", SubdivisionCode: "NY"}, "161.185.160.0/24"},
+			{"140.228.62.32", geoResult{CountryCode: "GB"}, "140.228.62.0/24"},
+			{"1.0.0.1", geoResult{CountryCode: "AU"}, "1.0.0.0/24"},
+			{"10.0.0.1", geoResult{}, "8.0.0.0/5"},
+			{"2600:1700::1", geoResult{CountryCode: "US", SubdivisionCode: "TX"}, "2600:1700::/32"},
+			{"2a00::1", geoResult{}, "2800::/5"},
+		}
+
+		for _, tt := range tests {
+			res, network, err := db.Lookup(net.ParseIP(tt.ip))
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %v", tt.ip, err)
+			}
+			if res != tt.expected {
+				t.Errorf("%s (%s): expected %+v, got %+v", tt.ip, filepath.Base(path), tt.expected, res)
+			}
+			if network.String() != tt.network {
+				t.Errorf("%s (%s): expected network %s, got %s", tt.ip, filepath.Base(path), tt.network, network)
+			}
+		}
+		_ = db.Close()
+	}
+}
+
+// A swapped out database is closed while lookups may still run on it.
+func TestLookupAfterClose(t *testing.T) {
+	csvDir := t.TempDir()
+	writeGeoLite2CSV(t, csvDir, csvTestLocations)
+	dbipPath := filepath.Join(t.TempDir(), "dbip-city-lite.csv")
+	if err := os.WriteFile(dbipPath, []byte(dbipTestCSV), 0644); err != nil {
+		t.Fatal(err)
+	}
+	binPath := writeIP2LocationBIN(t, []ip2lTestRow{
+		{"0.0.0.0", "-", "-"},
+		{"76.79.129.0", "US", "California"},
+		{"76.79.130.0", "-", "-"},
+	}, nil, true)
+
+	for _, path := range []string{csvDir, dbipPath, binPath} {
+		format := ""
+		if path == csvDir {
+			format = formatCSV
+		}
+		db, err := openGeoDB(format, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		res, _, err := db.Lookup(net.ParseIP("76.79.129.1"))
+		if err != nil || res != (geoResult{CountryCode: "US", SubdivisionCode: "CA"}) {
+			t.Errorf("%s: expected lookups to keep working after Close, got %+v, %v", filepath.Base(path), res, err)
+		}
+	}
+}
+
+func TestDetectFormat(t *testing.T) {
+	tests := map[string]string{
+		"/data/GeoLite2-City.mmdb":         formatMMDB,
+		"/data/IP2LOCATION-LITE-DB3.BIN":   formatIP2Location,
+		"/data/dbip-city-lite-2024-01.csv": formatDBIP,
+		"/data/dbip-city-lite.csv.gz":      formatDBIP,
+		"/plugins-local/geoip":             formatMMDB,
+	}
+
+	for path, expected := range tests {
+		if got := detectFormat(path); got != expected {
+			t.Errorf("%s: expected %s, got %s", path, expected, got)
+		}
+	}
+}
+
+func TestOpenGeoDBUnknownFormat(t *testing.T) {
+	if _, err := openGeoDB("sqlite", "/data/geo.db"); err == nil {
+		t.Error("expected unknown dbFormat to fail")
+	}
+}
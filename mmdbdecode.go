@@ -0,0 +1,322 @@
+package traefik_plugin_state_geo
+
+import (
+	"math/big"
+	"strings"
+	"sync"
+)
+
+// recordDecoder decodes the country and first subdivision ISO codes of a
+// GeoIP2/GeoLite2 record, and their localized names, without reflection. It
+// implements the maxminddb reader's deserializer hook: the reader streams the
+// record as events and recordDecoder skips every value that does not lead to
+// one of the codes or names.
+type recordDecoder struct {
+	result  geoResult
+	stack   []decodeFrame
+	pending int // context of the value the reader is about to emit
+
+	// countryNames and subdivisionNames are keyed by language tag as the
+	// database spells it, e.g. en or pt-BR.
+	countryNames     map[string]string
+	subdivisionNames map[string]string
+
+	// details is decoded as well when set.
+	details *geoDetails
+}
+
+// Decoding contexts, i.e. where in the record a value sits.
+const (
+	ctxSkip = iota
+	ctxRoot
+	ctxCountry
+	ctxCountryISO
+	ctxSubdivisions
+	ctxSubdivision
+	ctxSubdivisionISO
+	ctxCountryNames
+	ctxCountryName
+	ctxSubdivisionNames
+	ctxSubdivisionName
+	ctxCity
+	ctxCityNames
+	ctxCityName
+	ctxLocation
+	ctxLatitude
+	ctxLongitude
+	ctxTraits
+	ctxASN
+)
+
+type decodeFrame struct {
+	ctx     int
+	isMap   bool
+	wantKey bool // a map frame expects a key next
+	key     string
+	index   int
+}
+
+// child returns the context of the next value of the innermost container.
+func (d *recordDecoder) child() int {
+	if len(d.stack) == 0 {
+		return ctxRoot
+	}
+	f := &d.stack[len(d.stack)-1]
+	if f.isMap {
+		switch {
+		case f.ctx == ctxRoot && f.key == "country":
+			return ctxCountry
+		case f.ctx == ctxRoot && f.key == "subdivisions":
+			return ctxSubdivisions
+		case f.ctx == ctxCountry && f.key == "iso_code":
+			return ctxCountryISO
+		case f.ctx == ctxSubdivision && f.key == "iso_code":
+			return ctxSubdivisionISO
+		case f.ctx == ctxCountry && f.key == "names":
+			return ctxCountryNames
+		case f.ctx == ctxSubdivision && f.key == "names":
+			return ctxSubdivisionNames
+		case f.ctx == ctxCountryNames:
+			return ctxCountryName
+		case f.ctx == ctxSubdivisionNames:
+			return ctxSubdivisionName
+		}
+		if d.details != nil {
+			return f.detailChild()
+		}
+		return ctxSkip
+	}
+	if f.ctx == ctxSubdivisions && f.index == 0 {
+		return ctxSubdivision
+	}
+	return ctxSkip
+}
+
+// detailChild returns the context of the next value of a map frame that
+// leads to geoDetails: the English city name, the location and the ASN of
+// GeoIP2 Enterprise and ISP records or of GeoLite2-ASN shaped records.
+func (f *decodeFrame) detailChild() int {
+	switch {
+	case f.ctx == ctxRoot && f.key == "city":
+		return ctxCity
+	case f.ctx == ctxCity && f.key == "names":
+		return ctxCityNames
+	case f.ctx == ctxCityNames && f.key == "en":
+		return ctxCityName
+	case f.ctx == ctxRoot && f.key == "location":
+		return ctxLocation
+	case f.ctx == ctxLocation && f.key == "latitude":
+		return ctxLatitude
+	case f.ctx == ctxLocation && f.key == "longitude":
+		return ctxLongitude
+	case f.ctx == ctxRoot && f.key == "traits":
+		return ctxTraits
+	case (f.ctx == ctxRoot || f.ctx == ctxTraits) && f.key == "autonomous_system_number":
+		return ctxASN
+	}
+	return ctxSkip
+}
+
+// advance records that the innermost container finished one key or value.
+func (d *recordDecoder) advance() {
+	if len(d.stack) == 0 {
+		return
+	}
+	f := &d.stack[len(d.stack)-1]
+	if f.isMap {
+		f.wantKey = !f.wantKey
+	} else {
+		f.index++
+	}
+}
+
+// ShouldSkip is called before every key and value, and again when the value
+// is reached through a pointer, so it only changes state when skipping.
+func (d *recordDecoder) ShouldSkip(uintptr) (bool, error) {
+	if n := len(d.stack); n > 0 && d.stack[n-1].isMap && d.stack[n-1].wantKey {
+		return false, nil
+	}
+	d.pending = d.child()
+	if d.pending == ctxSkip {
+		d.advance()
+		return true, nil
+	}
+	return false, nil
+}
+
+func (d *recordDecoder) start(isMap bool) error {
+	d.stack = append(d.stack, decodeFrame{ctx: d.pending, isMap: isMap, wantKey: isMap})
+	return nil
+}
+
+func (d *recordDecoder) StartMap(uint) error   { return d.start(true) }
+func (d *recordDecoder) StartSlice(uint) error { return d.start(false) }
+
+func (d *recordDecoder) End() error {
+	d.stack = d.stack[:len(d.stack)-1]
+	d.advance()
+	return nil
+}
+
+func (d *recordDecoder) String(s string) error {
+	if n := len(d.stack); n > 0 && d.stack[n-1].isMap && d.stack[n-1].wantKey {
+		d.stack[n-1].key = s
+	} else {
+		switch d.pending {
+		case ctxCountryISO:
+			d.result.CountryCode = s
+		case ctxSubdivisionISO:
+			d.result.SubdivisionCode = s
+		case ctxCountryName:
+			if d.countryNames == nil {
+				d.countryNames = make(map[string]string)
+			}
+			d.countryNames[d.stack[len(d.stack)-1].key] = s
+		case ctxSubdivisionName:
+			if d.subdivisionNames == nil {
+				d.subdivisionNames = make(map[string]string)
+			}
+			d.subdivisionNames[d.stack[len(d.stack)-1].key] = s
+		case ctxCityName:
+			d.details.City = s
+		}
+	}
+	d.advance()
+	return nil
+}
+
+func (d *recordDecoder) scalar() error {
+	d.advance()
+	return nil
+}
+
+func (d *recordDecoder) Float64(v float64) error {
+	switch d.pending {
+	case ctxLatitude:
+		d.details.Latitude, d.details.HasLocation = v, true
+	case ctxLongitude:
+		d.details.Longitude = v
+	}
+	return d.scalar()
+}
+
+func (d *recordDecoder) asn(v uint64) error {
+	if d.pending == ctxASN {
+		d.details.ASN = v
+	}
+	return d.scalar()
+}
+
+func (d *recordDecoder) Uint16(v uint16) error  { return d.asn(uint64(v)) }
+func (d *recordDecoder) Uint32(v uint32) error  { return d.asn(uint64(v)) }
+func (d *recordDecoder) Uint64(v uint64) error  { return d.asn(v) }
+func (d *recordDecoder) Bytes([]byte) error     { return d.scalar() }
+func (d *recordDecoder) Int32(int32) error      { return d.scalar() }
+func (d *recordDecoder) Uint128(*big.Int) error { return d.scalar() }
+func (d *recordDecoder) Bool(bool) error        { return d.scalar() }
+func (d *recordDecoder) Float32(float32) error  { return d.scalar() }
+
+// offsetCapture stops the reader right before decoding and remembers where
+// the record starts. LookupNetwork with it yields network and record offset
+// in one tree traversal.
+type offsetCapture struct {
+	offset uintptr
+	found  bool
+}
+
+func (c *offsetCapture) ShouldSkip(offset uintptr) (bool, error) {
+	c.offset, c.found = offset, true
+	return true, nil
+}
+
+func (c *offsetCapture) StartSlice(uint) error  { return nil }
+func (c *offsetCapture) StartMap(uint) error    { return nil }
+func (c *offsetCapture) End() error             { return nil }
+func (c *offsetCapture) String(string) error    { return nil }
+func (c *offsetCapture) Float64(float64) error  { return nil }
+func (c *offsetCapture) Bytes([]byte) error     { return nil }
+func (c *offsetCapture) Uint16(uint16) error    { return nil }
+func (c *offsetCapture) Uint32(uint32) error    { return nil }
+func (c *offsetCapture) Int32(int32) error      { return nil }
+func (c *offsetCapture) Uint64(uint64) error    { return nil }
+func (c *offsetCapture) Uint128(*big.Int) error { return nil }
+func (c *offsetCapture) Bool(bool) error        { return nil }
+func (c *offsetCapture) Float32(float32) error  { return nil }
+
+// maxDecodedRecords bounds the decode cache. GeoIP2 databases share records
+// between networks, so a few thousand entries cover most traffic.
+const maxDecodedRecords = 1 << 16
+
+// recordCache maps record offsets to decoded results, so every distinct
+// record is decoded once.
+type recordCache struct {
+	mu      sync.RWMutex
+	records map[uintptr]geoResult
+}
+
+func (c *recordCache) get(offset uintptr) (geoResult, bool) {
+	c.mu.RLock()
+	res, ok := c.records[offset]
+	c.mu.RUnlock()
+	return res, ok
+}
+
+func (c *recordCache) put(offset uintptr, res geoResult) {
+	c.mu.Lock()
+	if len(c.records) < maxDecodedRecords {
+		c.records[offset] = res
+	}
+	c.mu.Unlock()
+}
+
+// detailCache maps record offsets to decoded details, see recordCache.
+type detailCache struct {
+	mu      sync.RWMutex
+	details map[uintptr]geoDetails
+}
+
+func (c *detailCache) get(offset uintptr) (geoDetails, bool) {
+	c.mu.RLock()
+	details, ok := c.details[offset]
+	c.mu.RUnlock()
+	return details, ok
+}
+
+func (c *detailCache) put(offset uintptr, details geoDetails) {
+	c.mu.Lock()
+	if len(c.details) < maxDecodedRecords {
+		c.details[offset] = details
+	}
+	c.mu.Unlock()
+}
+
+// nameTable holds the localized names decoded from records, keyed by the
+// country code (US) or the ISO 3166-2 code of the subdivision (US-CA). Names
+// belong to the location rather than the record, so the first record that
+// carries them fills the entry.
+type nameTable struct {
+	mu    sync.RWMutex
+	names map[string]map[string]string
+}
+
+func (t *nameTable) get(code string) map[string]string {
+	t.mu.RLock()
+	names := t.names[code]
+	t.mu.RUnlock()
+	return names
+}
+
+func (t *nameTable) add(code string, names map[string]string) {
+	if code == "" || len(names) == 0 {
+		return
+	}
+	t.mu.Lock()
+	if _, ok := t.names[code]; !ok {
+		localized := make(map[string]string, len(names))
+		for lang, name := range names {
+			localized[strings.ToLower(lang)] = name
+		}
+		t.names[code] = localized
+	}
+	t.mu.Unlock()
+}
@@ -0,0 +1,245 @@
+package traefik_plugin_state_geo
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/vikewoods/traefik-plugin-state-geo/internal/geoiptest"
+	"github.com/vikewoods/traefik-plugin-state-geo/internal/mmdbwriter"
+)
+
+// reflectRecord is the reflection based view recordDecoder replaces.
+type reflectRecord struct {
+	Country struct {
+		IsoCode string            `maxminddb:"iso_code"`
+		Names   map[string]string `maxminddb:"names"`
+	} `maxminddb:"country"`
+	Subdivisions []struct {
+		IsoCode string            `maxminddb:"iso_code"`
+		Names   map[string]string `maxminddb:"names"`
+	} `maxminddb:"subdivisions"`
+}
+
+func TestRecordDecoderMatchesReflection(t *testing.T) {
+	w, err := mmdbwriter.New(mmdbwriter.Options{
+		DatabaseType: "GeoIP2-City",
+		Description:  map[string]string{"en": "record decoder test"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// iso_code and names keys outside country and the first subdivision are
+	// decoys.
+	records := map[string]any{
+		"10.0.0.0/24": map[string]any{
+			"continent": map[string]any{
+				"code": "NA", "iso_code": "XX", "names": map[string]string{"en": "North America"},
+			},
+			"country": map[string]any{
+				"iso_code": "US", "names": map[string]string{"en": "United States"}, "is_in_european_union": false,
+			},
+			"registered_country": map[string]any{"iso_code": "DE"},
+			"subdivisions": []any{
+				map[string]any{
+					"iso_code":   "CA",
+					"geoname_id": uint32(5332921),
+					"names":      map[string]string{"en": "California", "fr": "Californie"},
+				},
+				map[string]any{"iso_code": "LA", "names": map[string]string{"en": "Louisiana"}},
+			},
+			"location": map[string]any{"latitude": 37.5, "longitude": -122.1, "accuracy_radius": uint16(5)},
+			"traits":   []any{uint64(1), int32(-2), []byte{1}, float32(1.5), true, map[string]any{"iso_code": "YY"}},
+		},
+		"10.0.1.0/24": map[string]any{"country": map[string]any{"iso_code": "GB"}},
+		"10.0.2.0/24": map[string]any{"subdivisions": []any{map[string]any{"iso_code": "ON"}}},
+		"10.0.3.0/24": map[string]any{
+			"country": "not a map", "subdivisions": []any{"not a map", map[string]any{"iso_code": "ZZ"}},
+		},
+		"10.0.4.0/24": map[string]any{},
+	}
+	for cidr, record := range records {
+		if err := w.Insert(netip.MustParsePrefix(cidr), record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	if _, err := w.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	custom, err := maxminddb.FromBytes(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fixture, err := geoiptest.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	city, err := maxminddb.FromBytes(fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, reader := range map[string]*maxminddb.Reader{"custom": custom, "fixture": city} {
+		networks := reader.Networks(maxminddb.SkipAliasedNetworks)
+		count := 0
+		for networks.Next() {
+			var capture offsetCapture
+			network, err := networks.Network(&capture)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var dec recordDecoder
+			if err := reader.Decode(capture.offset, &dec); err != nil {
+				t.Fatalf("%s: %s: %v", name, network, err)
+			}
+
+			var want reflectRecord
+			_ = reader.Decode(capture.offset, &want) // type mismatches leave zero values
+			expected := geoResult{CountryCode: want.Country.IsoCode}
+			var subdivisionNames map[string]string
+			if len(want.Subdivisions) > 0 {
+				expected.SubdivisionCode = want.Subdivisions[0].IsoCode
+				subdivisionNames = want.Subdivisions[0].Names
+			}
+
+			if dec.result != expected {
+				t.Errorf("%s: %s: decoded %+v, want %+v", name, network, dec.result, expected)
+			}
+			if !sameNames(dec.countryNames, want.Country.Names) || !sameNames(dec.subdivisionNames, subdivisionNames) {
+				t.Errorf("%s: %s: decoded names %v and %v, want %v and %v", name, network,
+					dec.countryNames, dec.subdivisionNames, want.Country.Names, subdivisionNames)
+			}
+			count++
+		}
+		if err := networks.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if count == 0 {
+			t.Fatalf("%s: no networks", name)
+		}
+	}
+}
+
+func sameNames(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for lang, name := range a {
+		if b[lang] != name {
+			return false
+		}
+	}
+	return true
+}
+
+func TestMMDBLookupCachesRecords(t *testing.T) {
+	db, err := openMMDB(geoiptest.WriteCityDB(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 3; i++ {
+		res, network, err := db.Lookup(net.ParseIP(geoiptest.IPCalifornia))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != (geoResult{CountryCode: "US", SubdivisionCode: "CA"}) || network.String() != "76.79.129.0/24" {
+			t.Fatalf("unexpected result %+v in %s", res, network)
+		}
+	}
+	if n := len(db.records.records); n != 1 {
+		t.Errorf("expected 1 decoded record, got %d", n)
+	}
+
+	res, network, err := db.Lookup(net.ParseIP(geoiptest.IPUnknown))
+	if err != nil || res != (geoResult{}) || !network.Contains(netip.MustParseAddr(geoiptest.IPUnknown)) {
+		t.Errorf("unexpected miss result %+v in %s: %v", res, network, err)
+	}
+}
+
+func TestMMDBLocalizedNames(t *testing.T) {
+	db, err := openMMDB(geoiptest.WriteCityDB(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if names := db.localizedNames("US-CA"); names != nil {
+		t.Fatalf("expected no names before a lookup, got %v", names)
+	}
+	if _, _, err := db.Lookup(net.ParseIP(geoiptest.IPCalifornia)); err != nil {
+		t.Fatal(err)
+	}
+	if got := db.localizedNames("US-CA")["fr"]; got != "Californie" {
+		t.Errorf("expected Californie, got %q", got)
+	}
+	if got := db.localizedNames("US")["es"]; got != "Estados Unidos" {
+		t.Errorf("expected Estados Unidos, got %q", got)
+	}
+}
+
+func TestMMDBLookupDetails(t *testing.T) {
+	w, err := mmdbwriter.New(mmdbwriter.Options{
+		DatabaseType: "GeoIP2-City",
+		Description:  map[string]string{"en": "details test"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := map[string]any{
+		// GeoLite2-ASN keeps the number at the root.
+		"10.0.0.0/24": map[string]any{
+			"autonomous_system_number":       uint32(64501),
+			"autonomous_system_organization": "Example",
+		},
+		"10.0.1.0/24": map[string]any{
+			"city":     map[string]any{"names": map[string]string{"de": "Köln", "en": "Cologne"}},
+			"location": map[string]any{"latitude": 50.9375, "longitude": 6.9603, "accuracy_radius": uint16(20)},
+			"traits":   map[string]any{"autonomous_system_number": uint32(64502), "isp": "Example"},
+		},
+	}
+	for cidr, record := range records {
+		if err := w.Insert(netip.MustParsePrefix(cidr), record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	if _, err := w.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	reader, err := maxminddb.FromBytes(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := &mmdbDB{
+		reader:  reader,
+		records: recordCache{records: make(map[uintptr]geoResult)},
+		names:   nameTable{names: make(map[string]map[string]string)},
+		details: detailCache{details: make(map[uintptr]geoDetails)},
+	}
+
+	tests := []struct {
+		ip       string
+		expected geoDetails
+	}{
+		{"10.0.0.1", geoDetails{ASN: 64501}},
+		{"10.0.1.1", geoDetails{City: "Cologne", Latitude: 50.9375, Longitude: 6.9603, HasLocation: true, ASN: 64502}},
+		{"10.0.2.1", geoDetails{}},
+	}
+	for _, tt := range tests {
+		details, err := db.lookupDetails(net.ParseIP(tt.ip))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if details != tt.expected {
+			t.Errorf("%s: expected %+v, got %+v", tt.ip, tt.expected, details)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package traefik_plugin_state_geo
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Formats of a block response.
+const (
+	formatHTML = "html"
+	formatJSON = "json"
+	formatText = "text"
+)
+
+// offeredTypes are the media types a block response can be rendered as, in
+// order of preference when the client rates them equally.
+var offeredTypes = []struct {
+	mediaType string
+	format    string
+}{
+	{"text/html", formatHTML},
+	{"application/problem+json", formatJSON},
+	{"application/json", formatJSON},
+	{"text/plain", formatText},
+}
+
+// negotiateFormat picks the block response format for an Accept header.
+// Requests without one get HTML, as browsers always send one and other
+// clients got HTML before negotiation existed. Requests that accept none of
+// the offered types get plain text.
+func negotiateFormat(accept string) string {
+	if strings.TrimSpace(accept) == "" {
+		return formatHTML
+	}
+
+	best, bestQ, bestSpecificity := formatText, 0.0, -1
+	for _, offer := range offeredTypes {
+		q, specificity := acceptQuality(accept, offer.mediaType)
+		if q > bestQ || (q == bestQ && q > 0 && specificity > bestSpecificity) {
+			best, bestQ, bestSpecificity = offer.format, q, specificity
+		}
+	}
+	return best
+}
+
+// acceptQuality returns the q-value accept assigns to mediaType and how
+// specific the matching range was: 2 for type/subtype, 1 for type/* and 0
+// for */*. The most specific range wins, as in RFC 9110.
+func acceptQuality(accept, mediaType string) (float64, int) {
+	slash := strings.IndexByte(mediaType, '/')
+	q, specificity := 0.0, -1
+
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		mediaRange := strings.ToLower(strings.TrimSpace(params[0]))
+
+		s := -1
+		switch {
+		case mediaRange == mediaType:
+			s = 2
+		case mediaRange == mediaType[:slash]+"/*":
+			s = 1
+		case mediaRange == "*/*":
+			s = 0
+		}
+		if s <= specificity {
+			continue
+		}
+
+		q, specificity = qValue(params[1:]), s
+	}
+	return q, specificity
+}
+
+// qValue returns the q parameter among the parameters of an Accept or
+// Accept-Language element, 1 when there is none.
+func qValue(params []string) float64 {
+	for _, param := range params {
+		name, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+		if ok && strings.EqualFold(strings.TrimSpace(name), "q") {
+			if v, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+				return v
+			}
+		}
+	}
+	return 1
+}
@@ -0,0 +1,31 @@
+package traefik_plugin_state_geo
+
+import "testing"
+
+func TestNegotiateFormat(t *testing.T) {
+	tests := []struct {
+		accept   string
+		expected string
+	}{
+		{"", formatHTML},
+		{"*/*", formatHTML},
+		{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", formatHTML},
+		{"application/json", formatJSON},
+		{"application/problem+json", formatJSON},
+		{"application/json, text/plain;q=0.5", formatJSON},
+		{"text/plain", formatText},
+		{"text/*", formatHTML},
+		{"text/html;q=0.1, text/plain", formatText},
+		{"text/html;q=0, */*", formatJSON},
+		{"application/*;q=0.5, text/plain;q=0.4", formatJSON},
+		{"image/png", formatText},
+		{"TEXT/PLAIN", formatText},
+		{"application/json;q=0", formatText},
+	}
+
+	for _, tt := range tests {
+		if got := negotiateFormat(tt.accept); got != tt.expected {
+			t.Errorf("%q: expected %s, got %s", tt.accept, tt.expected, got)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package traefik_plugin_state_geo
+
+import "net/netip"
+
+const noValue = -1
+
+// ipv4Mapped is where IPv4 addresses live in the tree.
+var ipv4Mapped = netip.MustParsePrefix("::ffff:0:0/96")
+
+type prefixNode struct {
+	children [2]int32
+	value    int32
+}
+
+// prefixTree is a binary radix tree over 128-bit addresses. IPv4 prefixes are
+// stored in the IPv4-mapped part of the IPv6 space, so one tree holds both
+// families. Values are indices into a slice owned by the caller which keeps
+// the tree itself free of pointers.
+//
+// IPv4 lookups start at the node of ::ffff:0:0/96 instead of walking the 96
+// bits above it, with the value inherited from the prefixes covering it.
+type prefixTree struct {
+	nodes []prefixNode
+
+	v4Root      int32 // node of ::ffff:0:0/96, 0 until it exists
+	v4Inherited int32 // value of the longest prefix above v4Root
+	v4Bits      int   // length of that prefix, -1 if there is none
+}
+
+func newPrefixTree() *prefixTree {
+	return &prefixTree{nodes: []prefixNode{{value: noValue}}, v4Inherited: noValue, v4Bits: -1}
+}
+
+// insert stores value for prefix, replacing any value stored for exactly the
+// same prefix. More specific prefixes keep their own values.
+func (t *prefixTree) insert(prefix netip.Prefix, value int32) {
+	addr, bits := mappedPrefix(prefix)
+	key := addr.As16()
+
+	onV4Path := netip.PrefixFrom(addr, bits).Overlaps(ipv4Mapped)
+
+	node := int32(0)
+	for i := 0; i < bits; i++ {
+		bit := bitAt(&key, i)
+		next := t.nodes[node].children[bit]
+		if next == 0 {
+			next = int32(len(t.nodes))
+			t.nodes = append(t.nodes, prefixNode{value: noValue})
+			t.nodes[node].children[bit] = next
+		}
+		node = next
+		if i+1 == 96 && onV4Path {
+			t.v4Root = node
+		}
+	}
+	if onV4Path && bits < 96 && bits >= t.v4Bits {
+		t.v4Inherited, t.v4Bits = value, bits
+	}
+	t.nodes[node].value = value
+}
+
+// lookup returns the value of the longest prefix containing addr. The
+// returned network is the largest prefix around addr that no other entry in
+// the tree overlaps, so every address in it resolves to the same value.
+func (t *prefixTree) lookup(addr netip.Addr) (int32, netip.Prefix, bool) {
+	is4 := addr.Is4() || addr.Is4In6()
+	addr = mappedAddr(addr)
+	key := addr.As16()
+
+	value := int32(noValue)
+	node := int32(0)
+	depth := 0
+	if is4 && t.v4Root != 0 {
+		value, node, depth = t.v4Inherited, t.v4Root, 96
+	}
+	for {
+		if v := t.nodes[node].value; v != noValue {
+			value = v
+		}
+		if depth == 128 {
+			break
+		}
+		bit := bitAt(&key, depth)
+		next := t.nodes[node].children[bit]
+		if next == 0 {
+			// The sibling subtree holds other entries, so only our half of
+			// this node is uniform.
+			if t.nodes[node].children[1-bit] != 0 {
+				depth++
+			}
+			break
+		}
+		node = next
+		depth++
+	}
+
+	if is4 && depth < 96 {
+		depth = 96
+	}
+	network, _ := addr.Prefix(depth)
+	return value, unmapPrefix(network), value != noValue
+}
+
+// walk calls fn for every prefix that carries a value, parents first.
+func (t *prefixTree) walk(fn func(prefix netip.Prefix, value int32)) {
+	var key [16]byte
+	t.walkNode(0, &key, 0, fn)
+}
+
+func (t *prefixTree) walkNode(node int32, key *[16]byte, depth int, fn func(netip.Prefix, int32)) {
+	if v := t.nodes[node].value; v != noValue {
+		fn(unmapPrefix(netip.PrefixFrom(netip.AddrFrom16(*key), depth)), v)
+	}
+	for bit := 0; bit < 2; bit++ {
+		child := t.nodes[node].children[bit]
+		if child == 0 {
+			continue
+		}
+		if bit == 1 {
+			key[depth/8] |= 0x80 >> (depth % 8)
+		}
+		t.walkNode(child, key, depth+1, fn)
+		key[depth/8] &^= 0x80 >> (depth % 8)
+	}
+}
+
+// leaves partitions the address space along the tree and calls fn for every
+// part in ascending order with the value of its longest containing prefix,
+// noValue for parts no prefix covers.
+func (t *prefixTree) leaves(fn func(prefix netip.Prefix, value int32)) {
+	var key [16]byte
+	t.leavesNode(0, &key, 0, noValue, fn)
+}
+
+func (t *prefixTree) leavesNode(node int32, key *[16]byte, depth int, value int32, fn func(netip.Prefix, int32)) {
+	if v := t.nodes[node].value; v != noValue {
+		value = v
+	}
+	children := t.nodes[node].children
+	if depth == 128 || (children[0] == 0 && children[1] == 0) {
+		fn(unmapPrefix(netip.PrefixFrom(netip.AddrFrom16(*key), depth)), value)
+		return
+	}
+	for bit := 0; bit < 2; bit++ {
+		if bit == 1 {
+			key[depth/8] |= 0x80 >> (depth % 8)
+		}
+		if children[bit] == 0 {
+			fn(unmapPrefix(netip.PrefixFrom(netip.AddrFrom16(*key), depth+1)), value)
+		} else {
+			t.leavesNode(children[bit], key, depth+1, value, fn)
+		}
+		key[depth/8] &^= 0x80 >> (depth % 8)
+	}
+}
+
+func (t *prefixTree) len() int {
+	return len(t.nodes)
+}
+
+func bitAt(key *[16]byte, i int) int {
+	return int(key[i/8]>>(7-i%8)) & 1
+}
+
+func mappedAddr(addr netip.Addr) netip.Addr {
+	if addr.Is4() {
+		return netip.AddrFrom16(addr.As16())
+	}
+	return addr
+}
+
+func mappedPrefix(prefix netip.Prefix) (netip.Addr, int) {
+	prefix = prefix.Masked()
+	if prefix.Addr().Is4() {
+		return netip.AddrFrom16(prefix.Addr().As16()), prefix.Bits() + 96
+	}
+	return prefix.Addr(), prefix.Bits()
+}
+
+// unmapPrefix turns prefixes inside ::ffff:0:0/96 back into IPv4 prefixes.
+func unmapPrefix(prefix netip.Prefix) netip.Prefix {
+	if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+		return netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+	}
+	return prefix
+}
@@ -0,0 +1,87 @@
+package traefik_plugin_state_geo
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestPrefixTreeLongestMatch(t *testing.T) {
+	tree := newPrefixTree()
+	tree.insert(netip.MustParsePrefix("10.0.0.0/8"), 1)
+	tree.insert(netip.MustParsePrefix("10.1.0.0/16"), 2)
+	tree.insert(netip.MustParsePrefix("10.1.2.0/28"), 3)
+	tree.insert(netip.MustParsePrefix("2001:db8::/32"), 4)
+
+	tests := []struct {
+		addr    string
+		value   int32
+		network string
+		found   bool
+	}{
+		{"10.200.0.1", 1, "10.128.0.0/9", true},
+		{"10.1.200.1", 2, "10.1.128.0/17", true},
+		{"10.1.2.5", 3, "10.1.2.0/28", true},
+		{"10.1.2.20", 2, "10.1.2.16/28", true},
+		{"11.0.0.1", noValue, "11.0.0.0/8", false},
+		{"2001:db8::1", 4, "2001:db8::/32", true},
+		{"2001:db9::1", noValue, "2001:db9::/32", false},
+		{"::ffff:10.1.2.5", 3, "10.1.2.0/28", true},
+	}
+
+	for _, tt := range tests {
+		value, network, found := tree.lookup(netip.MustParseAddr(tt.addr))
+		if value != tt.value || found != tt.found || network.String() != tt.network {
+			t.Errorf("%s: expected (%d, %s, %v), got (%d, %s, %v)",
+				tt.addr, tt.value, tt.network, tt.found, value, network, found)
+		}
+	}
+}
+
+func TestPrefixTreeIPv4InheritsCoveringIPv6Prefixes(t *testing.T) {
+	tree := newPrefixTree()
+	tree.insert(netip.MustParsePrefix("::/0"), 1)
+
+	// No IPv4 prefix yet, the lookup walks down from the root.
+	if value, _, _ := tree.lookup(netip.MustParseAddr("1.2.3.4")); value != 1 {
+		t.Errorf("expected ::/0 to cover IPv4 before any IPv4 insert, got %d", value)
+	}
+
+	tree.insert(netip.MustParsePrefix("10.0.0.0/8"), 2)
+	tree.insert(netip.MustParsePrefix("::/8"), 3)
+	tree.insert(netip.MustParsePrefix("2001:db8::/32"), 4)
+
+	tests := []struct {
+		addr  string
+		value int32
+	}{
+		{"10.1.1.1", 2},
+		{"11.0.0.1", 3},
+		{"2001:db8::1", 4},
+		{"2002::1", 1},
+	}
+	for _, tt := range tests {
+		if value, _, _ := tree.lookup(netip.MustParseAddr(tt.addr)); value != tt.value {
+			t.Errorf("%s: expected %d, got %d", tt.addr, tt.value, value)
+		}
+	}
+}
+
+func TestPrefixTreeWalk(t *testing.T) {
+	tree := newPrefixTree()
+	prefixes := []string{"10.0.0.0/8", "10.1.0.0/16", "2001:db8::/32"}
+	for i, p := range prefixes {
+		tree.insert(netip.MustParsePrefix(p), int32(i))
+	}
+
+	var seen []string
+	tree.walk(func(prefix netip.Prefix, value int32) {
+		if prefixes[value] != prefix.String() {
+			t.Errorf("value %d walked as %s", value, prefix)
+		}
+		seen = append(seen, prefix.String())
+	})
+
+	if len(seen) != len(prefixes) {
+		t.Errorf("expected %d prefixes, walked %v", len(prefixes), seen)
+	}
+}
@@ -0,0 +1,5 @@
+//go:build race
+
+package traefik_plugin_state_geo
+
+const raceEnabled = true
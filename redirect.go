@@ -0,0 +1,204 @@
+package traefik_plugin_state_geo
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	texttemplate "text/template"
+)
+
+const (
+	actionBlock    = "block"
+	actionRedirect = "redirect"
+)
+
+var redirectTemplateFuncs = texttemplate.FuncMap{
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+}
+
+// redirector sends blocked visitors to a landing page instead of serving the
+// block response. Targets are text/template URLs rendered with the BlockPage
+// of the request, chosen by jurisdiction: the ISO 3166-2 code of the state
+// (US-NY), then the country code, then the default.
+type redirector struct {
+	status   int
+	targets  map[string]*redirectTarget
+	fallback *redirectTarget
+}
+
+// redirectTarget is a parsed target template. followsRequest is set when
+// the path of the target changes with the request path or ID: such a landing
+// page never matches the request that reached it, so on the protected site
+// it would redirect again forever.
+type redirectTarget struct {
+	tmpl           *texttemplate.Template
+	followsRequest bool
+}
+
+// newRedirectTarget parses target. Landing pages on the protected site
+// itself, i.e. absolute paths, must not follow the request.
+func newRedirectTarget(name, target string) (*redirectTarget, error) {
+	tmpl, err := texttemplate.New(name).Funcs(redirectTemplateFuncs).Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	t := &redirectTarget{tmpl: tmpl}
+
+	_, first, errFirst := renderRedirect(tmpl, BlockPage{Path: "/p", RequestID: "0"})
+	_, second, errSecond := renderRedirect(tmpl, BlockPage{Path: "/q", RequestID: "1"})
+	if errFirst != nil || errSecond != nil {
+		// Unusable targets are reported when they are rendered.
+		return t, nil
+	}
+	t.followsRequest = first.Path != second.Path
+	if t.followsRequest && first.Host == "" && second.Host == "" {
+		return nil, fmt.Errorf("the path of a landing page on this site cannot follow .Path or .RequestID")
+	}
+	return t, nil
+}
+
+func newRedirector(config *Config) (*redirector, error) {
+	switch config.Action {
+	case "", actionBlock:
+		return nil, nil
+	case actionRedirect:
+	default:
+		return nil, fmt.Errorf("invalid action %q", config.Action)
+	}
+
+	r := &redirector{status: config.RedirectStatus, targets: make(map[string]*redirectTarget)}
+	switch r.status {
+	case 0:
+		r.status = http.StatusFound
+	case http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect:
+	default:
+		return nil, fmt.Errorf("invalid redirectStatus %d", config.RedirectStatus)
+	}
+
+	if config.RedirectURL != "" {
+		t, err := newRedirectTarget("redirectURL", config.RedirectURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redirectURL: %w", err)
+		}
+		r.fallback = t
+	}
+	for jurisdiction, target := range config.RedirectURLs {
+		t, err := newRedirectTarget(jurisdiction, target)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redirectURLs entry %q: %w", jurisdiction, err)
+		}
+		r.targets[strings.ToUpper(jurisdiction)] = t
+	}
+	if r.fallback == nil && len(r.targets) == 0 {
+		return nil, fmt.Errorf("action %q needs redirectURL or redirectURLs", actionRedirect)
+	}
+	return r, nil
+}
+
+// target renders the redirect URL for page. It reports false when no target
+// applies or the rendered URL is unusable, so the block response is served.
+//
+// Values taken from the request, like the path, must not move the target to
+// another scheme or host: /{{.Path}} for //evil.example would otherwise
+// redirect off the site. The template is rendered again with those values
+// neutralised and both results must agree. Targets that follow the request
+// are refused on the host of the request, where they would loop.
+func (r *redirector) target(page BlockPage) (string, bool, error) {
+	t := r.fallback
+	for _, jurisdiction := range jurisdictions(page) {
+		if candidate, ok := r.targets[jurisdiction]; ok {
+			t = candidate
+			break
+		}
+	}
+	if t == nil {
+		return "", false, nil
+	}
+
+	target, u, err := renderRedirect(t.tmpl, page)
+	if err != nil {
+		return "", false, err
+	}
+	if (u.Scheme != "" && u.Scheme != "http" && u.Scheme != "https") ||
+		(u.Host == "" && !strings.HasPrefix(u.Path, "/")) {
+		return "", false, fmt.Errorf("redirect target %q is neither an http(s) URL nor an absolute path", target)
+	}
+	// Browsers read a leading /\ like //.
+	if u.Host == "" && strings.HasPrefix(target, "/\\") {
+		return "", false, fmt.Errorf("redirect target %q is not an absolute path", target)
+	}
+
+	probe := page
+	probe.Path, probe.ClientIP, probe.RequestID = "/p", "0.0.0.0", "0"
+	_, expected, err := renderRedirect(t.tmpl, probe)
+	if err != nil {
+		return "", false, err
+	}
+	if !strings.EqualFold(u.Scheme, expected.Scheme) || !strings.EqualFold(u.Host, expected.Host) {
+		return "", false, fmt.Errorf("redirect target %q leaves the configured origin", target)
+	}
+	if t.followsRequest && strings.EqualFold(u.Host, page.Host) {
+		return "", false, fmt.Errorf("redirect target %q follows the request on the same host and would loop", target)
+	}
+	return target, true, nil
+}
+
+func renderRedirect(tmpl *texttemplate.Template, page BlockPage) (string, *url.URL, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, page); err != nil {
+		return "", nil, err
+	}
+	target := strings.TrimSpace(buf.String())
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", nil, err
+	}
+	return target, u, nil
+}
+
+// isLandingPage reports whether req already asks for target on this host.
+// The landing page is usually served by the protected router itself, so
+// redirecting there again would loop.
+func isLandingPage(req *http.Request, target string) bool {
+	u, err := url.Parse(target)
+	if err != nil {
+		return false
+	}
+	if u.Host != "" && !strings.EqualFold(u.Host, req.Host) {
+		return false
+	}
+	return u.Path == req.URL.Path
+}
+
+// serveRedirect redirects the visitor blocked by entry, or lets them through
+// to their landing page. It reports false when the block response should be
+// served instead.
+func (a *StateBlock) serveRedirect(rw http.ResponseWriter, req *http.Request, entry cacheEntry) bool {
+	// Denied IPs and a missing database always get the block response.
+	if a.redirect == nil || !locationReason(entry.reason) {
+		return false
+	}
+
+	target, ok, err := a.redirect.target(a.blockPage(req, entry))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[%s] ERROR: failed to build redirect target, serving the block response: %v\n",
+			a.name, err)
+	}
+	if !ok {
+		return false
+	}
+
+	if isLandingPage(req, target) {
+		a.forward(rw, req, clientAddr(req), entry, entry.reason)
+		return true
+	}
+	if a.debug {
+		fmt.Printf("[%s] DEBUG: Redirecting request from state: %s to %s\n", a.name, entry.location(), target)
+	}
+	http.Redirect(rw, req, target, a.redirect.status)
+	return true
+}
@@ -0,0 +1,203 @@
+package traefik_plugin_state_geo
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/vikewoods/traefik-plugin-state-geo/internal/geoiptest"
+)
+
+func TestRedirectAction(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.BlockedStates = []string{"CA", "WA"}
+	cfg.DBPath = geoiptest.WriteCityDB(t)
+	cfg.Action = actionRedirect
+	cfg.RedirectURL = "/unavailable/{{.Location | lower}}?from={{.Path | urlquery}}"
+	cfg.RedirectURLs = map[string]string{
+		"us-wa": "https://partner.example.com/wa",
+		"GB":    "https://example.co.uk{{.Path}}",
+	}
+	cfg.RedirectStatus = http.StatusSeeOther
+	cfg.DeniedIPs = []string{"198.51.100.0/24"}
+	handler := newTestHandler(t, cfg, nil)
+
+	tests := []struct {
+		ip           string
+		path         string
+		expectedCode int
+		location     string
+	}{
+		{geoiptest.IPCalifornia, "/shop?id=1", http.StatusSeeOther, "/unavailable/ca?from=%2Fshop"},
+		{geoiptest.IPWashington, "/", http.StatusSeeOther, "https://partner.example.com/wa"},
+		{geoiptest.IPUnitedKingdom, "/shop", http.StatusSeeOther, "https://example.co.uk/shop"},
+		{geoiptest.IPUSNoSubdivision, "/", http.StatusSeeOther, "/unavailable/unknown?from=%2F"},
+		{geoiptest.IPNewYork, "/", http.StatusOK, ""},
+		// The landing page is served by the protected router itself.
+		{geoiptest.IPCalifornia, "/unavailable/ca", http.StatusOK, ""},
+		// Denied IPs get the block response.
+		{geoiptest.IPNoLocation, "/", http.StatusForbidden, ""},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com"+tt.path, nil)
+		req.RemoteAddr = net.JoinHostPort(tt.ip, "1234")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+
+		if recorder.Code != tt.expectedCode {
+			t.Errorf("%s %s: expected status %d, got %d", tt.ip, tt.path, tt.expectedCode, recorder.Code)
+		}
+		if got := recorder.Header().Get("Location"); got != tt.location {
+			t.Errorf("%s %s: expected Location %q, got %q", tt.ip, tt.path, tt.location, got)
+		}
+	}
+}
+
+func TestRedirectFallsBackToBlockResponse(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.BlockedStates = []string{"CA", "WA"}
+	cfg.DBPath = geoiptest.WriteCityDB(t)
+	cfg.Action = actionRedirect
+	// Only Washington has a landing page, and it renders to an unusable URL.
+	cfg.RedirectURLs = map[string]string{
+		"US-WA": "javascript:alert(1)",
+		"US-TX": "/tx",
+	}
+	handler := newTestHandler(t, cfg, nil)
+
+	for _, ip := range []string{geoiptest.IPCalifornia, geoiptest.IPWashington} {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.RemoteAddr = net.JoinHostPort(ip, "1234")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+
+		if recorder.Code != http.StatusForbidden {
+			t.Errorf("%s: expected the block response, got %d", ip, recorder.Code)
+		}
+	}
+}
+
+func TestRedirectKeepsOrigin(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.BlockedStates = []string{"CA", "TX", "WA"}
+	cfg.DBPath = geoiptest.WriteCityDB(t)
+	cfg.Action = actionRedirect
+	cfg.RedirectURL = "https:/{{.Path}}"
+	cfg.RedirectURLs = map[string]string{
+		"GB":    "https://example.co.uk{{.Path}}",
+		"US-TX": "/\\evil.example",
+		"US-WA": "/unavailable?id={{.RequestID}}",
+	}
+	handler := newTestHandler(t, cfg, nil)
+
+	tests := []struct {
+		ip        string
+		path      string
+		requestID string
+		location  string // empty for the block response
+	}{
+		{geoiptest.IPCalifornia, "/evil.example/x", "", ""},
+		{geoiptest.IPTexas, "/", "", ""},
+		{geoiptest.IPUnitedKingdom, "//evil.example", "", "https://example.co.uk//evil.example"},
+		{geoiptest.IPWashington, "/", "abc", "/unavailable?id=abc"},
+		{geoiptest.IPWashington, "/", "x/../http://evil.example", "/unavailable?id=x/../http://evil.example"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.URL.Path = tt.path
+		req.RemoteAddr = net.JoinHostPort(tt.ip, "1234")
+		if tt.requestID != "" {
+			req.Header.Set("X-Request-Id", tt.requestID)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+
+		if got := recorder.Header().Get("Location"); got != tt.location {
+			t.Errorf("%s %q: expected Location %q, got %q", tt.ip, tt.path, tt.location, got)
+		}
+		if tt.location == "" && recorder.Code != http.StatusForbidden {
+			t.Errorf("%s %q: expected the block response, got %d", tt.ip, tt.path, recorder.Code)
+		}
+	}
+}
+
+// Following the redirects must end on the landing page, or on the block
+// response for targets that would loop.
+func TestRedirectDoesNotLoop(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.BlockedStates = []string{"CA", "WA"}
+	cfg.DBPath = geoiptest.WriteCityDB(t)
+	cfg.Action = actionRedirect
+	cfg.RedirectURL = "/unavailable/{{.Location | lower}}?from={{.Path | urlquery}}"
+	cfg.RedirectURLs = map[string]string{
+		"US-WA": "http://example.com/unavailable{{.Path}}",
+		"GB":    "https://example.co.uk/uk{{.Path}}",
+	}
+	handler := newTestHandler(t, cfg, nil)
+
+	tests := []struct {
+		ip           string
+		hops         int
+		expectedCode int
+	}{
+		{geoiptest.IPCalifornia, 1, http.StatusOK},
+		{geoiptest.IPWashington, 0, http.StatusForbidden},
+		// Another host, which the middleware does not protect.
+		{geoiptest.IPUnitedKingdom, 0, http.StatusFound},
+	}
+
+	for _, tt := range tests {
+		target := "http://example.com/shop"
+		hops := 0
+		for {
+			req := httptest.NewRequest(http.MethodGet, target, nil)
+			req.RemoteAddr = net.JoinHostPort(tt.ip, "1234")
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+
+			location := recorder.Header().Get("Location")
+			next, err := req.URL.Parse(location)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if location == "" || next.Host != "example.com" {
+				if recorder.Code != tt.expectedCode {
+					t.Errorf("%s: expected status %d, got %d", tt.ip, tt.expectedCode, recorder.Code)
+				}
+				break
+			}
+			if hops++; hops > 5 {
+				t.Fatalf("%s: redirect loop through %s", tt.ip, location)
+			}
+			target = next.String()
+		}
+		if hops != tt.hops {
+			t.Errorf("%s: expected %d redirects on the site, got %d", tt.ip, tt.hops, hops)
+		}
+	}
+}
+
+func TestRedirectConfig(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	invalid := []*Config{
+		{Action: "teleport"},
+		{Action: actionRedirect},
+		{Action: actionRedirect, RedirectURL: "/x", RedirectStatus: http.StatusMovedPermanently},
+		{Action: actionRedirect, RedirectURL: "/{{.State"},
+		{Action: actionRedirect, RedirectURLs: map[string]string{"US-NY": "/{{end}}"}},
+		{Action: actionRedirect, RedirectURL: "/blocked{{.Path}}"},
+		{Action: actionRedirect, RedirectURLs: map[string]string{"US-NY": "{{.Path}}/unavailable"}},
+		{Action: actionRedirect, RedirectURL: "/unavailable/{{.RequestID}}"},
+	}
+	for _, cfg := range invalid {
+		cfg.DBPath = geoiptest.WriteCityDB(t)
+		if _, err := New(context.Background(), next, cfg, "redirect-config-test"); err == nil {
+			t.Errorf("expected %+v to be rejected", cfg)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package traefik_plugin_state_geo
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// dbHandle is one open database. Lookups hold a reference while they use it,
+// so a database that is swapped out or released is closed only once the
+// lookups running on it have finished.
+type dbHandle struct {
+	// The sharedDB holds one reference while the handle is current.
+	refs int64 // accessed atomically
+	db   geoDB
+}
+
+func newDBHandle(db geoDB) *dbHandle {
+	return &dbHandle{refs: 1, db: db}
+}
+
+// release drops a reference and closes the database with the last one.
+func (h *dbHandle) release() {
+	if atomic.AddInt64(&h.refs, -1) == 0 {
+		_ = h.db.Close()
+	}
+}
+
+// sharedDB is one open database shared by every middleware instance that
+// points at the same file with the same format. It owns the optional reload
+// watcher and is closed when the last instance releases it.
+type sharedDB struct {
+	key    string
+	format string
+	path   string
+	name   string
+	info   os.FileInfo
+
+	mu      sync.RWMutex
+	current *dbHandle
+	version string
+
+	// Guarded by registryMutex.
+	users      map[*StateBlock]struct{}
+	stopWatch  context.CancelFunc
+	watchEvery time.Duration
+}
+
+var (
+	registryMutex sync.Mutex
+	registry      = make(map[string][]*sharedDB)
+)
+
+// registryKey resolves path so that different spellings of the same file,
+// including symlinks, share one entry.
+func registryKey(format, path string) string {
+	resolved, err := filepath.Abs(path)
+	if err == nil {
+		if real, err := filepath.EvalSymlinks(resolved); err == nil {
+			resolved = real
+		}
+	} else {
+		resolved = path
+	}
+	if format == "" || format == "auto" {
+		format = detectFormat(path)
+	}
+	return strings.ToLower(format) + ":" + resolved
+}
+
+// acquireDB returns the shared database for format and path, opening it if
+// no other instance uses the same file. Entries are matched by resolved path
+// and file identity, so a file replaced on disk gets an entry of its own.
+// A reload watcher is started once for the entry when reloadInterval is set.
+//
+// Databases are opened without holding registryMutex, so a slow load does
+// not hold up instances on other files. When two instances open the same
+// file at once, the copy registered first is used and the other closed.
+func acquireDB(format, path string, reloadInterval time.Duration, owner *StateBlock) (*sharedDB, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	key := registryKey(format, path)
+
+	// The entry is joined under the same lock it is found with: the last
+	// release unregisters it under that lock before closing the database.
+	registryMutex.Lock()
+	if shared := findSharedDB(key, info); shared != nil {
+		shared.addUser(owner, path, reloadInterval)
+		registryMutex.Unlock()
+		return shared, nil
+	}
+	registryMutex.Unlock()
+
+	stamp, err := statDB(path)
+	if err != nil {
+		return nil, err
+	}
+	db, err := openGeoDB(format, path)
+	if err != nil {
+		return nil, err
+	}
+	shared := &sharedDB{
+		key:     key,
+		format:  format,
+		path:    path,
+		name:    owner.name,
+		info:    info,
+		current: newDBHandle(db),
+		version: dbVersion(db, stamp),
+		users:   make(map[*StateBlock]struct{}),
+	}
+
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	if registered := findSharedDB(key, info); registered != nil {
+		_ = db.Close()
+		shared = registered
+	} else {
+		registry[key] = append(registry[key], shared)
+	}
+	shared.addUser(owner, path, reloadInterval)
+	return shared, nil
+}
+
+// addUser registers owner and starts the reload watcher if owner asks for
+// one, or for a shorter interval than the running one. The caller holds
+// registryMutex.
+func (s *sharedDB) addUser(owner *StateBlock, path string, reloadInterval time.Duration) {
+	s.users[owner] = struct{}{}
+
+	if reloadInterval > 0 && (s.stopWatch == nil || reloadInterval < s.watchEvery) {
+		if s.stopWatch != nil {
+			s.stopWatch()
+		}
+		stamp, err := statDB(path)
+		if err != nil {
+			stamp = dbStamp{}
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		s.stopWatch = cancel
+		s.watchEvery = reloadInterval
+		go s.watch(ctx, reloadInterval, stamp)
+	}
+}
+
+// findSharedDB returns the registered entry for the file, or nil. The caller
+// holds registryMutex.
+func findSharedDB(key string, info os.FileInfo) *sharedDB {
+	for _, candidate := range registry[key] {
+		if os.SameFile(candidate.info, info) {
+			return candidate
+		}
+	}
+	return nil
+}
+
+// release drops owner's reference. The last release stops the watcher and
+// closes the database once the lookups running on it have finished.
+func (s *sharedDB) release(owner *StateBlock) {
+	registryMutex.Lock()
+	if _, ok := s.users[owner]; !ok {
+		registryMutex.Unlock()
+		return
+	}
+	delete(s.users, owner)
+	if len(s.users) > 0 {
+		registryMutex.Unlock()
+		return
+	}
+
+	entries := registry[s.key]
+	for i, candidate := range entries {
+		if candidate == s {
+			entries = append(entries[:i], entries[i+1:]...)
+			break
+		}
+	}
+	if len(entries) == 0 {
+		delete(registry, s.key)
+	} else {
+		registry[s.key] = entries
+	}
+	if s.stopWatch != nil {
+		s.stopWatch()
+		s.stopWatch = nil
+	}
+	registryMutex.Unlock()
+
+	s.mu.Lock()
+	current := s.current
+	s.current = nil
+	s.mu.Unlock()
+	if current != nil {
+		current.release()
+	}
+}
+
+// acquire returns the current database with a reference the caller releases
+// when done with it, or nil once the entry has been released.
+func (s *sharedDB) acquire() *dbHandle {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	h := s.current
+	if h != nil {
+		atomic.AddInt64(&h.refs, 1)
+	}
+	return h
+}
+
+// currentVersion identifies the database currently in use, see dbVersion.
+func (s *sharedDB) currentVersion() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.version
+}
+
+// swap activates db, tells every user to drop decisions made with the old
+// database and closes it once the lookups running on it have finished.
+func (s *sharedDB) swap(db geoDB, info os.FileInfo, stamp dbStamp) {
+	h := newDBHandle(db)
+	// Held while users recompile from db, which the last release may
+	// close meanwhile.
+	h.refs++
+
+	s.mu.Lock()
+	old := s.current
+	if old == nil {
+		// Released while db was loading.
+		s.mu.Unlock()
+		_ = db.Close()
+		return
+	}
+	s.current = h
+	s.version = dbVersion(db, stamp)
+	s.mu.Unlock()
+
+	registryMutex.Lock()
+	if info != nil {
+		s.info = info
+	}
+	users := make([]*StateBlock, 0, len(s.users))
+	for user := range s.users {
+		users = append(users, user)
+	}
+	registryMutex.Unlock()
+
+	for _, user := range users {
+		user.dbSwapped(db)
+	}
+	h.release()
+
+	if old != nil {
+		old.release()
+	}
+}
+
+// dbVersion identifies one build of a database: the build epoch for MaxMind
+// databases, modification time and size for formats without one.
+func dbVersion(db geoDB, stamp dbStamp) string {
+	if m, ok := db.(*mmdbDB); ok {
+		return fmt.Sprintf("epoch:%d", m.reader.Metadata.BuildEpoch)
+	}
+	return fmt.Sprintf("stamp:%d:%d", stamp.modTime.UnixNano(), stamp.size)
+}
+
+// sharedDBCount reports how many databases are currently open.
+func sharedDBCount() int {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	count := 0
+	for _, entries := range registry {
+		count += len(entries)
+	}
+	return count
+}
@@ -0,0 +1,332 @@
+package traefik_plugin_state_geo
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vikewoods/traefik-plugin-state-geo/internal/geoiptest"
+)
+
+// released reports whether the last user released s.
+func released(s *sharedDB) bool {
+	h := s.acquire()
+	if h == nil {
+		return true
+	}
+	h.release()
+	return false
+}
+
+func TestRegistrySharesDatabase(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DBPath = geoiptest.WriteCityDB(t)
+	before := sharedDBCount()
+
+	first := newTestHandler(t, cfg, nil)
+	second := newTestHandler(t, cfg, nil)
+
+	link := filepath.Join(t.TempDir(), "city.mmdb")
+	if err := os.Symlink(cfg.DBPath, link); err != nil {
+		t.Fatal(err)
+	}
+	cfg.DBPath = link
+	third := newTestHandler(t, cfg, nil)
+
+	if first.db != second.db || first.db != third.db {
+		t.Fatal("expected instances on the same file to share one database")
+	}
+	if got := sharedDBCount() - before; got != 1 {
+		t.Fatalf("expected 1 open database, got %d", got)
+	}
+
+	_ = first.Close()
+	_ = second.Close()
+	if released(third.db) {
+		t.Fatal("database was closed while still in use")
+	}
+
+	_ = third.Close()
+	if !released(third.db) {
+		t.Fatal("expected database to be closed after the last user")
+	}
+	if got := sharedDBCount() - before; got != 0 {
+		t.Fatalf("expected no open databases, got %d", got)
+	}
+}
+
+func TestRegistryReplacedFile(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DBPath = geoiptest.WriteCityDB(t)
+	first := newTestHandler(t, cfg, nil)
+
+	// Replace the file the way database updaters do: write and rename.
+	dbPath := cfg.DBPath
+	data, err := os.ReadFile(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp := dbPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, dbPath); err != nil {
+		t.Fatal(err)
+	}
+
+	second := newTestHandler(t, cfg, nil)
+
+	if first.db == second.db {
+		t.Fatal("expected a replaced file to get its own database")
+	}
+}
+
+func TestClosedInstanceFailsLookup(t *testing.T) {
+	// Traefik may still route requests to an instance it has closed, so
+	// they are answered like requests without a database.
+	tests := []struct {
+		mode         string
+		expectedCode int
+	}{
+		{"", http.StatusForbidden},
+		{degradedFailOpen, http.StatusOK},
+		{degradedMaintenance, http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		cfg := CreateConfig()
+		cfg.DBPath = geoiptest.WriteCityDB(t)
+		cfg.DegradedMode = tt.mode
+		block := newTestHandler(t, cfg, nil)
+		_ = block.Close()
+		_ = block.Close()
+
+		req, _ := http.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = geoiptest.IPNewYork + ":1234"
+		recorder := httptest.NewRecorder()
+		block.ServeHTTP(recorder, req)
+
+		if recorder.Code != tt.expectedCode {
+			t.Errorf("%q: expected status %d after Close, got %d", tt.mode, tt.expectedCode, recorder.Code)
+		}
+	}
+}
+
+func TestContextCancellationReleasesResources(t *testing.T) {
+	dbPath := geoiptest.WriteCityDB(t)
+	snapshotDir := t.TempDir()
+	dbsBefore := sharedDBCount()
+	goroutinesBefore := runtime.NumGoroutine()
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	// Every dynamic configuration reload creates new instances and cancels
+	// the context of the old ones.
+	var blocks []*StateBlock
+	for i := 0; i < 20; i++ {
+		cfg := CreateConfig()
+		cfg.DBPath = dbPath
+		cfg.DBReloadInterval = "10ms"
+		cfg.CacheSnapshotPath = filepath.Join(snapshotDir, fmt.Sprintf("cache-%d.json", i))
+		cfg.CacheSnapshotInterval = "10ms"
+
+		ctx, cancel := context.WithCancel(context.Background())
+		handler, err := New(ctx, next, cfg, "lifecycle-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		blocks = append(blocks, handler.(*StateBlock))
+		cancel()
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for sharedDBCount() != dbsBefore || runtime.NumGoroutine() > goroutinesBefore {
+		if time.Now().After(deadline) {
+			t.Fatalf("leaked resources: %d databases and %d goroutines still running, started with %d and %d",
+				sharedDBCount(), runtime.NumGoroutine(), dbsBefore, goroutinesBefore)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for i, block := range blocks {
+		if !released(block.db) {
+			t.Fatalf("instance %d: database reader was not closed", i)
+		}
+		if _, err := os.Stat(block.snapshotPath); err != nil {
+			t.Errorf("instance %d: expected a final cache snapshot: %v", i, err)
+		}
+	}
+}
+
+func TestSwapWaitsForLookups(t *testing.T) {
+	owner := &StateBlock{name: "drain-test"}
+	for _, retire := range []string{"swap", "release"} {
+		old := &blockingDB{release: make(chan struct{})}
+		shared := &sharedDB{current: newDBHandle(old), users: make(map[*StateBlock]struct{})}
+		if retire == "release" {
+			shared.users[owner] = struct{}{}
+		}
+
+		h := shared.acquire()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			_, _, _ = h.db.Lookup(net.ParseIP(geoiptest.IPNewYork))
+			h.release()
+		}()
+		for atomic.LoadInt32(&old.lookups) == 0 {
+			runtime.Gosched()
+		}
+
+		if retire == "swap" {
+			shared.swap(&blockingDB{}, nil, dbStamp{})
+		} else {
+			shared.release(owner)
+		}
+		if atomic.LoadInt32(&old.closed) != 0 {
+			t.Fatalf("%s: database closed during a lookup", retire)
+		}
+		close(old.release)
+		<-done
+		if atomic.LoadInt32(&old.closed) == 0 {
+			t.Fatalf("%s: database not closed after the lookup finished", retire)
+		}
+	}
+}
+
+func TestConcurrentAcquireOpensOnce(t *testing.T) {
+	dbPath := geoiptest.WriteCityDB(t)
+	before := sharedDBCount()
+
+	owners := make([]*StateBlock, 8)
+	shared := make([]*sharedDB, len(owners))
+	var wg sync.WaitGroup
+	for i := range owners {
+		owners[i] = &StateBlock{name: fmt.Sprintf("acquire-test-%d", i)}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s, err := acquireDB("", dbPath, 0, owners[i])
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			shared[i] = s
+		}(i)
+	}
+	wg.Wait()
+
+	for i := range shared {
+		if shared[i] != shared[0] {
+			t.Fatalf("instance %d got a database of its own", i)
+		}
+	}
+	if got := sharedDBCount() - before; got != 1 {
+		t.Fatalf("expected 1 open database, got %d", got)
+	}
+	for _, owner := range owners {
+		shared[0].release(owner)
+	}
+	if got := sharedDBCount() - before; got != 0 {
+		t.Fatalf("expected no open databases, got %d", got)
+	}
+}
+
+// A configuration reload builds the new instances while the old ones are
+// closed, so instances join an entry while its last user releases it.
+func TestAcquireDuringLastRelease(t *testing.T) {
+	dbPath := geoiptest.WriteCityDB(t)
+	before := sharedDBCount()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			owner := &StateBlock{name: fmt.Sprintf("reload-test-%d", i)}
+			for j := 0; j < 1000; j++ {
+				s, err := acquireDB("", dbPath, 0, owner)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if released(s) {
+					t.Error("instance joined a released database")
+					return
+				}
+				s.release(owner)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if got := sharedDBCount() - before; got != 0 {
+		t.Fatalf("expected no open databases, got %d", got)
+	}
+}
+
+// Traefik closes a discarded instance while its router may still be serving
+// requests.
+func TestCloseWaitsForInFlightRequests(t *testing.T) {
+	db := &blockingDB{release: make(chan struct{})}
+	block := &StateBlock{
+		next:          http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}),
+		blockedStates: map[string]struct{}{"CA": {}},
+		name:          "close-test",
+		cache:         newDecisionCache(100, time.Hour, time.Hour),
+		flights:       newFlightGroup(),
+		closed:        make(chan struct{}),
+	}
+	block.db = &sharedDB{current: newDBHandle(db), users: map[*StateBlock]struct{}{block: {}}}
+
+	const requests = 5
+	codes := make([]int, requests)
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+			req.RemoteAddr = fmt.Sprintf("10.0.0.%d:1234", i+1)
+			recorder := httptest.NewRecorder()
+			block.ServeHTTP(recorder, req)
+			codes[i] = recorder.Code
+		}(i)
+	}
+	for atomic.LoadInt32(&db.lookups) < requests {
+		runtime.Gosched()
+	}
+
+	_ = block.Close()
+	if atomic.LoadInt32(&db.closed) != 0 {
+		t.Fatal("database closed while requests were looking up addresses")
+	}
+	close(db.release)
+	wg.Wait()
+	if atomic.LoadInt32(&db.closed) == 0 {
+		t.Fatal("database not closed after the requests finished")
+	}
+	for i, code := range codes {
+		if code != http.StatusForbidden {
+			t.Errorf("request %d: expected status %d, got %d", i, http.StatusForbidden, code)
+		}
+	}
+
+	// Later requests are blocked without touching the database.
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+	req.RemoteAddr = "10.0.1.1:1234"
+	recorder := httptest.NewRecorder()
+	block.ServeHTTP(recorder, req)
+	if lookups := atomic.LoadInt32(&db.lookups); recorder.Code != http.StatusForbidden || lookups != requests {
+		t.Errorf("expected the request to be blocked after Close, got %d after %d lookups", recorder.Code, lookups)
+	}
+}
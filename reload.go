@@ -0,0 +1,85 @@
+package traefik_plugin_state_geo
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// dbStamp identifies one version of the database on disk. For directory
+// based formats it covers every file in the directory.
+type dbStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func statDB(path string) (dbStamp, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return dbStamp{}, err
+	}
+	if !info.IsDir() {
+		return dbStamp{modTime: info.ModTime(), size: info.Size()}, nil
+	}
+
+	var stamp dbStamp
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return dbStamp{}, err
+	}
+	for _, entry := range entries {
+		fi, err := os.Stat(filepath.Join(path, entry.Name()))
+		if err != nil || fi.IsDir() {
+			continue
+		}
+		if fi.ModTime().After(stamp.modTime) {
+			stamp.modTime = fi.ModTime()
+		}
+		stamp.size += fi.Size()
+	}
+	return stamp, nil
+}
+
+// watch polls the database every interval and swaps in a fresh copy when it
+// changes on disk. A database that fails to load keeps the old one active.
+func (s *sharedDB) watch(ctx context.Context, interval time.Duration, stamp dbStamp) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		current, err := statDB(s.path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[%s] ERROR: failed to stat geoip database: %v\n", s.name, err)
+			continue
+		}
+		if current == stamp {
+			continue
+		}
+
+		info, _ := os.Stat(s.path)
+		db, err := openGeoDB(s.format, s.path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[%s] ERROR: failed to reload geoip database, keeping the previous one: %v\n",
+				s.name, err)
+			continue
+		}
+
+		// The entry may have been released while the file was loading.
+		if ctx.Err() != nil {
+			_ = db.Close()
+			return
+		}
+
+		stamp = current
+		s.swap(db, info, current)
+		fmt.Printf("[%s] INFO: Reloaded geoip database %s\n", s.name, s.path)
+	}
+}
@@ -0,0 +1,114 @@
+package traefik_plugin_state_geo
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const defaultReportOnlyHeader = "X-Geo-Would-Block"
+
+// reportOnlyUnknown counts would-be blocks of visitors without a location.
+const reportOnlyUnknown = "unknown"
+
+// reportOnly lets visitors through that would be blocked for their location,
+// either all of them or those from some jurisdictions, so the effect of a
+// policy can be watched before it is enforced.
+type reportOnly struct {
+	all           bool
+	jurisdictions map[string]struct{}
+	header        string
+
+	mu     sync.Mutex
+	counts map[string]uint64 // keyed by jurisdiction
+}
+
+func newReportOnly(config *Config) (*reportOnly, error) {
+	if !config.ReportOnly && len(config.ReportOnlyJurisdictions) == 0 {
+		if config.ReportOnlyHeader != "" {
+			return nil, fmt.Errorf("reportOnlyHeader needs reportOnly or reportOnlyJurisdictions")
+		}
+		return nil, nil
+	}
+
+	r := &reportOnly{
+		all:           config.ReportOnly,
+		jurisdictions: make(map[string]struct{}),
+		header:        defaultReportOnlyHeader,
+		counts:        make(map[string]uint64),
+	}
+	for _, jurisdiction := range config.ReportOnlyJurisdictions {
+		key := strings.ToUpper(strings.TrimSpace(jurisdiction))
+		if key == "" {
+			return nil, fmt.Errorf("invalid reportOnlyJurisdictions entry %q", jurisdiction)
+		}
+		r.jurisdictions[key] = struct{}{}
+	}
+	if config.ReportOnlyHeader != "" {
+		r.header = http.CanonicalHeaderKey(strings.TrimSpace(config.ReportOnlyHeader))
+		if r.header == "" || strings.ContainsAny(r.header, " \t\r\n:") {
+			return nil, fmt.Errorf("invalid reportOnlyHeader %q", config.ReportOnlyHeader)
+		}
+	}
+	return r, nil
+}
+
+// applies reports whether the block entry is only reported. The state of a
+// jurisdiction is matched before its country.
+func (r *reportOnly) applies(entry cacheEntry) bool {
+	if !locationReason(entry.reason) {
+		return false
+	}
+	if r.all {
+		return true
+	}
+	if entry.stateCode != "" {
+		if _, ok := r.jurisdictions[entry.jurisdiction()]; ok {
+			return true
+		}
+	}
+	_, ok := r.jurisdictions[entry.countryCode]
+	return ok && entry.countryCode != ""
+}
+
+func (r *reportOnly) count(jurisdiction string) {
+	if jurisdiction == "" {
+		jurisdiction = reportOnlyUnknown
+	}
+	r.mu.Lock()
+	r.counts[jurisdiction]++
+	r.mu.Unlock()
+}
+
+// ReportOnlyStats returns how many requests report-only mode let through
+// that would have been blocked, per jurisdiction: US-TX for states, the
+// country code elsewhere and "unknown" for visitors without a location. It
+// returns nil when report-only mode is off.
+func (a *StateBlock) ReportOnlyStats() map[string]uint64 {
+	r := a.reportOnly
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stats := make(map[string]uint64, len(r.counts))
+	for jurisdiction, n := range r.counts {
+		stats[jurisdiction] = n
+	}
+	return stats
+}
+
+// serveReportOnly lets a visitor through that entry would block. The
+// request and the response carry the block reason in the report-only
+// header.
+func (a *StateBlock) serveReportOnly(rw http.ResponseWriter, req *http.Request, entry cacheEntry) {
+	addr := clientAddr(req)
+	a.reportOnly.count(entry.jurisdiction())
+	fmt.Printf("[%s] INFO: Report-only: would block %s from %s (%s)\n",
+		a.name, getRemoteIP(req), entry.location(), entry.reason)
+
+	req.Header.Set(a.reportOnly.header, entry.reason)
+	rw.Header().Set(a.reportOnly.header, entry.reason)
+	a.forward(rw, req, addr, entry, entry.reason)
+}
@@ -0,0 +1,136 @@
+package traefik_plugin_state_geo
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/vikewoods/traefik-plugin-state-geo/internal/geoiptest"
+)
+
+func TestReportOnly(t *testing.T) {
+	tests := []struct {
+		name          string
+		global        bool
+		jurisdictions []string
+		ip            string
+		reported      string // the would-block reason, or empty when enforced
+		status        int
+	}{
+		{"global state", true, nil, geoiptest.IPCalifornia, "state_blocked", http.StatusOK},
+		{"global country", true, nil, geoiptest.IPUnitedKingdom, "country_blocked", http.StatusOK},
+		{"global unknown", true, nil, geoiptest.IPUnknown, "unknown_location", http.StatusOK},
+		{"global denied", true, nil, "192.0.2.10", "", http.StatusForbidden},
+		{"state", false, []string{"us-ca"}, geoiptest.IPCalifornia, "state_blocked", http.StatusOK},
+		{"state other", false, []string{"US-CA"}, geoiptest.IPTexas, "", http.StatusForbidden},
+		{"state country", false, []string{"US-CA"}, geoiptest.IPUnitedKingdom, "", http.StatusForbidden},
+		{"country", false, []string{"GB"}, geoiptest.IPUnitedKingdom, "country_blocked", http.StatusOK},
+		{"country of state", false, []string{"US"}, geoiptest.IPTexas, "state_blocked", http.StatusOK},
+		{"allowed", true, nil, geoiptest.IPNewYork, "", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := CreateConfig()
+			cfg.BlockedStates = []string{"CA", "TX"}
+			cfg.DeniedIPs = []string{"192.0.2.0/24"}
+			cfg.DBPath = geoiptest.WriteCityDB(t)
+			cfg.ReportOnly = tt.global
+			cfg.ReportOnlyJurisdictions = tt.jurisdictions
+
+			var forwarded bool
+			var backendValues []string
+			next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				forwarded = true
+				backendValues = req.Header.Values("X-Geo-Would-Block")
+			})
+			handler := newTestHandler(t, cfg, next)
+
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+			req.RemoteAddr = net.JoinHostPort(tt.ip, "1234")
+			// Spoofed by the client.
+			req.Header.Set("X-Geo-Would-Block", "forged")
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Errorf("expected status %d, got %d", tt.status, rec.Code)
+			}
+			if forwarded != (tt.status == http.StatusOK) {
+				t.Errorf("expected forwarded=%v", tt.status == http.StatusOK)
+			}
+			if got := rec.Header().Get("X-Geo-Would-Block"); got != tt.reported {
+				t.Errorf("expected response header %q, got %q", tt.reported, got)
+			}
+			if forwarded {
+				var want []string
+				if tt.reported != "" {
+					want = []string{tt.reported}
+				}
+				if !reflect.DeepEqual(backendValues, want) {
+					t.Errorf("expected backend header %q, got %q", want, backendValues)
+				}
+			}
+		})
+	}
+}
+
+func TestReportOnlyStats(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.BlockedStates = []string{"CA"}
+	cfg.DBPath = geoiptest.WriteCityDB(t)
+	cfg.ReportOnly = true
+	cfg.ReportOnlyHeader = "x-dry-run"
+
+	var backendValue string
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		backendValue = req.Header.Get("X-Dry-Run")
+	})
+	handler := newTestHandler(t, cfg, next)
+
+	// The second request of each address is answered from the cache.
+	ips := []string{
+		geoiptest.IPCalifornia, geoiptest.IPCalifornia, geoiptest.IPUnitedKingdom, geoiptest.IPUnknown,
+		geoiptest.IPNewYork,
+	}
+	for _, ip := range ips {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+		req.RemoteAddr = net.JoinHostPort(ip, "1234")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	if backendValue != "" {
+		t.Errorf("expected no header for an allowed visitor, got %q", backendValue)
+	}
+
+	want := map[string]uint64{"US-CA": 2, "GB": 1, "unknown": 1}
+	if got := handler.ReportOnlyStats(); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestReportOnlyConfig(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	invalid := []func(cfg *Config){
+		func(cfg *Config) { cfg.ReportOnlyHeader = "X-Would-Block" },
+		func(cfg *Config) { cfg.ReportOnly = true; cfg.ReportOnlyHeader = "X Would Block" },
+		func(cfg *Config) { cfg.ReportOnlyJurisdictions = []string{" "} },
+	}
+	for i, apply := range invalid {
+		cfg := CreateConfig()
+		cfg.DBPath = geoiptest.WriteCityDB(t)
+		apply(cfg)
+		if _, err := New(context.Background(), next, cfg, "report-only-config-test"); err == nil {
+			t.Errorf("expected config %d to be rejected", i)
+		}
+	}
+
+	cfg := CreateConfig()
+	cfg.DBPath = geoiptest.WriteCityDB(t)
+	if stats := newTestHandler(t, cfg, nil).ReportOnlyStats(); stats != nil {
+		t.Errorf("expected no stats without report-only mode, got %v", stats)
+	}
+}
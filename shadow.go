@@ -0,0 +1,160 @@
+package traefik_plugin_state_geo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	shadowEventName     = "shadow_disagreement"
+	shadowDecisionAllow = "allow"
+	shadowDecisionBlock = "block"
+)
+
+// shadowPolicy evaluates a candidate configuration for every request next
+// to the live one and reports where they disagree. It never answers
+// requests.
+type shadowPolicy struct {
+	evaluated uint64 // accessed atomically
+
+	name   string // of the live instance
+	policy *StateBlock
+	emit   func(shadowEvent)
+
+	mu            sync.Mutex
+	disagreements map[string]uint64 // keyed "<live reason>/<shadow reason>"
+}
+
+// shadowEvent is emitted for each request the policies decide differently.
+type shadowEvent struct {
+	Event      string         `json:"event"`
+	Middleware string         `json:"middleware"`
+	IP         string         `json:"ip"`
+	Host       string         `json:"host"`
+	Path       string         `json:"path"`
+	Live       shadowDecision `json:"live"`
+	Shadow     shadowDecision `json:"shadow"`
+}
+
+// shadowDecision is one side of a shadowEvent.
+type shadowDecision struct {
+	Decision     string `json:"decision"` // allow or block
+	Reason       string `json:"reason"`
+	Jurisdiction string `json:"jurisdiction,omitempty"`
+}
+
+// ShadowStats are the counters of the shadow policy.
+type ShadowStats struct {
+	// Evaluated counts the requests both policies decided on.
+	Evaluated uint64
+	// Disagreements counts the requests one policy allows and the other
+	// blocks, keyed by the live and the shadow reason, e.g. "allowed/state_blocked" for visitors
+	// the shadow policy would block for their state.
+	Disagreements map[string]uint64
+}
+
+// newShadowPolicy starts the shadow instance of config.Shadow. Database and
+// degraded mode options it leaves out are taken from the live configuration.
+// A shadow policy that cannot start is logged and left out, so it never
+// takes the live policy down with it.
+func newShadowPolicy(ctx context.Context, config *Config, name string) *shadowPolicy {
+	if config.Shadow == nil {
+		return nil
+	}
+	shadowConfig := *config.Shadow
+	if shadowConfig.Shadow != nil {
+		fmt.Fprintf(os.Stderr, "[%s] ERROR: ignoring shadow policy: a shadow policy cannot have a shadow\n", name)
+		return nil
+	}
+	if shadowConfig.DBPath == "" {
+		shadowConfig.DBPath = config.DBPath
+		shadowConfig.DBFormat = config.DBFormat
+		shadowConfig.DBReloadInterval = config.DBReloadInterval
+	}
+	if shadowConfig.DegradedMode == "" {
+		shadowConfig.DegradedMode = config.DegradedMode
+	}
+	if shadowConfig.DBRetryInterval == "" {
+		shadowConfig.DBRetryInterval = config.DBRetryInterval
+	}
+
+	handler, err := New(ctx, nil, &shadowConfig, name+".shadow")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[%s] ERROR: ignoring shadow policy: %v\n", name, err)
+		return nil
+	}
+	s := &shadowPolicy{
+		name:          name,
+		policy:        handler.(*StateBlock),
+		disagreements: make(map[string]uint64),
+	}
+	s.emit = s.log
+	return s
+}
+
+// compare evaluates req with the shadow policy and records a disagreement
+// with the live verdict. Policies disagree when one allows the request and
+// the other blocks it; allowing or blocking for different reasons, e.g. a
+// whitelisted path, is not a disagreement.
+func (s *shadowPolicy) compare(req *http.Request, live verdict) {
+	shadow := s.policy.evaluate(req)
+	atomic.AddUint64(&s.evaluated, 1)
+	if shadow.allowed == live.allowed {
+		return
+	}
+
+	s.mu.Lock()
+	s.disagreements[live.reason+"/"+shadow.reason]++
+	s.mu.Unlock()
+
+	s.emit(shadowEvent{
+		Event:      shadowEventName,
+		Middleware: s.name,
+		IP:         getRemoteIP(req),
+		Host:       req.Host,
+		Path:       req.URL.Path,
+		Live:       newShadowDecision(live),
+		Shadow:     newShadowDecision(shadow),
+	})
+}
+
+func newShadowDecision(v verdict) shadowDecision {
+	d := shadowDecision{Decision: shadowDecisionBlock, Reason: v.reason, Jurisdiction: v.entry.jurisdiction()}
+	if v.allowed {
+		d.Decision = shadowDecisionAllow
+	}
+	return d
+}
+
+// log writes the event as a JSON line, so log pipelines can pick the
+// disagreements out.
+func (s *shadowPolicy) log(event shadowEvent) {
+	line, err := json.Marshal(event)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[%s] ERROR: failed to encode shadow event: %v\n", s.name, err)
+		return
+	}
+	fmt.Printf("[%s] SHADOW: %s\n", s.name, line)
+}
+
+// ShadowStats returns the counters of the shadow policy, the zero value
+// when no shadow policy is configured.
+func (a *StateBlock) ShadowStats() ShadowStats {
+	s := a.shadow
+	if s == nil {
+		return ShadowStats{}
+	}
+	stats := ShadowStats{Evaluated: atomic.LoadUint64(&s.evaluated)}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats.Disagreements = make(map[string]uint64, len(s.disagreements))
+	for key, n := range s.disagreements {
+		stats.Disagreements[key] = n
+	}
+	return stats
+}
@@ -0,0 +1,173 @@
+package traefik_plugin_state_geo
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/vikewoods/traefik-plugin-state-geo/internal/geoiptest"
+)
+
+// captureShadowEvents collects the shadow events of a instead of logging
+// them.
+func captureShadowEvents(a *StateBlock) *[]shadowEvent {
+	events := &[]shadowEvent{}
+	a.shadow.emit = func(event shadowEvent) { *events = append(*events, event) }
+	return events
+}
+
+func serveShadowRequest(handler http.Handler, ip, path string) int {
+	req := httptest.NewRequest(http.MethodGet, "http://localhost"+path, nil)
+	req.RemoteAddr = net.JoinHostPort(ip, "1234")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestShadowPolicy(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.BlockedStates = []string{"CA"}
+	cfg.DBPath = geoiptest.WriteCityDB(t)
+	cfg.Shadow = &Config{
+		BlockedStates:    []string{"CA", "TX"},
+		WhitelistedIPs:   []string{geoiptest.IPCalifornia},
+		WhitelistedPaths: []string{"/health"},
+		PrecompilePolicy: true,
+	}
+	a := newTestHandler(t, cfg, nil)
+	events := captureShadowEvents(a)
+
+	tests := []struct {
+		ip     string
+		path   string
+		status int // of the live policy
+	}{
+		{geoiptest.IPNewYork, "/", http.StatusOK},
+		{geoiptest.IPCalifornia, "/", http.StatusForbidden},
+		{geoiptest.IPTexas, "/", http.StatusOK},
+		{geoiptest.IPTexas, "/", http.StatusOK}, // cached
+		{geoiptest.IPTexas, "/health", http.StatusOK},
+		{geoiptest.IPUnitedKingdom, "/", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		if status := serveShadowRequest(a, tt.ip, tt.path); status != tt.status {
+			t.Errorf("%s %s: expected status %d, got %d", tt.ip, tt.path, tt.status, status)
+		}
+	}
+
+	want := ShadowStats{
+		Evaluated: 6,
+		Disagreements: map[string]uint64{
+			"state_blocked/ip_whitelisted": 1,
+			"allowed/state_blocked":        2,
+		},
+	}
+	if stats := a.ShadowStats(); !reflect.DeepEqual(stats, want) {
+		t.Errorf("expected %+v, got %+v", want, stats)
+	}
+
+	// Allowing for different reasons, e.g. the shadow's whitelisted path,
+	// is no disagreement.
+	if len(*events) != 3 {
+		t.Fatalf("expected 3 events, got %+v", *events)
+	}
+	wantEvent := shadowEvent{
+		Event:      "shadow_disagreement",
+		Middleware: "TestShadowPolicy",
+		IP:         geoiptest.IPTexas,
+		Host:       "localhost",
+		Path:       "/",
+		Live:       shadowDecision{Decision: "allow", Reason: "allowed", Jurisdiction: "US-TX"},
+		Shadow:     shadowDecision{Decision: "block", Reason: "state_blocked", Jurisdiction: "US-TX"},
+	}
+	if got := (*events)[1]; got != wantEvent {
+		t.Errorf("expected %+v, got %+v", wantEvent, got)
+	}
+	got := (*events)[0]
+	if got.Live.Reason != "state_blocked" || got.Shadow.Decision != "allow" || got.Shadow.Jurisdiction != "" {
+		t.Errorf("unexpected event %+v", got)
+	}
+}
+
+func TestShadowPolicyDatabase(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.BlockedStates = []string{"CA"}
+	cfg.DBPath = geoiptest.WriteCityDB(t)
+	cfg.Shadow = &Config{
+		BlockedStates: []string{"CA"},
+		// The candidate database moves the New York address to California.
+		DBPath: geoiptest.WriteCityDB(t, geoiptest.Network{
+			CIDR: geoiptest.IPNewYork + "/32", IP: geoiptest.IPNewYork, Country: "US", Subdivision: "CA",
+		}),
+	}
+	a := newTestHandler(t, cfg, nil)
+	events := captureShadowEvents(a)
+
+	if status := serveShadowRequest(a, geoiptest.IPNewYork, "/"); status != http.StatusOK {
+		t.Errorf("expected the live policy to allow, got %d", status)
+	}
+	if len(*events) != 1 || (*events)[0].Live.Jurisdiction != "US-NY" || (*events)[0].Shadow.Jurisdiction != "US-CA" {
+		t.Errorf("unexpected events %+v", *events)
+	}
+
+	a.Close()
+	select {
+	case <-a.shadow.policy.closed:
+	default:
+		t.Error("expected Close to close the shadow policy")
+	}
+}
+
+func TestShadowPolicyConfig(t *testing.T) {
+	// A shadow policy that cannot start leaves the live one running alone.
+	invalid := []*Config{
+		{Shadow: &Config{}},
+		{DeniedIPs: []string{"not-an-ip"}},
+		{DBPath: "/nonexistent/geoip.mmdb"},
+	}
+	for i, shadow := range invalid {
+		cfg := CreateConfig()
+		cfg.BlockedStates = []string{"CA"}
+		cfg.DBPath = geoiptest.WriteCityDB(t)
+		cfg.Shadow = shadow
+		a := newTestHandler(t, cfg, nil)
+		if a.shadow != nil {
+			t.Errorf("expected shadow %d to be left out", i)
+		}
+		if status := serveShadowRequest(a, geoiptest.IPCalifornia, "/"); status != http.StatusForbidden {
+			t.Errorf("shadow %d: expected the live policy to block, got %d", i, status)
+		}
+	}
+
+	cfg := CreateConfig()
+	cfg.DBPath = geoiptest.WriteCityDB(t)
+	if stats := newTestHandler(t, cfg, nil).ShadowStats(); stats.Evaluated != 0 || stats.Disagreements != nil {
+		t.Errorf("expected no stats without a shadow policy, got %+v", stats)
+	}
+}
+
+func TestShadowPolicyDegradedStartup(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.BlockedStates = []string{"CA"}
+	cfg.DBPath = filepath.Join(t.TempDir(), "missing.mmdb")
+	cfg.DegradedMode = degradedFailOpen
+	cfg.DBRetryInterval = "10ms"
+	cfg.Shadow = &Config{BlockedStates: []string{"CA", "TX"}}
+	a := newTestHandler(t, cfg, nil)
+	events := captureShadowEvents(a)
+
+	if a.shadow.policy.degradedMode != degradedFailOpen || a.shadow.policy.retryInterval != 10*time.Millisecond {
+		t.Fatalf("expected the shadow policy to inherit the degraded mode options, got %q every %v",
+			a.shadow.policy.degradedMode, a.shadow.policy.retryInterval)
+	}
+	if status := serveShadowRequest(a, geoiptest.IPTexas, "/"); status != http.StatusOK {
+		t.Errorf("expected the live policy to fail open, got %d", status)
+	}
+	if len(*events) != 0 {
+		t.Errorf("expected both policies to fail open, got %+v", *events)
+	}
+}
@@ -0,0 +1,170 @@
+package traefik_plugin_state_geo
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultCacheSnapshotInterval = 5 * time.Minute
+	snapshotFormat               = 2
+)
+
+// cacheSnapshot is the on-disk form of the decision cache. It is only valid
+// for the database build and policy it was written with.
+type cacheSnapshot struct {
+	Format   int             `json:"format"`
+	Database string          `json:"database"`
+	Policy   string          `json:"policy"`
+	Entries  []snapshotEntry `json:"entries"`
+}
+
+type snapshotEntry struct {
+	Network string `json:"network"`
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason,omitempty"`
+	Country string `json:"country,omitempty"`
+	State   string `json:"state,omitempty"`
+	Expires int64  `json:"expires"`
+}
+
+// policyHash identifies the decisions a policy makes, so a snapshot is not
+// reused after blockedStates changes.
+func policyHash(blockedStates map[string]struct{}) string {
+	states := make([]string, 0, len(blockedStates))
+	for state := range blockedStates {
+		states = append(states, state)
+	}
+	sort.Strings(states)
+
+	sum := sha256.Sum256([]byte("blockedStates=" + strings.Join(states, ",")))
+	return hex.EncodeToString(sum[:])
+}
+
+// saveSnapshot writes the live cache entries to the snapshot path. The file
+// is replaced atomically, so a crash never leaves a truncated snapshot.
+func (a *StateBlock) saveSnapshot() error {
+	shared := a.currentDB()
+	if shared == nil {
+		// Nothing was cached before the database loaded.
+		return nil
+	}
+	version := shared.currentVersion()
+	if version == "" {
+		return errDBClosed
+	}
+
+	snap := cacheSnapshot{Format: snapshotFormat, Database: version, Policy: a.policy}
+	a.cache.each(func(key netip.Prefix, entry cacheEntry, expires time.Time) {
+		snap.Entries = append(snap.Entries, snapshotEntry{
+			Network: key.String(),
+			Allowed: entry.allowed,
+			Reason:  entry.reason,
+			Country: entry.countryCode,
+			State:   entry.stateCode,
+			Expires: expires.Unix(),
+		})
+	})
+
+	// A reload while collecting may have mixed decisions of two databases.
+	if shared.currentVersion() != version {
+		return nil
+	}
+
+	data, err := json.Marshal(&snap)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(a.snapshotPath), filepath.Base(a.snapshotPath)+".tmp*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), a.snapshotPath); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// loadSnapshot fills the cache from the snapshot path. Snapshots written for
+// another database build or policy are ignored, as are expired entries.
+func (a *StateBlock) loadSnapshot() error {
+	data, err := os.ReadFile(a.snapshotPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var snap cacheSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return fmt.Errorf("invalid cache snapshot: %w", err)
+	}
+	if snap.Format != snapshotFormat || snap.Database != a.currentDB().currentVersion() || snap.Policy != a.policy {
+		fmt.Printf("[%s] INFO: Ignoring cache snapshot %s, the database or policy changed\n", a.name, a.snapshotPath)
+		return nil
+	}
+
+	now := a.cache.now()
+	restored := 0
+	for _, entry := range snap.Entries {
+		prefix, err := netip.ParsePrefix(entry.Network)
+		if err != nil {
+			continue
+		}
+		expires := time.Unix(entry.Expires, 0)
+		if !now.Before(expires) {
+			continue
+		}
+		decision := cacheEntry{
+			allowed:     entry.Allowed,
+			reason:      entry.Reason,
+			countryCode: entry.Country,
+			stateCode:   entry.State,
+		}
+		a.cache.setUntil(prefix, decision, expires)
+		restored++
+	}
+	fmt.Printf("[%s] INFO: Restored %d cached decisions from %s\n", a.name, restored, a.snapshotPath)
+	return nil
+}
+
+// writeSnapshots saves the cache every interval until ctx is cancelled.
+func (a *StateBlock) writeSnapshots(ctx context.Context, interval time.Duration) {
+	defer close(a.snapshotDone)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := a.saveSnapshot(); err != nil {
+			fmt.Fprintf(os.Stderr, "[%s] ERROR: failed to write cache snapshot: %v\n", a.name, err)
+		}
+	}
+}
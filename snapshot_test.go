@@ -0,0 +1,141 @@
+package traefik_plugin_state_geo
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/vikewoods/traefik-plugin-state-geo/internal/geoiptest"
+)
+
+func serveIP(handler http.Handler, ip string) int {
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+	req.RemoteAddr = net.JoinHostPort(ip, "1234")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	return recorder.Code
+}
+
+func TestCacheSnapshotWarmStart(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.BlockedStates = []string{"CA"}
+	cfg.DBPath = geoiptest.WriteCityDB(t)
+	cfg.CacheSnapshotPath = filepath.Join(t.TempDir(), "cache.json")
+
+	first := newTestHandler(t, cfg, nil)
+	serveIP(first, geoiptest.IPNewYork)
+	serveIP(first, geoiptest.IPCalifornia)
+	first.Close()
+
+	second := newTestHandler(t, cfg, nil)
+
+	if entries := second.CacheStats().Entries; entries != 2 {
+		t.Fatalf("expected 2 restored entries, got %d", entries)
+	}
+	if code := serveIP(second, geoiptest.IPNewYork); code != http.StatusOK {
+		t.Errorf("expected NY visitor to be allowed, got %d", code)
+	}
+	if code := serveIP(second, geoiptest.IPCalifornia); code != http.StatusForbidden {
+		t.Errorf("expected CA visitor to be blocked, got %d", code)
+	}
+	if stats := second.CacheStats(); stats.Hits != 2 || stats.Misses != 0 {
+		t.Errorf("expected the restored entries to be hit, got %+v", stats)
+	}
+}
+
+func TestCacheSnapshotIgnoredWhenStale(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.BlockedStates = []string{"CA"}
+	cfg.DBPath = geoiptest.WriteCityDB(t)
+	cfg.CacheSnapshotPath = filepath.Join(t.TempDir(), "cache.json")
+
+	first := newTestHandler(t, cfg, nil)
+	serveIP(first, geoiptest.IPCalifornia)
+	first.Close()
+
+	// A different policy must not reuse decisions made under the old one.
+	cfg.BlockedStates = []string{"NY"}
+	changed := newTestHandler(t, cfg, nil)
+	if entries := changed.CacheStats().Entries; entries != 0 {
+		t.Errorf("expected the snapshot of another policy to be ignored, got %d entries", entries)
+	}
+	if code := serveIP(changed, geoiptest.IPCalifornia); code != http.StatusOK {
+		t.Errorf("expected CA visitor to be allowed under the new policy, got %d", code)
+	}
+	changed.Close()
+
+	// The same goes for a snapshot of another database build.
+	data, err := os.ReadFile(cfg.CacheSnapshotPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var snap cacheSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		t.Fatal(err)
+	}
+	snap.Database = "epoch:1"
+	snap.Policy = policyHash(map[string]struct{}{"CA": {}})
+	if data, err = json.Marshal(&snap); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(cfg.CacheSnapshotPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.BlockedStates = []string{"CA"}
+	rebuilt := newTestHandler(t, cfg, nil)
+	if entries := rebuilt.CacheStats().Entries; entries != 0 {
+		t.Errorf("expected the snapshot of another database build to be ignored, got %d entries", entries)
+	}
+}
+
+func TestCacheSnapshotSkipsExpiredEntries(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.BlockedStates = []string{"CA"}
+	cfg.DBPath = geoiptest.WriteCityDB(t)
+	cfg.CacheSnapshotPath = filepath.Join(t.TempDir(), "cache.json")
+
+	first := newTestHandler(t, cfg, nil)
+	serveIP(first, geoiptest.IPNewYork)
+	serveIP(first, geoiptest.IPCalifornia)
+	first.Close()
+
+	snapshotPath := cfg.CacheSnapshotPath
+	cfg.CacheSnapshotPath = ""
+	second := newTestHandler(t, cfg, nil)
+	second.snapshotPath = snapshotPath
+	// Blocked decisions live 10 minutes, allowed ones an hour.
+	second.cache.now = func() time.Time { return time.Now().Add(30 * time.Minute) }
+	if err := second.loadSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if entries := second.CacheStats().Entries; entries != 1 {
+		t.Errorf("expected only the allowed decision to be restored, got %d entries", entries)
+	}
+}
+
+func TestCacheSnapshotWrittenPeriodically(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DBPath = geoiptest.WriteCityDB(t)
+	cfg.CacheSnapshotPath = filepath.Join(t.TempDir(), "cache.json")
+	cfg.CacheSnapshotInterval = "10ms"
+	handler := newTestHandler(t, cfg, nil)
+
+	serveIP(handler, geoiptest.IPNewYork)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, err := os.Stat(cfg.CacheSnapshotPath); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("cache snapshot was not written")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -5,11 +5,11 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"strings"
 	"sync"
-
-	"github.com/oschwald/maxminddb-golang"
+	"time"
 )
 
 type Config struct {
@@ -17,7 +17,88 @@ type Config struct {
 	WhitelistedIPs   []string `json:"whitelistedIPs,omitempty"`
 	WhitelistedPaths []string `json:"whitelistedPaths,omitempty"`
 	DBPath           string   `json:"dbPath,omitempty"`
+	DBFormat         string   `json:"dbFormat,omitempty"`
+	DBReloadInterval string   `json:"dbReloadInterval,omitempty"`
 	TemplatePath     string   `json:"templatePath,omitempty"`
+	JSONTemplatePath string   `json:"jsonTemplatePath,omitempty"`
+	TextTemplatePath string   `json:"textTemplatePath,omitempty"`
+	SupportContact   string   `json:"supportContact,omitempty"`
+	DeniedIPs        []string `json:"deniedIPs,omitempty"`
+	CacheSize        int      `json:"cacheSize,omitempty"`
+	CacheAllowTTL    string   `json:"cacheAllowTTL,omitempty"`
+	CacheBlockTTL    string   `json:"cacheBlockTTL,omitempty"`
+	PrecompilePolicy bool     `json:"precompilePolicy,omitempty"`
+	Debug            bool     `json:"debug,omitempty"`
+
+	CacheSnapshotPath     string `json:"cacheSnapshotPath,omitempty"`
+	CacheSnapshotInterval string `json:"cacheSnapshotInterval,omitempty"`
+
+	DegradedMode        string `json:"degradedMode,omitempty"`
+	DBRetryInterval     string `json:"dbRetryInterval,omitempty"`
+	MaintenancePagePath string `json:"maintenancePagePath,omitempty"`
+
+	// StatusCode is the status of block responses, 403 by default.
+	// StatusCodes overrides it per reason code, e.g. 451 for state_blocked.
+	StatusCode  int            `json:"statusCode,omitempty"`
+	StatusCodes map[string]int `json:"statusCodes,omitempty"`
+	// BlockedBy is sent as a Link header with rel="blocked-by" (RFC 7725).
+	BlockedBy string `json:"blockedBy,omitempty"`
+
+	// Action is "block" (default) or "redirect". Redirect targets are URL
+	// templates; RedirectURLs are keyed by jurisdiction (US-NY or GB) and
+	// fall back to RedirectURL.
+	Action         string            `json:"action,omitempty"`
+	RedirectURL    string            `json:"redirectURL,omitempty"`
+	RedirectURLs   map[string]string `json:"redirectURLs,omitempty"`
+	RedirectStatus int               `json:"redirectStatus,omitempty"`
+
+	// Templates maps jurisdictions (US-NY or GB) to block page templates
+	// that replace TemplatePath for visitors from there.
+	Templates map[string]string `json:"templates,omitempty"`
+
+	// TemplateDir holds templates named by convention: blocked.html,
+	// blocked.json, blocked.txt and <jurisdiction>.html. Templates are
+	// reloaded when they change, checked every TemplateReloadInterval.
+	TemplateDir            string `json:"templateDir,omitempty"`
+	TemplateReloadInterval string `json:"templateReloadInterval,omitempty"`
+
+	// AssetsDir is served under AssetsPrefix (/__geoblock/assets/ by
+	// default) for block pages to link to, cached for AssetsMaxAge.
+	AssetsDir    string `json:"assetsDir,omitempty"`
+	AssetsPrefix string `json:"assetsPrefix,omitempty"`
+	AssetsMaxAge string `json:"assetsMaxAge,omitempty"`
+
+	// GeoHeaders maps request headers to the field they carry to the
+	// backend: country, subdivision, city, latitude, longitude, asn or
+	// reason. Incoming copies are always removed.
+	GeoHeaders map[string]string `json:"geoHeaders,omitempty"`
+
+	// AttestationKey signs an attestation of the decision that is sent to
+	// the backend in AttestationHeader (X-Geo-Attestation by default) and
+	// expires after AttestationTTL, see the attest package. It is
+	// "hmac-sha256:<base64 secret>" or "ed25519:<base64 seed>", inline or
+	// read from AttestationKeyPath.
+	AttestationKey     string `json:"attestationKey,omitempty"`
+	AttestationKeyPath string `json:"attestationKeyPath,omitempty"`
+	AttestationKeyID   string `json:"attestationKeyID,omitempty"`
+	AttestationHeader  string `json:"attestationHeader,omitempty"`
+	AttestationTTL     string `json:"attestationTTL,omitempty"`
+
+	// ReportOnly lets every visitor through that would be blocked for
+	// their location, ReportOnlyJurisdictions only those from there (US-TX
+	// or GB). They are logged, counted and marked with ReportOnlyHeader
+	// (X-Geo-Would-Block by default) on the request and the response.
+	ReportOnly              bool     `json:"reportOnly,omitempty"`
+	ReportOnlyJurisdictions []string `json:"reportOnlyJurisdictions,omitempty"`
+	ReportOnlyHeader        string   `json:"reportOnlyHeader,omitempty"`
+
+	// Shadow is a candidate configuration evaluated for every request next
+	// to this one without affecting it. Requests the two decide
+	// differently are logged and counted, see ShadowStats. Only the
+	// options that decide requests matter; the database and degraded mode
+	// options default to the ones above. A shadow that fails to start is
+	// logged and left out.
+	Shadow *Config `json:"shadow,omitempty"`
 }
 
 func CreateConfig() *Config {
@@ -29,31 +110,48 @@ func CreateConfig() *Config {
 	}
 }
 
-type cacheEntry struct {
-	allowed   bool
-	stateCode string
-}
-
 type StateBlock struct {
 	next             http.Handler
 	blockedStates    map[string]struct{}
-	whitelistedIPs   map[string]struct{}
+	whitelistedIPs   map[netip.Addr]struct{}
+	deniedIPs        *prefixTree
 	whitelistedPaths map[string]struct{}
-	db               *maxminddb.Reader
+	db               *sharedDB
+	dbMutex          sync.RWMutex
 	templatePath     string
-	templateCache    string
+	templates        blockTemplates
+	templateConfig   templateConfig
+	templateErr      error
+	templateMutex    sync.RWMutex
+	stopTemplates    context.CancelFunc
+	templatesDone    chan struct{}
+	supportContact   string
+	statusCodes      map[string]int
+	blockedBy        string
+	redirect         *redirector
+	assets           *assetServer
+	geoHeaders       *geoHeaders
+	attestor         *attestor
+	reportOnly       *reportOnly
+	shadow           *shadowPolicy
 	name             string
-	cache            map[string]cacheEntry
-	cacheMutex       sync.RWMutex
-}
-
-type geoRecord struct {
-	Country struct {
-		IsoCode string `maxminddb:"iso_code"`
-	} `maxminddb:"country"`
-	Subdivisions []struct {
-		IsoCode string `maxminddb:"iso_code"`
-	} `maxminddb:"subdivisions"`
+	cache            *decisionCache
+	flights          *flightGroup
+	precompile       bool
+	verdicts         *verdictTable
+	verdictMutex     sync.RWMutex
+	debug            bool
+	policy           string
+	snapshotPath     string
+	stopSnapshots    context.CancelFunc
+	snapshotDone     chan struct{}
+	closeOnce        sync.Once
+	closed           chan struct{}
+	degradedMode     string
+	retryInterval    time.Duration
+	maintenancePage  string
+	stopRetry        context.CancelFunc
+	retryDone        chan struct{}
 }
 
 func New(ctx context.Context, next http.Handler, config *Config, name string) (http.Handler, error) {
@@ -61,29 +159,116 @@ func New(ctx context.Context, next http.Handler, config *Config, name string) (h
 		return nil, fmt.Errorf("dbPath cannot be empty")
 	}
 
-	db, err := maxminddb.Open(config.DBPath)
+	var reloadInterval time.Duration
+	if config.DBReloadInterval != "" {
+		d, err := time.ParseDuration(config.DBReloadInterval)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid dbReloadInterval %q", config.DBReloadInterval)
+		}
+		reloadInterval = d
+	}
+
+	cacheSize := config.CacheSize
+	if cacheSize <= 0 {
+		cacheSize = defaultCacheSize
+	}
+	allowTTL, err := parseTTL("cacheAllowTTL", config.CacheAllowTTL, defaultCacheAllowTTL)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open geoip database: %w", err)
+		return nil, err
+	}
+	blockTTL, err := parseTTL("cacheBlockTTL", config.CacheBlockTTL, defaultCacheBlockTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshotInterval, err := parseTTL("cacheSnapshotInterval", config.CacheSnapshotInterval,
+		defaultCacheSnapshotInterval)
+	if err != nil {
+		return nil, err
 	}
 
-	var templateContent string
-	if config.TemplatePath != "" {
-		content, err := os.ReadFile(config.TemplatePath)
+	if !validDegradedMode(config.DegradedMode) {
+		return nil, fmt.Errorf("invalid degradedMode %q", config.DegradedMode)
+	}
+	retryInterval, err := parseTTL("dbRetryInterval", config.DBRetryInterval, defaultDBRetryInterval)
+	if err != nil {
+		return nil, err
+	}
+	maintenancePage := defaultMaintenancePage
+	if config.MaintenancePagePath != "" {
+		content, err := os.ReadFile(config.MaintenancePagePath)
 		if err == nil {
-			templateContent = string(content)
+			maintenancePage = string(content)
 		} else {
-			fmt.Fprintf(os.Stderr, "[%s] ERROR: failed to pre-load template: %v\n", name, err)
+			fmt.Fprintf(os.Stderr, "[%s] ERROR: failed to pre-load maintenance page: %v\n", name, err)
 		}
 	}
 
+	templateReloadInterval, err := parseTTL("templateReloadInterval", config.TemplateReloadInterval,
+		defaultTemplateReloadInterval)
+	if err != nil {
+		return nil, err
+	}
+	tmplConfig := newTemplateConfig(config)
+	// Stat before loading, so a change during the load is picked up.
+	templateStamp := tmplConfig.stat()
+	templates, err := loadBlockTemplates(tmplConfig, name, false)
+	if err != nil {
+		return nil, err
+	}
+
 	blockedMap := make(map[string]struct{})
 	for _, state := range config.BlockedStates {
 		blockedMap[strings.ToUpper(state)] = struct{}{}
 	}
 
-	whitelistMap := make(map[string]struct{})
+	whitelistMap := make(map[netip.Addr]struct{})
 	for _, ip := range config.WhitelistedIPs {
-		whitelistMap[ip] = struct{}{}
+		addr, err := netip.ParseAddr(strings.TrimSpace(ip))
+		if err != nil {
+			// Such entries never matched; they are not an error so that
+			// existing configurations keep loading.
+			fmt.Fprintf(os.Stderr, "[%s] ERROR: ignoring whitelistedIPs entry %q: not an IP address\n", name, ip)
+			continue
+		}
+		whitelistMap[addr.Unmap()] = struct{}{}
+	}
+
+	var deniedIPs *prefixTree
+	if len(config.DeniedIPs) > 0 {
+		deniedIPs = newPrefixTree()
+	}
+	for _, entry := range config.DeniedIPs {
+		prefix, err := parseIPOrPrefix(strings.TrimSpace(entry))
+		if err != nil {
+			return nil, fmt.Errorf("invalid deniedIPs entry %q", entry)
+		}
+		deniedIPs.insert(prefix, 0)
+	}
+
+	statusCodes, err := resolveStatusCodes(config.StatusCode, config.StatusCodes)
+	if err != nil {
+		return nil, err
+	}
+	redirect, err := newRedirector(config)
+	if err != nil {
+		return nil, err
+	}
+	assets, err := newAssetServer(config)
+	if err != nil {
+		return nil, err
+	}
+	geoHeaders, err := newGeoHeaders(config.GeoHeaders)
+	if err != nil {
+		return nil, err
+	}
+	attestor, err := newAttestor(config)
+	if err != nil {
+		return nil, err
+	}
+	reportOnly, err := newReportOnly(config)
+	if err != nil {
+		return nil, err
 	}
 
 	whitelistedPathsMap := make(map[string]struct{})
@@ -91,17 +276,238 @@ func New(ctx context.Context, next http.Handler, config *Config, name string) (h
 		whitelistedPathsMap[path] = struct{}{}
 	}
 
-	return &StateBlock{
+	a := &StateBlock{
 		blockedStates:    blockedMap,
 		whitelistedIPs:   whitelistMap,
+		deniedIPs:        deniedIPs,
 		whitelistedPaths: whitelistedPathsMap,
-		db:               db,
 		templatePath:     config.TemplatePath,
-		templateCache:    templateContent,
+		templates:        templates,
+		templateConfig:   tmplConfig,
+		supportContact:   config.SupportContact,
+		statusCodes:      statusCodes,
+		blockedBy:        config.BlockedBy,
+		redirect:         redirect,
+		assets:           assets,
+		geoHeaders:       geoHeaders,
+		attestor:         attestor,
+		reportOnly:       reportOnly,
 		next:             next,
 		name:             name,
-		cache:            make(map[string]cacheEntry),
-	}, nil
+		cache:            newDecisionCache(cacheSize, allowTTL, blockTTL),
+		flights:          newFlightGroup(),
+		precompile:       config.PrecompilePolicy,
+		debug:            config.Debug,
+		policy:           policyHash(blockedMap),
+		snapshotPath:     config.CacheSnapshotPath,
+		closed:           make(chan struct{}),
+		degradedMode:     config.DegradedMode,
+		retryInterval:    retryInterval,
+		maintenancePage:  maintenancePage,
+	}
+
+	db, err := acquireDB(config.DBFormat, config.DBPath, reloadInterval, a)
+	switch {
+	case err != nil && a.degradedMode == "":
+		return nil, fmt.Errorf("failed to open geoip database: %w", err)
+	case err != nil:
+		// Start anyway and keep retrying, so a database that is missing
+		// during a deploy does not take the router down.
+		fmt.Fprintf(os.Stderr, "[%s] ERROR: failed to open geoip database, starting in %s mode: %v\n",
+			name, a.degradedMode, err)
+		retryCtx, cancel := context.WithCancel(context.Background())
+		a.stopRetry = cancel
+		a.retryDone = make(chan struct{})
+		go a.retryDB(retryCtx, config.DBFormat, config.DBPath, reloadInterval)
+	default:
+		a.db = db
+		if a.precompile {
+			table, err := a.compileShared(db)
+			if err != nil {
+				a.db.release(a)
+				return nil, fmt.Errorf("failed to precompile policy: %w", err)
+			}
+			a.verdicts = table
+		}
+	}
+
+	if a.snapshotPath != "" {
+		if a.db != nil {
+			if err := a.loadSnapshot(); err != nil {
+				fmt.Fprintf(os.Stderr, "[%s] ERROR: failed to load cache snapshot: %v\n", name, err)
+			}
+		}
+		snapshotCtx, cancel := context.WithCancel(context.Background())
+		a.stopSnapshots = cancel
+		a.snapshotDone = make(chan struct{})
+		go a.writeSnapshots(snapshotCtx, snapshotInterval)
+	}
+
+	if tmplConfig.configured() {
+		templateCtx, cancel := context.WithCancel(context.Background())
+		a.stopTemplates = cancel
+		a.templatesDone = make(chan struct{})
+		go a.watchTemplates(templateCtx, templateReloadInterval, templateStamp)
+	}
+
+	a.shadow = newShadowPolicy(ctx, config, name)
+
+	// Traefik cancels ctx when it discards the instance, e.g. after a dynamic
+	// configuration reload.
+	if done := ctx.Done(); done != nil {
+		go func() {
+			select {
+			case <-done:
+				_ = a.Close()
+			case <-a.closed:
+			}
+		}()
+	}
+
+	return a, nil
+}
+
+// Close writes a final cache snapshot and releases the instance's reference
+// to the shared database. The database is closed once no instance uses it
+// anymore and the lookups still running on it, e.g. for requests the
+// discarded router is finishing, have returned. Requests that miss the cache
+// afterwards are answered according to degradedMode, blocked by default.
+// Close is called when the context passed to New is cancelled and is safe to
+// call more than once.
+func (a *StateBlock) Close() error {
+	a.closeOnce.Do(func() {
+		if a.closed != nil {
+			close(a.closed)
+		}
+		if a.stopSnapshots != nil {
+			a.stopSnapshots()
+			<-a.snapshotDone
+		}
+		if a.stopRetry != nil {
+			a.stopRetry()
+			<-a.retryDone
+		}
+		if a.stopTemplates != nil {
+			a.stopTemplates()
+			<-a.templatesDone
+		}
+		if a.stopSnapshots != nil {
+			if err := a.saveSnapshot(); err != nil {
+				fmt.Fprintf(os.Stderr, "[%s] ERROR: failed to write cache snapshot: %v\n", a.name, err)
+			}
+		}
+		if db := a.currentDB(); db != nil {
+			db.release(a)
+		}
+		if a.shadow != nil {
+			_ = a.shadow.policy.Close()
+		}
+	})
+	return nil
+}
+
+// currentDB returns the shared database, or nil while the instance runs in
+// degraded mode.
+func (a *StateBlock) currentDB() *sharedDB {
+	a.dbMutex.RLock()
+	defer a.dbMutex.RUnlock()
+	return a.db
+}
+
+func (a *StateBlock) setDB(db *sharedDB) {
+	a.dbMutex.Lock()
+	a.db = db
+	a.dbMutex.Unlock()
+}
+
+// CacheStats returns the decision cache counters.
+func (a *StateBlock) CacheStats() CacheStats {
+	stats := a.cache.stats()
+	stats.Coalesced = a.flights.coalesced()
+	return stats
+}
+
+// dbSwapped drops everything derived from the previous database. It runs on
+// the reload watcher, so requests keep being served from the cache-backed
+// lookup path while the policy is recompiled.
+func (a *StateBlock) dbSwapped(db geoDB) {
+	if a.precompile {
+		a.setVerdicts(nil)
+	}
+	a.cache.reset()
+	if !a.precompile {
+		return
+	}
+
+	table, err := compileVerdicts(db, a.decide)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[%s] ERROR: failed to precompile policy, falling back to lookups: %v\n", a.name, err)
+		return
+	}
+	a.setVerdicts(table)
+}
+
+func (a *StateBlock) currentVerdicts() *verdictTable {
+	a.verdictMutex.RLock()
+	defer a.verdictMutex.RUnlock()
+	return a.verdicts
+}
+
+func (a *StateBlock) setVerdicts(table *verdictTable) {
+	a.verdictMutex.Lock()
+	a.verdicts = table
+	a.verdictMutex.Unlock()
+}
+
+// decide applies the policy to a database record.
+func (a *StateBlock) decide(record geoResult) cacheEntry {
+	switch {
+	case record.CountryCode == "":
+		return cacheEntry{reason: reasonUnknownLocation}
+	case record.CountryCode != "US":
+		return cacheEntry{reason: reasonCountryBlocked, countryCode: record.CountryCode}
+	case record.SubdivisionCode == "":
+		return cacheEntry{reason: reasonUnknownLocation, countryCode: "US"}
+	}
+	entry := cacheEntry{allowed: true, countryCode: "US", stateCode: record.SubdivisionCode}
+	if _, blocked := a.blockedStates[record.SubdivisionCode]; blocked {
+		entry.allowed = false
+		entry.reason = reasonStateBlocked
+	}
+	return entry
+}
+
+func parseTTL(option, value string, fallback time.Duration) (time.Duration, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid %s %q", option, value)
+	}
+	return d, nil
+}
+
+// parseIPOrPrefix parses an address or a CIDR prefix. Addresses become
+// single-address prefixes, IPv4-mapped entries their IPv4 form.
+func parseIPOrPrefix(s string) (netip.Prefix, error) {
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+		prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+	}
+	return prefix.Masked(), nil
 }
 
 func (a *StateBlock) isPathWhitelisted(reqPath string) bool {
@@ -113,107 +519,197 @@ func (a *StateBlock) isPathWhitelisted(reqPath string) bool {
 	return false
 }
 
-func (a *StateBlock) serveBlocked(rw http.ResponseWriter, state string) {
-	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
-	rw.WriteHeader(http.StatusForbidden)
-
-	fmt.Printf("[%s] DEBUG: Blocking request from state: %s\n", a.name, state)
+// verdict is a policy's decision on one request.
+type verdict struct {
+	addr     netip.Addr // the client address, invalid when it is unknown
+	entry    cacheEntry
+	allowed  bool
+	reason   string // why the request is let through or blocked
+	degraded bool   // decided without a database, see degradedMode
+}
 
-	if a.templateCache != "" {
-		html := strings.ReplaceAll(a.templateCache, "{{STATE}}", state)
-		_, _ = rw.Write([]byte(html))
+// ServeHTTP does not allocate for whitelisted and cached allowed requests
+// unless geoHeaders, an attestation or a shadow policy are set.
+// Debug lines are guarded at the call site since formatting their arguments
+// allocates even when nothing is printed.
+func (a *StateBlock) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	// Block page assets are served by the middleware itself
+	if a.assets != nil && a.assets.match(req.URL.Path) {
+		a.assets.ServeHTTP(rw, req)
 		return
 	}
+	if a.reportOnly != nil {
+		// Only the middleware marks would-be blocks.
+		req.Header.Del(a.reportOnly.header)
+	}
 
-	_, _ = rw.Write([]byte(fmt.Sprintf("<h1>Access Denied</h1><p>State: %s</p>", state)))
+	v := a.evaluate(req)
+	if a.shadow != nil {
+		a.shadow.compare(req, v)
+	}
+	switch {
+	case v.degraded:
+		a.serveDegraded(rw, req)
+	case v.allowed:
+		a.forward(rw, req, v.addr, v.entry, v.reason)
+	default:
+		a.serveBlocked(rw, req, v.entry)
+	}
 }
 
-func (a *StateBlock) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	// 0. Check paths whitelist first
+// evaluate applies the policy to req without answering it.
+func (a *StateBlock) evaluate(req *http.Request) verdict {
+	// 0. Check paths whitelist
 	if a.isPathWhitelisted(req.URL.Path) {
-		fmt.Printf("[%s] DEBUG: Path %s is whitelisted, allowing\n", a.name, req.URL.Path)
-		a.next.ServeHTTP(rw, req)
-		return
+		if a.debug {
+			fmt.Printf("[%s] DEBUG: Path %s is whitelisted, allowing\n", a.name, req.URL.Path)
+		}
+		return verdict{allowed: true, reason: reasonPathWhitelisted}
 	}
 
 	ipStr := getRemoteIP(req)
+	addr, parseErr := netip.ParseAddr(ipStr)
+	addr = addr.Unmap()
 
 	// 1. Check Whitelist first (Static)
-	if _, ok := a.whitelistedIPs[ipStr]; ok {
-		fmt.Printf("[%s] DEBUG: IP %s is whitelisted, allowing\n", a.name, ipStr)
-		a.next.ServeHTTP(rw, req)
-		return
+	if _, ok := a.whitelistedIPs[addr]; ok {
+		if a.debug {
+			fmt.Printf("[%s] DEBUG: IP %s is whitelisted, allowing\n", a.name, ipStr)
+		}
+		return verdict{addr: addr, allowed: true, reason: reasonIPWhitelisted}
 	}
 
-	// 2. Check Decision Cache
-	a.cacheMutex.RLock()
-	entry, found := a.cache[ipStr]
-	a.cacheMutex.RUnlock()
-
-	if found {
-		if entry.allowed {
-			fmt.Printf("[%s] DEBUG: Cache hit for %s: ALLOWED\n", a.name, ipStr)
-			a.next.ServeHTTP(rw, req)
-		} else {
-			fmt.Printf("[%s] DEBUG: Cache hit for %s: BLOCKED (%s)\n", a.name, ipStr, entry.stateCode)
-			a.serveBlocked(rw, entry.stateCode)
+	// Static deny list
+	if a.deniedIPs != nil && parseErr == nil {
+		if _, _, denied := a.deniedIPs.lookup(addr); denied {
+			return verdict{addr: addr, entry: cacheEntry{reason: reasonIPDenied}, reason: reasonIPDenied}
 		}
-		return
 	}
 
-	// 3. Database Lookup
-	isAllowed := true
-	stateCode := ""
+	// No database yet, see degradedMode
+	if a.currentDB() == nil {
+		return a.degradedVerdict()
+	}
 
-	ip := net.ParseIP(ipStr)
-	if ip != nil {
-		var record geoRecord
-		err := a.db.Lookup(ip, &record)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "[%s] ERROR: GeoIP lookup failed for %s: %v\n", a.name, ipStr, err)
-		} else {
-			if record.Country.IsoCode != "US" {
-				isAllowed = false
-				stateCode = record.Country.IsoCode
-			} else if len(record.Subdivisions) > 0 {
-				stateCode = record.Subdivisions[0].IsoCode
-				if _, ok := a.blockedStates[stateCode]; ok {
-					isAllowed = false
+	// 2. Precompiled policy, a single trie lookup
+	if parseErr == nil {
+		if table := a.currentVerdicts(); table != nil {
+			entry, _ := table.lookup(addr)
+			return entryVerdict(addr, entry)
+		}
+	}
+
+	// 3. Check Decision Cache
+	if parseErr == nil {
+		if entry, found := a.cache.get(addr); found {
+			if a.debug {
+				if entry.allowed {
+					fmt.Printf("[%s] DEBUG: Cache hit for %s: ALLOWED\n", a.name, ipStr)
+				} else {
+					fmt.Printf("[%s] DEBUG: Cache hit for %s: BLOCKED (%s)\n", a.name, ipStr, entry.location())
 				}
-			} else {
-				isAllowed = false
-				stateCode = "Unknown"
 			}
+			return entryVerdict(addr, entry)
 		}
 	}
 
-	// 4. Update Cache
-	a.cacheMutex.Lock()
-	if len(a.cache) < 1000 {
-		a.cache[ipStr] = cacheEntry{allowed: isAllowed, stateCode: stateCode}
+	// 4. Database Lookup, coalesced with concurrent requests from the same IP
+	decision := cacheEntry{allowed: true}
+
+	if parseErr == nil {
+		entry, _, err := a.flights.do(addr, func() (cacheEntry, netip.Prefix, error) {
+			return a.lookup(addr)
+		})
+		if err == errDBClosed {
+			// Closed while its router still serves, see Close.
+			return a.degradedVerdict()
+		}
+		if err == nil {
+			decision = entry
+		}
 	}
-	a.cacheMutex.Unlock()
 
-	if !isAllowed {
-		a.serveBlocked(rw, stateCode)
-		return
+	if decision.allowed && a.debug {
+		fmt.Printf("[%s] DEBUG: New IP %s allowed (State: %s)\n", a.name, ipStr, decision.stateCode)
+	}
+	// Only a failed lookup allows without a location.
+	v := entryVerdict(addr, decision)
+	if decision.allowed && decision.countryCode == "" {
+		v.reason = reasonFailOpen
+	}
+	return v
+}
+
+// degradedVerdict is the verdict on requests that need a database the
+// instance does not have, see degradedMode.
+func (a *StateBlock) degradedVerdict() verdict {
+	if a.degradedMode == degradedFailOpen {
+		return verdict{degraded: true, allowed: true, reason: reasonFailOpen}
+	}
+	return verdict{degraded: true, reason: reasonDBUnavailable}
+}
+
+// entryVerdict is the verdict of a database decision.
+func entryVerdict(addr netip.Addr, entry cacheEntry) verdict {
+	if entry.allowed {
+		return verdict{addr: addr, entry: entry, allowed: true, reason: reasonAllowed}
+	}
+	return verdict{addr: addr, entry: entry, reason: entry.reason}
+}
+
+// lookup resolves addr in the database and caches the decision for the whole
+// network the record applies to. Failed lookups are not cached, so they are
+// retried on the next request.
+func (a *StateBlock) lookup(addr netip.Addr) (cacheEntry, netip.Prefix, error) {
+	var record geoResult
+	var network netip.Prefix
+	err := errDBClosed
+	// Read before the lookup, so a decision from a database that is swapped
+	// out meanwhile is not cached.
+	gen := a.cache.generation()
+	if shared := a.currentDB(); shared != nil {
+		if h := shared.acquire(); h != nil {
+			record, network, err = h.db.Lookup(net.IP(addr.AsSlice()))
+			h.release()
+		}
+	}
+	if err == errDBClosed {
+		return cacheEntry{}, netip.Prefix{}, err
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[%s] ERROR: GeoIP lookup failed for %s: %v\n", a.name, addr, err)
+		return cacheEntry{}, netip.Prefix{}, err
 	}
 
-	fmt.Printf("[%s] DEBUG: New IP %s allowed (State: %s)\n", a.name, ipStr, stateCode)
-	a.next.ServeHTTP(rw, req)
+	if !network.IsValid() || !network.Contains(addr) {
+		network = netip.PrefixFrom(addr, addr.BitLen())
+	}
+	decision := a.decide(record)
+	a.cache.setFrom(gen, network, decision)
+	return decision, network, nil
+}
+
+// clientAddr parses the client address of req, see getRemoteIP. It returns
+// the zero Addr when the address does not parse.
+func clientAddr(req *http.Request) netip.Addr {
+	addr, _ := netip.ParseAddr(getRemoteIP(req))
+	return addr.Unmap()
 }
 
+// getRemoteIP returns the client address as a substring of the request, so
+// it does not allocate.
 func getRemoteIP(req *http.Request) string {
 	// Check CF-Connecting-Ip header first
 	if cf := req.Header.Get("Cf-Connecting-Ip"); cf != "" {
 		return strings.TrimSpace(cf)
 	}
 
-	// Check X-Forwarded-For if behind proxies
+	// Check X-Forwarded-For if behind proxies, the client is the first entry
 	if xff := req.Header.Get("X-Forwarded-For"); xff != "" {
-		parts := strings.Split(xff, ",")
-		// Trim spaces
-		return strings.TrimSpace(parts[0])
+		if i := strings.IndexByte(xff, ','); i >= 0 {
+			xff = xff[:i]
+		}
+		return strings.TrimSpace(xff)
 	}
 
 	// Fallback to RemoteAddr
@@ -2,20 +2,36 @@ package traefik_plugin_state_geo
 
 import (
 	"context"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"strings"
 	"testing"
+
+	"github.com/vikewoods/traefik-plugin-state-geo/internal/geoiptest"
 )
 
-func TestStateBlock(t *testing.T) {
-	dbPath := "data/GeoLite2-City.mmdb"
-	templatePath := "data/blocked.html"
+// newTestHandler returns the instance New builds from cfg, closed when the
+// test ends. A nil next handler answers 200.
+func newTestHandler(tb testing.TB, cfg *Config, next http.Handler) *StateBlock {
+	tb.Helper()
 
-	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
-		t.Skip("GeoLite2-City.mmdb not found in data/ folder, skipping test")
+	if next == nil {
+		next = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
 	}
+	handler, err := New(context.Background(), next, cfg, tb.Name())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	block := handler.(*StateBlock)
+	tb.Cleanup(func() { _ = block.Close() })
+	return block
+}
+
+func TestStateBlock(t *testing.T) {
+	dbPath := geoiptest.WriteCityDB(t)
+	templatePath := "data/blocked.html"
 
 	if _, err := os.Stat(templatePath); os.IsNotExist(err) {
 		_ = os.MkdirAll("data", 0755)
@@ -103,11 +119,7 @@ func TestStateBlock(t *testing.T) {
 
 // NEW: Test specifically for whitelisted paths
 func TestPathWhitelist(t *testing.T) {
-	dbPath := "data/GeoLite2-City.mmdb"
-
-	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
-		t.Skip("GeoLite2-City.mmdb not found in data/ folder, skipping test")
-	}
+	dbPath := geoiptest.WriteCityDB(t)
 
 	cfg := CreateConfig()
 	cfg.BlockedStates = []string{"CA"}
@@ -208,11 +220,7 @@ func TestPathWhitelist(t *testing.T) {
 
 // NEW: Test path whitelist priority (should bypass geo-lookup entirely)
 func TestPathWhitelistBypassesGeoLookup(t *testing.T) {
-	dbPath := "data/GeoLite2-City.mmdb"
-
-	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
-		t.Skip("GeoLite2-City.mmdb not found in data/ folder, skipping test")
-	}
+	dbPath := geoiptest.WriteCityDB(t)
 
 	cfg := CreateConfig()
 	cfg.BlockedStates = []string{"CA", "NY", "TX"} // Block multiple states
@@ -249,11 +257,7 @@ func TestPathWhitelistBypassesGeoLookup(t *testing.T) {
 
 // NEW: Test X-Forwarded-For header with whitelisted paths
 func TestPathWhitelistWithProxyHeaders(t *testing.T) {
-	dbPath := "data/GeoLite2-City.mmdb"
-
-	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
-		t.Skip("GeoLite2-City.mmdb not found in data/ folder, skipping test")
-	}
+	dbPath := geoiptest.WriteCityDB(t)
 
 	cfg := CreateConfig()
 	cfg.BlockedStates = []string{"CA"}
@@ -282,3 +286,232 @@ func TestPathWhitelistWithProxyHeaders(t *testing.T) {
 		t.Errorf("Expected whitelisted path to work with X-Forwarded-For, got status %d", recorder.Code)
 	}
 }
+
+func TestDecisionMatrix(t *testing.T) {
+	for _, precompile := range []bool{false, true} {
+		testDecisionMatrix(t, precompile)
+	}
+}
+
+func testDecisionMatrix(t *testing.T, precompile bool) {
+	cfg := CreateConfig()
+	cfg.BlockedStates = []string{"CA", "wa"}
+	cfg.WhitelistedIPs = []string{geoiptest.IPUKWhitelisted}
+	cfg.DBPath = geoiptest.WriteCityDB(t)
+	cfg.PrecompilePolicy = precompile
+	handler := newTestHandler(t, cfg, nil)
+
+	tests := []struct {
+		name          string
+		ip            string
+		expectedCode  int
+		expectContent string
+	}{
+		{"Allowed state", geoiptest.IPNewYork, http.StatusOK, ""},
+		{"Allowed state (TX)", geoiptest.IPTexas, http.StatusOK, ""},
+		{"Blocked state", geoiptest.IPCalifornia, http.StatusForbidden, "CA"},
+		{"Blocked state (lower case config)", geoiptest.IPWashington, http.StatusForbidden, "WA"},
+		{"US without subdivision", geoiptest.IPUSNoSubdivision, http.StatusForbidden, "Unknown"},
+		{"Territory reported as country", geoiptest.IPPuertoRico, http.StatusForbidden, "PR"},
+		{"Territory (GU)", geoiptest.IPGuam, http.StatusForbidden, "GU"},
+		{"Foreign country", geoiptest.IPUnitedKingdom, http.StatusForbidden, "GB"},
+		{"Canada is not California", geoiptest.IPCanadaOntario, http.StatusForbidden, "CA"},
+		{"Foreign without subdivision", geoiptest.IPMexico, http.StatusForbidden, "MX"},
+		{"Record without location", geoiptest.IPNoLocation, http.StatusForbidden, ""},
+		{"Address not in database", geoiptest.IPUnknown, http.StatusForbidden, ""},
+		{"Whitelisted foreign IP", geoiptest.IPUKWhitelisted, http.StatusOK, ""},
+		{"IPv6 allowed state", geoiptest.IPv6NewYork, http.StatusOK, ""},
+		{"IPv6 blocked state", geoiptest.IPv6California, http.StatusForbidden, "CA"},
+		{"IPv6 foreign country", geoiptest.IPv6UnitedKingdom, http.StatusForbidden, "GB"},
+	}
+
+	// Run twice so the second pass is served from the decision cache.
+	for pass := 1; pass <= 2; pass++ {
+		for _, tt := range tests {
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+			req.RemoteAddr = net.JoinHostPort(tt.ip, "1234")
+
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+
+			if recorder.Code != tt.expectedCode {
+				t.Errorf("precompile=%v, pass %d, %s: expected status %d, got %d",
+					precompile, pass, tt.name, tt.expectedCode, recorder.Code)
+			}
+			if tt.expectContent != "" && !strings.Contains(recorder.Body.String(), tt.expectContent) {
+				t.Errorf("precompile=%v, pass %d, %s: expected body to contain %s, got %s",
+					precompile, pass, tt.name, tt.expectContent, recorder.Body.String())
+			}
+		}
+	}
+}
+
+func TestPrefixCacheHonorsOverrides(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.BlockedStates = []string{"CA"}
+	// A California override inside the Texas /16.
+	cfg.DBPath = geoiptest.WriteCityDB(t, geoiptest.Network{
+		CIDR: "23.116.5.0/24", Country: "US", Subdivision: "CA",
+	})
+	block := newTestHandler(t, cfg, nil)
+
+	serve := func(ip string) int {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+		req.RemoteAddr = net.JoinHostPort(ip, "1234")
+		recorder := httptest.NewRecorder()
+		block.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	tests := []struct {
+		ip           string
+		expectedCode int
+		cacheHit     bool
+	}{
+		// The override splits the /16, so the Texas address resolves to
+		// 23.116.0.0/22 and neighbouring networks need lookups of their own.
+		{geoiptest.IPTexas, http.StatusOK, false},
+		{"23.116.3.200", http.StatusOK, true},
+		{"23.116.5.10", http.StatusForbidden, false},
+		{"23.116.5.200", http.StatusForbidden, true},
+		{"23.116.4.255", http.StatusOK, false},
+		{"23.116.4.1", http.StatusOK, true},
+		{"23.116.200.1", http.StatusOK, false},
+		{"23.116.130.1", http.StatusOK, true},
+	}
+
+	for _, tt := range tests {
+		before := block.CacheStats().Hits
+		if code := serve(tt.ip); code != tt.expectedCode {
+			t.Errorf("%s: expected status %d, got %d", tt.ip, tt.expectedCode, code)
+		}
+		if hit := block.CacheStats().Hits > before; hit != tt.cacheHit {
+			t.Errorf("%s: expected cache hit %v, got %v", tt.ip, tt.cacheHit, hit)
+		}
+	}
+}
+
+var hotPathCases = []struct {
+	name       string
+	precompile bool
+	remoteAddr string
+	header     string
+}{
+	{"cached", false, "161.185.160.93:1234", ""},
+	{"cached IPv6", false, "[2600:1000::1]:1234", ""},
+	{"cached X-Forwarded-For", false, "127.0.0.1:1234", "161.185.160.93, 10.0.0.1"},
+	{"whitelisted", false, "140.228.62.31:1234", ""},
+	{"precompiled", true, "161.185.160.93:1234", ""},
+}
+
+func TestServeHTTPHotPathDoesNotAllocate(t *testing.T) {
+	if raceEnabled {
+		t.Skip("the race detector allocates")
+	}
+
+	for _, tc := range hotPathCases {
+		cfg := CreateConfig()
+		cfg.BlockedStates = []string{"CA"}
+		cfg.WhitelistedIPs = []string{geoiptest.IPUKWhitelisted}
+		cfg.DBPath = geoiptest.WriteCityDB(t)
+		cfg.PrecompilePolicy = tc.precompile
+		handler := newTestHandler(t, cfg, nil)
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+		req.RemoteAddr = tc.remoteAddr
+		if tc.header != "" {
+			req.Header.Set("X-Forwarded-For", tc.header)
+		}
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req) // fill the cache
+
+		allocs := testing.AllocsPerRun(100, func() {
+			handler.ServeHTTP(rw, req)
+		})
+		if allocs != 0 {
+			t.Errorf("%s: expected no allocations, got %v", tc.name, allocs)
+		}
+	}
+}
+
+func BenchmarkServeHTTP(b *testing.B) {
+	for _, tc := range hotPathCases {
+		b.Run(tc.name, func(b *testing.B) {
+			cfg := CreateConfig()
+			cfg.BlockedStates = []string{"CA"}
+			cfg.WhitelistedIPs = []string{geoiptest.IPUKWhitelisted}
+			cfg.DBPath = geoiptest.WriteCityDB(b)
+			cfg.PrecompilePolicy = tc.precompile
+			handler := newTestHandler(b, cfg, nil)
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+			req.RemoteAddr = tc.remoteAddr
+			if tc.header != "" {
+				req.Header.Set("X-Forwarded-For", tc.header)
+			}
+			rw := httptest.NewRecorder()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				handler.ServeHTTP(rw, req)
+			}
+		})
+	}
+}
+
+func TestDeniedIPs(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DBPath = geoiptest.WriteCityDB(t)
+	cfg.WhitelistedIPs = []string{"161.185.160.93"}
+	cfg.DeniedIPs = []string{"161.185.0.0/16", " 2600:1000::1 ", "::ffff:23.116.0.0/112"}
+	handler := newTestHandler(t, cfg, nil)
+
+	tests := []struct {
+		ip           string
+		expectedCode int
+	}{
+		{"161.185.160.94", http.StatusForbidden},
+		{"161.185.160.93", http.StatusOK}, // whitelisted wins
+		{"2600:1000::1", http.StatusForbidden},
+		{"2600:1000::2", http.StatusOK},
+		{geoiptest.IPTexas, http.StatusForbidden},
+		{"::ffff:23.116.1.1", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+		req.RemoteAddr = net.JoinHostPort(tt.ip, "1234")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+
+		if recorder.Code != tt.expectedCode {
+			t.Errorf("%s: expected status %d, got %d", tt.ip, tt.expectedCode, recorder.Code)
+		}
+	}
+}
+
+// Entries that are not addresses never matched and must not stop a
+// configuration from loading.
+func TestWhitelistedIPsIgnoresInvalidEntries(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DBPath = geoiptest.WriteCityDB(t)
+	cfg.WhitelistedIPs = []string{"140.228.62.0/24", "not-an-ip", geoiptest.IPUKWhitelisted}
+	handler := newTestHandler(t, cfg, nil)
+
+	tests := []struct {
+		ip           string
+		expectedCode int
+	}{
+		{geoiptest.IPUKWhitelisted, http.StatusOK},
+		{geoiptest.IPUnitedKingdom, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+		req.RemoteAddr = net.JoinHostPort(tt.ip, "1234")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+
+		if recorder.Code != tt.expectedCode {
+			t.Errorf("%s: expected status %d, got %d", tt.ip, tt.expectedCode, recorder.Code)
+		}
+	}
+}
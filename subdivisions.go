@@ -0,0 +1,70 @@
+package traefik_plugin_state_geo
+
+import "strings"
+
+// usSubdivisionCodes maps the subdivision names used by IP2Location and DB-IP
+// to the ISO 3166-2:US codes MaxMind reports, keyed by lower-case name.
+var usSubdivisionCodes = map[string]string{
+	"alabama":              "AL",
+	"alaska":               "AK",
+	"arizona":              "AZ",
+	"arkansas":             "AR",
+	"california":           "CA",
+	"colorado":             "CO",
+	"connecticut":          "CT",
+	"delaware":             "DE",
+	"district of columbia": "DC",
+	"washington, d.c.":     "DC",
+	"florida":              "FL",
+	"georgia":              "GA",
+	"hawaii":               "HI",
+	"idaho":                "ID",
+	"illinois":             "IL",
+	"indiana":              "IN",
+	"iowa":                 "IA",
+	"kansas":               "KS",
+	"kentucky":             "KY",
+	"louisiana":            "LA",
+	"maine":                "ME",
+	"maryland":             "MD",
+	"massachusetts":        "MA",
+	"michigan":             "MI",
+	"minnesota":            "MN",
+	"mississippi":          "MS",
+	"missouri":             "MO",
+	"montana":              "MT",
+	"nebraska":             "NE",
+	"nevada":               "NV",
+	"new hampshire":        "NH",
+	"new jersey":           "NJ",
+	"new mexico":           "NM",
+	"new york":             "NY",
+	"north carolina":       "NC",
+	"north dakota":         "ND",
+	"ohio":                 "OH",
+	"oklahoma":             "OK",
+	"oregon":               "OR",
+	"pennsylvania":         "PA",
+	"rhode island":         "RI",
+	"south carolina":       "SC",
+	"south dakota":         "SD",
+	"tennessee":            "TN",
+	"texas":                "TX",
+	"utah":                 "UT",
+	"vermont":              "VT",
+	"virginia":             "VA",
+	"washington":           "WA",
+	"west virginia":        "WV",
+	"wisconsin":            "WI",
+	"wyoming":              "WY",
+}
+
+// subdivisionCode resolves a subdivision name to its ISO code. Only US names
+// are known; everything else resolves to "" just like an mmdb record without
+// subdivisions would.
+func subdivisionCode(country, name string) string {
+	if country != "US" {
+		return ""
+	}
+	return usSubdivisionCodes[strings.ToLower(strings.TrimSpace(name))]
+}
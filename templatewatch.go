@@ -0,0 +1,195 @@
+package traefik_plugin_state_geo
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	defaultTemplateReloadInterval = 5 * time.Second
+
+	// templateDirBase is the name of the format templates in the template
+	// directory: blocked.html, blocked.json and blocked.txt.
+	templateDirBase = "blocked"
+)
+
+// templateFile is a template file and the option that configures it.
+type templateFile struct {
+	option string
+	path   string
+}
+
+// templateConfig are the template options. They are kept so the templates
+// can be reloaded when the files change.
+type templateConfig struct {
+	dir           string
+	html          templateFile
+	json          templateFile
+	text          templateFile
+	jurisdictions map[string]templateFile // keyed by upper-case jurisdiction
+}
+
+func newTemplateConfig(config *Config) templateConfig {
+	c := templateConfig{
+		dir:           config.TemplateDir,
+		html:          templateFile{option: "templatePath", path: config.TemplatePath},
+		json:          templateFile{option: "jsonTemplatePath", path: config.JSONTemplatePath},
+		text:          templateFile{option: "textTemplatePath", path: config.TextTemplatePath},
+		jurisdictions: make(map[string]templateFile),
+	}
+	for jurisdiction, path := range config.Templates {
+		c.jurisdictions[strings.ToUpper(jurisdiction)] = templateFile{option: "templates." + jurisdiction, path: path}
+	}
+	return c
+}
+
+// configured reports whether there are any templates to load and watch.
+func (c templateConfig) configured() bool {
+	return c.dir != "" || c.html.path != "" || c.json.path != "" || c.text.path != "" || len(c.jurisdictions) > 0
+}
+
+// withDir returns c with the templates of the template directory filled in
+// where no option names one: blocked.html, blocked.json and blocked.txt for
+// the formats and <jurisdiction>.html, e.g. US-NY.html, per jurisdiction.
+// Files with a language tag before the extension are the variants of these,
+// see loadTemplateSet. A missing directory is reported and adds nothing,
+// except on reload, see loadBlockTemplates.
+func (c templateConfig) withDir(name string, reload bool) (templateConfig, error) {
+	if c.dir == "" {
+		return c, nil
+	}
+	entries, err := os.ReadDir(c.dir)
+	if isMissingFile(err) && !reload {
+		fmt.Fprintf(os.Stderr, "[%s] ERROR: failed to read template directory: %v\n", name, err)
+		return c, nil
+	}
+	if err != nil {
+		return templateConfig{}, fmt.Errorf("invalid templateDir: %w", err)
+	}
+
+	jurisdictions := make(map[string]templateFile, len(c.jurisdictions))
+	for jurisdiction, file := range c.jurisdictions {
+		jurisdictions[jurisdiction] = file
+	}
+	c.jurisdictions = jurisdictions
+
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		stem := strings.TrimSuffix(entry.Name(), ext)
+		if entry.IsDir() || stem == "" || strings.Contains(stem, ".") {
+			continue
+		}
+		file := templateFile{option: "templateDir", path: filepath.Join(c.dir, entry.Name())}
+		switch {
+		case stem == templateDirBase && ext == ".html" && c.html.path == "":
+			c.html = file
+		case stem == templateDirBase && ext == ".json" && c.json.path == "":
+			c.json = file
+		case stem == templateDirBase && ext == ".txt" && c.text.path == "":
+			c.text = file
+		case stem != templateDirBase && ext == ".html":
+			if _, ok := c.jurisdictions[strings.ToUpper(stem)]; !ok {
+				c.jurisdictions[strings.ToUpper(stem)] = file
+			}
+		}
+	}
+	return c, nil
+}
+
+// stat returns a stamp covering every directory that holds templates, so
+// changed, added and removed templates and variants all change it.
+func (c templateConfig) stat() dbStamp {
+	dirs := make(map[string]struct{})
+	if c.dir != "" {
+		dirs[filepath.Clean(c.dir)] = struct{}{}
+	}
+	for _, file := range []templateFile{c.html, c.json, c.text} {
+		if file.path != "" {
+			dirs[filepath.Dir(file.path)] = struct{}{}
+		}
+	}
+	for _, file := range c.jurisdictions {
+		dirs[filepath.Dir(file.path)] = struct{}{}
+	}
+
+	var stamp dbStamp
+	for dir := range dirs {
+		// The directory itself changes when files are added, removed or
+		// renamed into place.
+		info, err := os.Stat(dir)
+		if err != nil {
+			continue
+		}
+		files, err := statDB(dir)
+		if err != nil {
+			continue
+		}
+		for _, t := range []time.Time{info.ModTime(), files.modTime} {
+			if t.After(stamp.modTime) {
+				stamp.modTime = t
+			}
+		}
+		stamp.size += files.size
+	}
+	return stamp
+}
+
+// currentTemplates returns the block templates in use.
+func (a *StateBlock) currentTemplates() blockTemplates {
+	a.templateMutex.RLock()
+	defer a.templateMutex.RUnlock()
+	return a.templates
+}
+
+// TemplateError returns why the last template reload failed while the
+// previous templates are still in use, or nil.
+func (a *StateBlock) TemplateError() error {
+	a.templateMutex.RLock()
+	defer a.templateMutex.RUnlock()
+	return a.templateErr
+}
+
+// watchTemplates polls the template directories every interval and swaps in
+// the reloaded templates when they change. Templates that fail to load keep
+// the previous ones in use until the files change again.
+func (a *StateBlock) watchTemplates(ctx context.Context, interval time.Duration, stamp dbStamp) {
+	defer close(a.templatesDone)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		current := a.templateConfig.stat()
+		if current == stamp {
+			continue
+		}
+		// A template that is still being written is retried once the write
+		// completes, as that changes the stamp again.
+		stamp = current
+
+		templates, err := loadBlockTemplates(a.templateConfig, a.name, true)
+		a.templateMutex.Lock()
+		if err == nil {
+			a.templates = templates
+		}
+		a.templateErr = err
+		a.templateMutex.Unlock()
+
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[%s] ERROR: failed to reload block templates, keeping the previous ones: %v\n",
+				a.name, err)
+			continue
+		}
+		fmt.Printf("[%s] INFO: Reloaded block templates\n", a.name)
+	}
+}
@@ -0,0 +1,206 @@
+package traefik_plugin_state_geo
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vikewoods/traefik-plugin-state-geo/internal/geoiptest"
+)
+
+func writeTemplateFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func serveTemplateRequest(handler http.Handler, ip, accept, language string) string {
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+	req.RemoteAddr = net.JoinHostPort(ip, "1234")
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	if language != "" {
+		req.Header.Set("Accept-Language", language)
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	return recorder.Body.String()
+}
+
+func TestTemplateDir(t *testing.T) {
+	dir := t.TempDir()
+	writeTemplateFiles(t, dir, map[string]string{
+		"blocked.html":    "html {{.Location}}",
+		"blocked.es.html": "html es {{.Location}}",
+		"blocked.json":    `{"reason":{{json .Reason}}}`,
+		"blocked.txt":     "text {{.Location}}",
+		"US-NY.html":      "new york",
+		"gb.html":         "united kingdom",
+		"gb.fr.html":      "royaume-uni",
+		"notes.md":        "{{.Broken",
+	})
+	if err := os.Mkdir(filepath.Join(dir, "US-TX.html"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := CreateConfig()
+	cfg.BlockedStates = []string{"CA", "NY"}
+	cfg.DBPath = geoiptest.WriteCityDB(t)
+	cfg.TemplateDir = dir
+	// Options take precedence over the directory.
+	cfg.TextTemplatePath = writeTemplate(t, "custom.txt", "custom {{.Location}}")
+	handler := newTestHandler(t, cfg, nil)
+
+	tests := []struct {
+		ip       string
+		accept   string
+		language string
+		expected string
+	}{
+		{geoiptest.IPCalifornia, "", "", "html CA"},
+		{geoiptest.IPCalifornia, "", "es", "html es CA"},
+		{geoiptest.IPCalifornia, "application/json", "", `{"reason":"state_blocked"}`},
+		{geoiptest.IPCalifornia, "text/plain", "", "custom CA"},
+		{geoiptest.IPNewYork, "", "es", "new york"},
+		{geoiptest.IPUnitedKingdom, "", "", "united kingdom"},
+		{geoiptest.IPUnitedKingdom, "", "fr", "royaume-uni"},
+		{geoiptest.IPMexico, "", "", "html MX"},
+	}
+
+	for _, tt := range tests {
+		if got := serveTemplateRequest(handler, tt.ip, tt.accept, tt.language); got != tt.expected {
+			t.Errorf("%s %q %q: expected %q, got %q", tt.ip, tt.accept, tt.language, tt.expected, got)
+		}
+	}
+}
+
+func TestBrokenTemplateDirFailsAtNew(t *testing.T) {
+	dir := t.TempDir()
+	writeTemplateFiles(t, dir, map[string]string{"US-NY.html": "{{.Broken"})
+
+	cfg := CreateConfig()
+	cfg.DBPath = geoiptest.WriteCityDB(t)
+	cfg.TemplateDir = dir
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	if _, err := New(context.Background(), next, cfg, "broken-template-dir-test"); err == nil {
+		t.Fatal("expected a broken template in templateDir to fail")
+	}
+}
+
+// waitForTemplate serves California until the body is expected.
+func waitForTemplate(t *testing.T, handler *StateBlock, expected string) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := serveTemplateRequest(handler, geoiptest.IPCalifornia, "", "")
+		if got == expected {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %q after the reload, got %q", expected, got)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestTemplateHotReload(t *testing.T) {
+	dir := t.TempDir()
+
+	cfg := CreateConfig()
+	cfg.BlockedStates = []string{"CA", "NY"}
+	cfg.DBPath = geoiptest.WriteCityDB(t)
+	cfg.TemplateDir = dir
+	cfg.TemplateReloadInterval = "10ms"
+	handler := newTestHandler(t, cfg, nil)
+
+	// Without templates the built-in page is served until one appears.
+	if got := serveTemplateRequest(handler, geoiptest.IPCalifornia, "", ""); !strings.Contains(got, "Access Denied") {
+		t.Fatalf("expected the built-in page, got %q", got)
+	}
+	writeTemplateFiles(t, dir, map[string]string{"blocked.html": "first {{.Location}}"})
+	waitForTemplate(t, handler, "first CA")
+
+	writeTemplateFiles(t, dir, map[string]string{"blocked.html": "second version {{.Location}}"})
+	waitForTemplate(t, handler, "second version CA")
+	if err := handler.TemplateError(); err != nil {
+		t.Fatalf("unexpected template error %v", err)
+	}
+
+	// A broken update keeps the last good templates and reports the error.
+	writeTemplateFiles(t, dir, map[string]string{"blocked.html": "broken {{.Location"})
+	deadline := time.Now().Add(5 * time.Second)
+	for handler.TemplateError() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the broken template to be reported")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := serveTemplateRequest(handler, geoiptest.IPCalifornia, "", ""); got != "second version CA" {
+		t.Errorf("expected the last good template, got %q", got)
+	}
+
+	writeTemplateFiles(t, dir, map[string]string{"blocked.html": "fixed {{.Location}}"})
+	waitForTemplate(t, handler, "fixed CA")
+	if err := handler.TemplateError(); err != nil {
+		t.Errorf("expected the error to clear after a good reload, got %v", err)
+	}
+}
+
+func TestTemplateReloadKeepsRemovedTemplate(t *testing.T) {
+	dir := t.TempDir()
+	writeTemplateFiles(t, dir, map[string]string{
+		"page.html":    "first {{.Location}}",
+		"page.es.html": "primero {{.Location}}",
+	})
+
+	cfg := CreateConfig()
+	cfg.BlockedStates = []string{"CA"}
+	cfg.DBPath = geoiptest.WriteCityDB(t)
+	cfg.TemplatePath = filepath.Join(dir, "page.html")
+	cfg.TemplateReloadInterval = "10ms"
+	handler := newTestHandler(t, cfg, nil)
+
+	// A removed language variant is left out.
+	if err := os.Remove(filepath.Join(dir, "page.es.html")); err != nil {
+		t.Fatal(err)
+	}
+	writeTemplateFiles(t, dir, map[string]string{"page.html": "second {{.Location}}"})
+	waitForTemplate(t, handler, "second CA")
+	if got := serveTemplateRequest(handler, geoiptest.IPCalifornia, "", "es"); got != "second CA" {
+		t.Errorf("expected the removed variant to be left out, got %q", got)
+	}
+
+	// A configured template that disappears is reported like a broken one.
+	if err := os.Remove(cfg.TemplatePath); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for handler.TemplateError() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the removed template to be reported")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := serveTemplateRequest(handler, geoiptest.IPCalifornia, "", ""); got != "second CA" {
+		t.Errorf("expected the last good template, got %q", got)
+	}
+
+	writeTemplateFiles(t, dir, map[string]string{"page.html": "restored {{.Location}}"})
+	waitForTemplate(t, handler, "restored CA")
+	if err := handler.TemplateError(); err != nil {
+		t.Errorf("expected the error to clear after a good reload, got %v", err)
+	}
+}
@@ -0,0 +1,201 @@
+package traefik_plugin_state_geo
+
+import (
+	"errors"
+	"net/netip"
+)
+
+// networkWalker is implemented by backends that can enumerate their
+// networks. walkNetworks calls fn for every network in ascending address
+// order, IPv4 networks as IPv4 prefixes. Networks must not overlap; addresses
+// that are not reported resolve to a zero geoResult.
+type networkWalker interface {
+	walkNetworks(fn func(prefix netip.Prefix, res geoResult)) error
+}
+
+var errNotWalkable = errors.New("database backend cannot enumerate its networks")
+
+// verdictTable is the policy compiled against every network of a database.
+// It answers a request with a single trie lookup instead of decoding a
+// database record.
+type verdictTable struct {
+	tree     *prefixTree
+	verdicts []cacheEntry
+}
+
+// lookup returns the verdict for addr and the network it applies to.
+func (t *verdictTable) lookup(addr netip.Addr) (cacheEntry, netip.Prefix) {
+	idx, network, found := t.tree.lookup(addr)
+	if !found {
+		// Not reached for tables built by compileVerdicts, which cover the
+		// whole address space.
+		return t.verdicts[0], network
+	}
+	return t.verdicts[idx], network
+}
+
+// compileShared compiles the verdicts of the database shared currently holds.
+func (a *StateBlock) compileShared(shared *sharedDB) (*verdictTable, error) {
+	h := shared.acquire()
+	if h == nil {
+		return nil, errDBClosed
+	}
+	defer h.release()
+	return compileVerdicts(h.db, a.decide)
+}
+
+// compileVerdicts evaluates decide for every network of db and stores the
+// result in a prefix tree. Neighbouring networks with the same verdict are
+// merged, so the table is much smaller than the database.
+func compileVerdicts(db geoDB, decide func(geoResult) cacheEntry) (*verdictTable, error) {
+	walker, ok := db.(networkWalker)
+	if !ok {
+		return nil, errNotWalkable
+	}
+
+	b := &verdictBuilder{
+		table:  &verdictTable{tree: newPrefixTree()},
+		index:  make(map[cacheEntry]int32),
+		decide: decide,
+	}
+	// Index 0 is the verdict for addresses the database does not know.
+	b.unknown = b.intern(decide(geoResult{}))
+	b.v4.next = netip.IPv4Unspecified()
+	b.v6.next = netip.IPv6Unspecified()
+
+	if err := walker.walkNetworks(b.add); err != nil {
+		return nil, err
+	}
+	if b.err != nil {
+		return nil, b.err
+	}
+	b.v4.finish(b, netip.AddrFrom4([4]byte{255, 255, 255, 255}))
+	b.v6.finish(b, maxIPv6)
+
+	// The tree stores IPv4 at ::ffff:0:0/96, so IPv6 networks there are
+	// dropped and IPv4 networks go in last.
+	for _, entry := range b.v6.out {
+		if entry.prefix.Bits() >= 96 && ipv4Mapped.Contains(entry.prefix.Addr()) {
+			continue
+		}
+		b.table.tree.insert(entry.prefix, entry.value)
+	}
+	for _, entry := range b.v4.out {
+		b.table.tree.insert(entry.prefix, entry.value)
+	}
+	return b.table, nil
+}
+
+type verdictBuilder struct {
+	table   *verdictTable
+	index   map[cacheEntry]int32
+	decide  func(geoResult) cacheEntry
+	unknown int32
+	v4, v6  familyBuilder
+	err     error
+}
+
+// familyBuilder merges the networks of one address family. Networks arrive
+// in ascending order; gaps between them get the unknown verdict, and two
+// sibling networks with the same verdict collapse into their parent.
+type familyBuilder struct {
+	next  netip.Addr // first address not covered yet
+	done  bool       // the end of the address space was reached
+	stack []verdictPrefix
+	out   []verdictPrefix
+}
+
+type verdictPrefix struct {
+	prefix netip.Prefix
+	value  int32
+}
+
+func (b *verdictBuilder) intern(v cacheEntry) int32 {
+	if idx, ok := b.index[v]; ok {
+		return idx
+	}
+	idx := int32(len(b.table.verdicts))
+	b.table.verdicts = append(b.table.verdicts, v)
+	b.index[v] = idx
+	return idx
+}
+
+func (b *verdictBuilder) add(prefix netip.Prefix, res geoResult) {
+	if b.err != nil {
+		return
+	}
+	prefix = prefix.Masked()
+	f := &b.v6
+	if prefix.Addr().Is4() {
+		f = &b.v4
+	}
+	if f.done || prefix.Addr().Less(f.next) {
+		b.err = errors.New("database networks are not in ascending order")
+		return
+	}
+
+	if f.next.Less(prefix.Addr()) {
+		f.addRange(b, f.next, prefix.Addr().Prev(), b.unknown)
+	}
+	f.push(prefix, b.intern(b.decide(res)))
+}
+
+func (f *familyBuilder) addRange(b *verdictBuilder, first, last netip.Addr, value int32) {
+	rangePrefixes(first, last, func(prefix netip.Prefix) {
+		f.push(prefix, value)
+	})
+}
+
+func (f *familyBuilder) push(prefix netip.Prefix, value int32) {
+	f.stack = append(f.stack, verdictPrefix{prefix: prefix, value: value})
+	for len(f.stack) >= 2 {
+		left, right := f.stack[len(f.stack)-2], f.stack[len(f.stack)-1]
+		bits := right.prefix.Bits()
+		if bits == 0 || left.prefix.Bits() != bits || left.value != right.value {
+			break
+		}
+		parent, _ := left.prefix.Addr().Prefix(bits - 1)
+		if parent.Addr() != left.prefix.Addr() || !parent.Contains(right.prefix.Addr()) {
+			break
+		}
+		f.stack = f.stack[:len(f.stack)-2]
+		f.stack = append(f.stack, verdictPrefix{prefix: parent, value: value})
+	}
+
+	// A right child that did not merge with its left sibling never will,
+	// and neither can anything below it, so the whole stack is final. The
+	// stack holds at most one left child per prefix length otherwise.
+	top := f.stack[len(f.stack)-1].prefix
+	if top.Bits() == 0 || isRightChild(top) {
+		f.out = append(f.out, f.stack...)
+		f.stack = f.stack[:0]
+	}
+
+	last := lastAddr(prefix)
+	if last == maxAddr(prefix.Addr()) {
+		f.done = true
+	} else {
+		f.next = last.Next()
+	}
+}
+
+// finish covers the rest of the family and flushes the remaining entries.
+func (f *familyBuilder) finish(b *verdictBuilder, max netip.Addr) {
+	if !f.done {
+		f.addRange(b, f.next, max, b.unknown)
+	}
+	f.out = append(f.out, f.stack...)
+	f.stack = nil
+}
+
+func isRightChild(prefix netip.Prefix) bool {
+	parent, _ := prefix.Addr().Prefix(prefix.Bits() - 1)
+	return parent.Addr() != prefix.Addr()
+}
+
+func maxAddr(addr netip.Addr) netip.Addr {
+	if addr.Is4() {
+		return netip.AddrFrom4([4]byte{255, 255, 255, 255})
+	}
+	return maxIPv6
+}
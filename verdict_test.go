@@ -0,0 +1,193 @@
+package traefik_plugin_state_geo
+
+import (
+	"math/rand"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vikewoods/traefik-plugin-state-geo/internal/geoiptest"
+)
+
+// verdictTestDBs opens one database per backend that can be precompiled.
+func verdictTestDBs(t *testing.T) map[string]geoDB {
+	t.Helper()
+
+	csvDir := t.TempDir()
+	writeGeoLite2CSV(t, csvDir, csvTestLocations)
+
+	dbipPath := filepath.Join(t.TempDir(), "dbip-city-lite.csv")
+	if err := os.WriteFile(dbipPath, []byte(dbipTestCSV), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ip2lPath := writeIP2LocationBIN(t,
+		[]ip2lTestRow{
+			{"0.0.0.0", "-", "-"},
+			{"76.79.129.0", "US", "California"},
+			{"76.79.130.0", "US", "California"},
+			{"76.79.131.0", "-", "-"},
+			{"161.185.160.0", "US", "New York"},
+			{"161.185.161.0", "-", "-"},
+		},
+		[]ip2lTestRow{
+			{"::", "-", "-"},
+			{"2600:1700::", "US", "Texas"},
+			{"2600:1701::", "-", "-"},
+		},
+		true,
+	)
+
+	dbs := make(map[string]geoDB)
+	for name, path := range map[string]string{
+		formatMMDB:        geoiptest.WriteCityDB(t),
+		formatCSV:         csvDir,
+		formatDBIP:        dbipPath,
+		formatIP2Location: ip2lPath,
+	} {
+		db, err := openGeoDB(name, path)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		t.Cleanup(func() { _ = db.Close() })
+		dbs[name] = db
+	}
+	return dbs
+}
+
+// verdictTestAddrs returns addresses around every network boundary of db
+// plus random addresses.
+func verdictTestAddrs(t *testing.T, db geoDB) []netip.Addr {
+	t.Helper()
+
+	var addrs []netip.Addr
+	err := db.(networkWalker).walkNetworks(func(prefix netip.Prefix, _ geoResult) {
+		first, last := prefix.Addr(), lastAddr(prefix)
+		addrs = append(addrs, first, last, first.Prev(), last.Next())
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		var b4 [4]byte
+		var b16 [16]byte
+		rng.Read(b4[:])
+		rng.Read(b16[:])
+		addrs = append(addrs, netip.AddrFrom4(b4), netip.AddrFrom16(b16))
+	}
+	fixed := []string{
+		geoiptest.IPCalifornia, geoiptest.IPNewYork, geoiptest.IPv6California, "2600:1700::1", "::ffff:1.2.3.4",
+	}
+	for _, ip := range fixed {
+		addrs = append(addrs, netip.MustParseAddr(ip))
+	}
+	return addrs
+}
+
+func TestCompiledVerdictsMatchLookups(t *testing.T) {
+	block := &StateBlock{blockedStates: map[string]struct{}{"CA": {}}}
+
+	for name, db := range verdictTestDBs(t) {
+		table, err := compileVerdicts(db, block.decide)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		for _, addr := range verdictTestAddrs(t, db) {
+			if !addr.IsValid() {
+				continue
+			}
+			addr = addr.Unmap()
+			res, _, err := db.Lookup(net.IP(addr.AsSlice()))
+			if err != nil {
+				t.Fatalf("%s: %s: %v", name, addr, err)
+			}
+			want := block.decide(res)
+			got, network := table.lookup(addr)
+			if got != want {
+				t.Errorf("%s: %s: compiled verdict %+v, lookup verdict %+v", name, addr, got, want)
+			}
+			if !network.Contains(addr) {
+				t.Errorf("%s: %s: verdict network %s does not contain the address", name, addr, network)
+			}
+		}
+	}
+}
+
+func TestCompiledVerdictsAreCompact(t *testing.T) {
+	db, err := openGeoDB(formatMMDB, geoiptest.WriteCityDB(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	allowAll := func(geoResult) cacheEntry { return cacheEntry{allowed: true} }
+	table, err := compileVerdicts(db, allowAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Everything collapses into ::/0 and 0.0.0.0/0, which sits at
+	// ::ffff:0:0/96 in the tree.
+	if n := table.tree.len(); n > 100 {
+		t.Errorf("expected a single verdict per family, tree has %d nodes", n)
+	}
+	if len(table.verdicts) != 1 {
+		t.Errorf("expected 1 distinct verdict, got %d", len(table.verdicts))
+	}
+}
+
+func TestCompileVerdictsRejectsUnorderedNetworks(t *testing.T) {
+	db := walkerFunc(func(fn func(netip.Prefix, geoResult)) error {
+		fn(netip.MustParsePrefix("10.0.0.0/8"), geoResult{CountryCode: "US"})
+		fn(netip.MustParsePrefix("9.0.0.0/8"), geoResult{CountryCode: "US"})
+		return nil
+	})
+
+	block := &StateBlock{}
+	if _, err := compileVerdicts(db, block.decide); err == nil {
+		t.Error("expected networks out of order to be rejected")
+	}
+}
+
+type walkerFunc func(fn func(netip.Prefix, geoResult)) error
+
+func (w walkerFunc) walkNetworks(fn func(netip.Prefix, geoResult)) error { return w(fn) }
+func (w walkerFunc) Lookup(net.IP) (geoResult, netip.Prefix, error) {
+	return geoResult{}, netip.Prefix{}, nil
+}
+func (w walkerFunc) Close() error { return nil }
+
+func BenchmarkVerdict(b *testing.B) {
+	db, err := openGeoDB(formatMMDB, geoiptest.WriteCityDB(b))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	block := &StateBlock{blockedStates: map[string]struct{}{"CA": {}}}
+	table, err := compileVerdicts(db, block.decide)
+	if err != nil {
+		b.Fatal(err)
+	}
+	addr := netip.MustParseAddr(geoiptest.IPNewYork)
+	ip := net.IP(addr.AsSlice())
+
+	b.Run("lookup", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			res, _, _ := db.Lookup(ip)
+			block.decide(res)
+		}
+	})
+	b.Run("precompiled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			table.lookup(addr)
+		}
+	})
+}